@@ -0,0 +1,243 @@
+//go:build js && wasm
+
+package asset
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"sync"
+	"syscall/js"
+)
+
+// Image is an image asset loaded into an HTML image element.
+type Image struct {
+	// Source is the image decoded in Go, or nil if the image was decoded by the browser only.
+	Source image.Image
+	// Element is the loaded HTML image element, ready to be drawn onto a canvas.
+	Element js.Value
+	// Width and Height is the size of the image.
+	Width, Height int
+}
+
+// Loader loads the assets served along with the page, caching them by their path.
+// The concurrent requests of the same asset are waiting for the same load.
+// The failed loads are not cached, so they are retried on the next request.
+type Loader struct {
+	mu       sync.Mutex
+	images   map[string]*pending
+	elements map[string]*pending
+}
+
+// pending is an asset being loaded, or already loaded.
+type pending struct {
+	done chan struct{}
+	img  *Image
+	err  error
+}
+
+// NewLoader creates a new asset loader with an empty cache.
+func NewLoader() *Loader {
+	return &Loader{
+		images:   make(map[string]*pending),
+		elements: make(map[string]*pending),
+	}
+}
+
+// Image returns the image located at the path, decoded in Go, loading it if it's not cached yet.
+// It blocks until the image is loaded, so it must not be called from the Javascript event handlers.
+func (l *Loader) Image(path string) (*Image, error) {
+	return l.load(l.images, path, func() (*Image, error) {
+		data, err := Fetch(path)
+		if err != nil {
+			return nil, err
+		}
+		return NewImage(data)
+	})
+}
+
+// Element returns the image located at the path, loading it if it's not cached yet. Unlike Image,
+// the image is decoded by the browser only, so it can be in any format the browser supports,
+// like GIF, WebP or SVG, but the returned image has no Source.
+// It blocks until the image is loaded, so it must not be called from the Javascript event handlers.
+func (l *Loader) Element(path string) (*Image, error) {
+	return l.load(l.elements, path, func() (*Image, error) {
+		resp, err := fetch(path)
+		if err != nil {
+			return nil, err
+		}
+		// The Blob keeps the media type of the response, which is needed by the SVG images.
+		blob, err := Await(resp.Call("blob"))
+		if err != nil {
+			return nil, fmt.Errorf("failed reading %s: %w", path, err)
+		}
+		return NewElement(blob)
+	})
+}
+
+// load returns the cached asset located at the path, or loads it with the provided function.
+func (l *Loader) load(cache map[string]*pending, path string, fn func() (*Image, error)) (*Image, error) {
+	l.mu.Lock()
+	p, ok := cache[path]
+	if !ok {
+		p = &pending{done: make(chan struct{})}
+		cache[path] = p
+	}
+	l.mu.Unlock()
+
+	if ok {
+		<-p.done
+		return p.img, p.err
+	}
+
+	img, err := fn()
+	if err != nil {
+		p.err = fmt.Errorf("failed loading %s: %w", path, err)
+		l.mu.Lock()
+		delete(cache, path)
+		l.mu.Unlock()
+	} else {
+		p.img = img
+	}
+	close(p.done)
+	return p.img, p.err
+}
+
+// NewImage decodes the image data and loads it into an HTML image element through a Blob URL,
+// waiting for the element to load. The image format must be PNG or JPEG.
+func NewImage(data []byte) (*Image, error) {
+	img, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	elem, err := NewElement(newBlob(data, "image/"+format))
+	if err != nil {
+		return nil, err
+	}
+	elem.Source = img
+	return elem, nil
+}
+
+// NewElement loads the Javascript Blob into an HTML image element through a Blob URL, waiting for
+// the element to load. The image is decoded by the browser only, so the returned image has no Source.
+func NewElement(blob js.Value) (*Image, error) {
+	url := js.Global().Get("URL").Call("createObjectURL", blob)
+	// The loaded image is kept by the element, so the URL can be released as soon as the element is loaded.
+	defer js.Global().Get("URL").Call("revokeObjectURL", url)
+
+	elem := js.Global().Get("document").Call("createElement", "img")
+	if err := awaitLoad(elem, url); err != nil {
+		return nil, err
+	}
+	return &Image{
+		Element: elem,
+		Width:   elem.Get("naturalWidth").Int(),
+		Height:  elem.Get("naturalHeight").Int(),
+	}, nil
+}
+
+// Fetch reads the file located at the URL, which is either absolute or relative to the page.
+// It blocks until the file is read, so it must not be called from the Javascript event handlers.
+func Fetch(url string) ([]byte, error) {
+	resp, err := fetch(url)
+	if err != nil {
+		return nil, err
+	}
+	return ReadBlob(resp)
+}
+
+// fetch requests the file located at the URL, returning the successful response.
+func fetch(url string) (js.Value, error) {
+	resp, err := Await(js.Global().Call("fetch", url))
+	if err != nil {
+		return js.Value{}, fmt.Errorf("failed fetching %s: %w", url, err)
+	}
+	if !resp.Get("ok").Bool() {
+		return js.Value{}, fmt.Errorf("failed fetching %s: %d %s", url, resp.Get("status").Int(), resp.Get("statusText").String())
+	}
+	return resp, nil
+}
+
+// ReadBlob reads the content of the Javascript object implementing the arrayBuffer method,
+// like a Blob, a File or a fetch Response.
+func ReadBlob(blob js.Value) ([]byte, error) {
+	buf, err := Await(blob.Call("arrayBuffer"))
+	if err != nil {
+		return nil, err
+	}
+	uint8Arr := js.Global().Get("Uint8Array").New(buf)
+	data := make([]byte, uint8Arr.Get("length").Int())
+	js.CopyBytesToGo(data, uint8Arr)
+	return data, nil
+}
+
+// Await blocks until the Javascript promise is settled, returning its value or the rejection reason as error.
+// It must not be called from the Javascript event handlers, since they can't block.
+func Await(promise js.Value) (js.Value, error) {
+	var (
+		value js.Value
+		err   error
+	)
+	done := make(chan struct{})
+	resolve := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		if len(args) > 0 {
+			value = args[0]
+		}
+		close(done)
+		return nil
+	})
+	defer resolve.Release()
+	reject := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		err = errors.New("promise rejected")
+		if len(args) > 0 {
+			err = errors.New(args[0].Call("toString").String())
+		}
+		close(done)
+		return nil
+	})
+	defer reject.Release()
+
+	promise.Call("then", resolve, reject)
+	<-done
+	return value, err
+}
+
+// awaitLoad sets the source of the HTML media element, blocking until its load or error event is fired.
+func awaitLoad(elem js.Value, src js.Value) error {
+	done := make(chan error, 1)
+	onLoad := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		done <- nil
+		return nil
+	})
+	defer onLoad.Release()
+	onError := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		done <- errors.New("the image element failed loading")
+		return nil
+	})
+	defer onError.Release()
+
+	opts := js.Global().Get("Object").New()
+	opts.Set("once", true)
+	elem.Call("addEventListener", "load", onLoad, opts)
+	elem.Call("addEventListener", "error", onError, opts)
+	elem.Set("src", src)
+
+	err := <-done
+	elem.Call("removeEventListener", "load", onLoad)
+	elem.Call("removeEventListener", "error", onError)
+	return err
+}
+
+// newBlob copies the data into a new Javascript Blob of the provided media type.
+func newBlob(data []byte, mimeType string) js.Value {
+	uint8Arr := js.Global().Get("Uint8Array").New(len(data))
+	js.CopyBytesToJS(uint8Arr, data)
+
+	opts := js.Global().Get("Object").New()
+	opts.Set("type", mimeType)
+	return js.Global().Get("Blob").New([]interface{}{uint8Arr}, opts)
+}
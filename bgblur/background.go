@@ -0,0 +1,185 @@
+//go:build js && wasm
+
+package bgblur
+
+import (
+	"fmt"
+	"syscall/js"
+)
+
+// Background defines what replaces the background behind the detected faces.
+type Background int
+
+const (
+	// BlurBackground blurs out the webcam frame.
+	BlurBackground Background = iota
+	// ColorBackground fills the background with a solid color.
+	ColorBackground
+	// ImageBackground replaces the background with a loaded image.
+	ImageBackground
+	// VideoBackground replaces the background with the frames of another video source.
+	VideoBackground
+)
+
+// bgColors are the solid background colors which can be cycled through.
+var bgColors = []string{"#00b140", "#0047bb", "#ffffff", "#202020"}
+
+// String returns the name of the background mode.
+func (b Background) String() string {
+	switch b {
+	case ColorBackground:
+		return "color"
+	case ImageBackground:
+		return "image"
+	case VideoBackground:
+		return "video"
+	default:
+		return "blur"
+	}
+}
+
+// drawBackground draws the replacement background over the whole canvas.
+// It reports false if the background source is not ready yet.
+func (c *Canvas) drawBackground() bool {
+	width, height := c.windowSize.width, c.windowSize.height
+
+	switch c.background {
+	case ColorBackground:
+		c.ctx.Set("fillStyle", c.bgColor)
+		c.ctx.Call("fillRect", 0, 0, width, height)
+	case ImageBackground:
+		if c.bgImage.IsUndefined() || !c.bgImage.Get("complete").Bool() {
+			return false
+		}
+		c.drawCover(c.bgImage, c.bgImage.Get("naturalWidth").Int(), c.bgImage.Get("naturalHeight").Int())
+	case VideoBackground:
+		// The video has no current frame until it reaches the HAVE_CURRENT_DATA state.
+		if c.bgVideo.IsUndefined() || c.bgVideo.Get("readyState").Int() < 2 {
+			return false
+		}
+		c.drawCover(c.bgVideo, c.bgVideo.Get("videoWidth").Int(), c.bgVideo.Get("videoHeight").Int())
+	default:
+		return false
+	}
+	return true
+}
+
+// drawCover scales the source to cover the whole canvas, preserving its aspect ratio and cropping the overflow.
+func (c *Canvas) drawCover(src js.Value, srcWidth, srcHeight int) {
+	if srcWidth == 0 || srcHeight == 0 {
+		return
+	}
+	width, height := float64(c.windowSize.width), float64(c.windowSize.height)
+	scale := width / float64(srcWidth)
+	if s := height / float64(srcHeight); s > scale {
+		scale = s
+	}
+	w, h := float64(srcWidth)*scale, float64(srcHeight)*scale
+	c.ctx.Call("drawImage", src, (width-w)/2, (height-h)/2, w, h)
+}
+
+// nextBackground switches to the next background mode having its source available.
+func (c *Canvas) nextBackground() {
+	for i := 0; i < 4; i++ {
+		c.background = (c.background + 1) % 4
+		switch {
+		case c.background == ImageBackground && c.bgImage.IsUndefined():
+			continue
+		case c.background == VideoBackground && c.bgVideo.IsUndefined():
+			continue
+		}
+		break
+	}
+	c.Log("Background: " + c.background.String())
+}
+
+// nextColor switches to the solid color background, selecting the next color.
+func (c *Canvas) nextColor() {
+	if c.background == ColorBackground {
+		c.colorIdx = (c.colorIdx + 1) % len(bgColors)
+	}
+	c.bgColor = bgColors[c.colorIdx]
+	c.background = ColorBackground
+}
+
+// loadBackgroundImage loads the image located at the path and uses it as background.
+// The image is decoded by the browser, so it can be in any format the browser supports.
+func (c *Canvas) loadBackgroundImage(file string) error {
+	img, err := c.assets.Element(file)
+	if err != nil {
+		return err
+	}
+	c.bgImage = img.Element
+	c.background = ImageBackground
+	return nil
+}
+
+// setBackgroundVideo uses the video source as background. The source is either
+// the URL of a video file, or a MediaStream, like a second camera or a screen capture.
+func (c *Canvas) setBackgroundVideo(src js.Value) {
+	if !c.bgVideo.IsUndefined() {
+		c.bgVideo.Call("pause")
+	}
+	video := c.doc.Call("createElement", "video")
+	video.Set("autoplay", 1)
+	video.Set("playsinline", 1)
+	video.Set("muted", true)
+	video.Set("loop", true)
+	if src.Type() == js.TypeString {
+		video.Set("crossOrigin", "anonymous")
+		video.Set("src", src)
+	} else {
+		video.Set("srcObject", src)
+	}
+	video.Call("play")
+
+	c.bgVideo = video
+	c.background = VideoBackground
+}
+
+// exposeBackground registers the background controls as a global Javascript object with the provided name:
+//
+//	mode([name])   returns the background mode, after changing it if a name ("blur", "color", "image" or "video") is provided
+//	color(css)     fills the background with the CSS color
+//	image(path)    replaces the background with the image located at the path
+//	video(source)  replaces the background with the video located at the URL, or with the MediaStream
+func (c *Canvas) exposeBackground(name string) {
+	api := js.Global().Get("Object").New()
+
+	api.Set("mode", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		if len(args) > 0 {
+			for _, b := range []Background{BlurBackground, ColorBackground, ImageBackground, VideoBackground} {
+				if b.String() == args[0].String() {
+					c.background = b
+				}
+			}
+		}
+		return c.background.String()
+	}))
+	api.Set("color", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		if len(args) > 0 {
+			c.bgColor = args[0].String()
+			c.background = ColorBackground
+		}
+		return nil
+	}))
+	api.Set("image", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		if len(args) > 0 {
+			file := args[0].String()
+			// The image is fetched and loaded asynchronously, which blocks, so it can't run in the event handler.
+			go func() {
+				if err := c.loadBackgroundImage(file); err != nil {
+					c.Log(fmt.Sprintf("failed loading the background image: %v", err))
+				}
+			}()
+		}
+		return nil
+	}))
+	api.Set("video", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		if len(args) > 0 {
+			c.setBackgroundVideo(args[0])
+		}
+		return nil
+	}))
+	js.Global().Set(name, api)
+}
@@ -8,9 +8,14 @@ import (
 	"math"
 	"syscall/js"
 
+	"github.com/esimov/pigo-wasm-demos/asset"
+	"github.com/esimov/pigo-wasm-demos/bgmodel"
+	"github.com/esimov/pigo-wasm-demos/blur"
 	"github.com/esimov/pigo-wasm-demos/detector"
+	"github.com/esimov/pigo-wasm-demos/mask"
 	"github.com/esimov/pigo-wasm-demos/pixels"
-	"github.com/esimov/stackblur-go"
+	"github.com/esimov/pigo-wasm-demos/segment"
+	pigocore "github.com/esimov/pigo/core"
 )
 
 // Canvas struct holds the Javascript objects needed for the Canvas creation
@@ -44,8 +49,36 @@ type Canvas struct {
 	showPupil  bool
 	showFrame  bool
 	blurRadius uint32
+	blurrer    *blur.Blurrer
+	maskKind   mask.Kind
+	segmented  bool
+	segmenter  *segment.Segmenter
+	modeled    bool
+	bgModel    *bgmodel.Model
+	matted     bool // the persons of the current frame are composited through a matte
+	graded     bool
+	dof        *depthOfField
+
+	// Background replacement related variables
+	background Background
+	bgColor    string
+	colorIdx   int
+	bgImage    js.Value
+	bgVideo    js.Value
+	assets     *asset.Loader
+
+	frame    *image.NRGBA
+	blurBuf  []uint8
+	matteBuf []uint8
+}
 
-	frame *image.NRGBA
+// detectedFace holds a detected face along with its facial features,
+// which are located only once per frame, then shared by the matte and the face mask.
+type detectedFace struct {
+	det                   []int
+	leftPupil, rightPupil *pigocore.Puploc
+	// contour is the face contour fitted over the facial landmarks, or nil if any of the pupils is missing.
+	contour *mask.Face
 }
 
 const (
@@ -90,6 +123,16 @@ func NewCanvas() *Canvas {
 	c.showPupil = false
 	c.showFrame = false
 	c.blurRadius = 20
+	c.blurrer = blur.NewBlurrer(blur.Stack)
+	c.maskKind = mask.Ellipse
+	c.segmented = true
+	c.segmenter = segment.NewSegmenter(segment.DefaultConfig())
+	c.bgModel = bgmodel.NewModel(bgmodel.DefaultConfig())
+	c.dof = newDepthOfField()
+	c.background = BlurBackground
+	c.bgColor = bgColors[0]
+	c.assets = asset.NewLoader()
+	c.exposeBackground("background")
 
 	pigo = detector.NewDetector()
 	return &c
@@ -99,6 +142,7 @@ func NewCanvas() *Canvas {
 func (c *Canvas) Render() error {
 	width, height := c.windowSize.width, c.windowSize.height
 	var data = make([]byte, width*height*4)
+	var gray = make([]byte, width*height)
 	c.done = make(chan struct{})
 
 	err := pigo.UnpackCascades()
@@ -125,17 +169,28 @@ func (c *Canvas) Render() error {
 			uint8Arr := js.Global().Get("Uint8Array").New(rgba)
 			js.CopyBytesToGo(data, uint8Arr)
 
-			{ // Blur out the background.
+			// The persons are located first, since the depth of field blur depends on their position.
+			gray = pixels.Grayscale(gray, data, pixels.BT709)
+			res := pigo.DetectFaces(gray, height, width)
+			faces := locateFaces(res)
+			matte := c.personMatte(data, faces)
+
+			// Blur out the background, unless it's replaced with another source.
+			if !c.drawBackground() {
 				rect := image.Rect(0, 0, width, height)
-				// Converts the buffer array to an image.
-				img := pixels.PixToImage(data, rect)
-				blurred, err := c.blurBackground(img)
-				if err != nil {
-					return err
+				// Copy the buffer array into the reusable frame image. The frame is blurred
+				// in place, so the original pixels are kept intact for the face detection.
+				c.frame = pixels.PixToNRGBA(c.frame, data, rect)
+				var blurred *image.NRGBA
+				if c.graded {
+					blurred = c.dof.blur(c.blurrer, c.frame, int(c.blurRadius), res, matte)
+				} else {
+					blurred = c.blurBackground(c.frame)
 				}
+				c.blurBuf = pixels.ImgToPixInto(c.blurBuf, blurred)
 
 				uint8Arr2 := js.Global().Get("Uint8Array").New(width * height * 4)
-				js.CopyBytesToJS(uint8Arr2, pixels.ImgToPix(blurred))
+				js.CopyBytesToJS(uint8Arr2, c.blurBuf)
 
 				uint8Clamped := js.Global().Get("Uint8ClampedArray").New(uint8Arr2)
 				rawData := js.Global().Get("ImageData").New(uint8Clamped, width, height)
@@ -144,18 +199,12 @@ func (c *Canvas) Render() error {
 				c.ctx.Call("putImageData", rawData, 0, 0)
 			}
 
-			{ // Face detection.
-				gray := pixels.RgbaToGrayscale(data, width, height)
-				res := pigo.DetectFaces(gray, height, width)
-
-				if err := c.drawDetection(res, imageData); err != nil {
-					return err
-				}
+			if c.matted = matte != nil; c.matted {
+				c.drawMatte(matte, imageData)
+			}
+			if err := c.drawDetection(faces, imageData); err != nil {
+				return err
 			}
-			// Reset the data slice to its default values to avoid unnecessary memory allocation.
-			// Otherwise, the GC won't clean up the memory address allocated by this slice
-			// and the memory will keep increasing by each iteration.
-			data = make([]byte, len(data))
 
 			c.window.Get("stats").Call("end")
 			return nil
@@ -236,67 +285,160 @@ func (c *Canvas) StartWebcam() (*Canvas, error) {
 	}
 }
 
-// blurFace blures out the detected face region
-func (c *Canvas) blurBackground(src image.Image) (*image.NRGBA, error) {
-	img, err := stackblur.Process(src, c.blurRadius)
-	if err != nil {
-		return nil, err
+// blurBackground blurs out the whole frame in place, with the selected blur kernel.
+func (c *Canvas) blurBackground(src *image.NRGBA) *image.NRGBA {
+	return c.blurrer.Blur(src, src, int(c.blurRadius))
+}
+
+// locateFaces locates the facial features of the faces detected with enough confidence.
+func locateFaces(dets [][]int) []detectedFace {
+	faces := make([]detectedFace, 0, len(dets))
+	for _, det := range dets {
+		if det[3] <= 50 {
+			continue
+		}
+		f := detectedFace{
+			det:        det,
+			leftPupil:  pigo.DetectLeftPupil(det),
+			rightPupil: pigo.DetectRightPupil(det),
+		}
+		if f.leftPupil != nil && f.rightPupil != nil {
+			f.contour = mask.NewFace(f.leftPupil, f.rightPupil, pigo.DetectLandmarkPoints(f.leftPupil, f.rightPupil))
+		}
+		faces = append(faces, f)
+	}
+	return faces
+}
+
+// personMatte returns the matte of the persons, combining the head and shoulders segmentation
+// with the foreground of the learned background plate. It returns nil if neither of them is available.
+func (c *Canvas) personMatte(data []uint8, detected []detectedFace) *image.Alpha {
+	width, height := c.windowSize.width, c.windowSize.height
+
+	var matte *image.Alpha
+	// The background model is fed on every frame, since it has to learn the plate before being used.
+	if c.modeled {
+		if fg := c.bgModel.Update(data, width, height); c.bgModel.Ready() {
+			matte = fg
+		}
+	}
+	if !c.segmented {
+		return matte
+	}
+
+	faces := make([]segment.Face, 0, len(detected))
+	for _, f := range detected {
+		face := segment.Face{
+			Center: mask.Point{X: float64(f.det[1]), Y: float64(f.det[0])},
+			Scale:  float64(f.det[2]),
+		}
+		if f.contour != nil {
+			face.Angle = math.Atan2(float64(f.rightPupil.Row-f.leftPupil.Row), float64(f.rightPupil.Col-f.leftPupil.Col))
+			face.Contour = f.contour.Contour()
+		}
+		faces = append(faces, face)
+	}
+	seg := c.segmenter.Segment(data, width, height, faces)
+	if matte == nil {
+		return seg
+	}
+	// The foreground mask is reused by the next update, so the segmentation can be merged into it.
+	for i, a := range seg.Pix {
+		if a > matte.Pix[i] {
+			matte.Pix[i] = a
+		}
 	}
+	return matte
+}
+
+// drawMatte composites the persons from the original frame over the background through the matte.
+func (c *Canvas) drawMatte(matte *image.Alpha, imageData js.Value) {
+	width, height := c.windowSize.width, c.windowSize.height
+
+	c.matteBuf = pixels.AlphaToPixInto(c.matteBuf, matte)
+	uint8Arr := js.Global().Get("Uint8Array").New(width * height * 4)
+	js.CopyBytesToJS(uint8Arr, c.matteBuf)
+
+	uint8Clamped := js.Global().Get("Uint8ClampedArray").New(uint8Arr)
+	rawData := js.Global().Get("ImageData").New(uint8Clamped, width, height)
+
+	c.ctxEllipse.Call("setTransform", 1, 0, 0, 1, 0, 0)
+	c.ctxEllipse.Call("putImageData", rawData, 0, 0)
+
+	// Cut out the persons from the original frame with the matte, then draw them over the background.
+	c.ctxFace.Call("putImageData", imageData, 0, 0)
+	c.ctxFace.Call("save")
+	c.ctxFace.Set("globalCompositeOperation", "destination-in")
+	c.ctxFace.Call("drawImage", c.ellipse, 0, 0)
+	c.ctxFace.Call("restore")
 
-	return img, nil
+	c.ctx.Call("drawImage", c.face, 0, 0)
 }
 
 // drawDetection draws the detected faces and eyes.
-func (c *Canvas) drawDetection(dets [][]int, imageData js.Value) error {
+func (c *Canvas) drawDetection(faces []detectedFace, imageData js.Value) error {
 	var scaleX, scaleY, invScaleX, invScaleY float64
 	var grad js.Value
 
-	for _, det := range dets {
-		leftPupil := pigo.DetectLeftPupil(det)
-		rightPupil := pigo.DetectRightPupil(det)
-
-		if det[3] > 50 {
-			c.ctx.Call("beginPath")
-			c.ctx.Set("lineWidth", 2)
-			c.ctx.Set("strokeStyle", "rgba(255, 0, 0, 0.5)")
-
-			row, col, scale := det[1], det[0], int(float64(det[2])*1.2)
-			scx, scy := int(float64(scale)*0.8/1.6), int(float64(scale)*0.8/2.1)
-			rx, ry := scx/2, scy/2
-
-			// Create an ellipse radial gradient.
-			if rx >= ry {
-				scaleX, invScaleX = 1, 1
-				scaleY = float64(rx) / float64(ry)
-				invScaleY = float64(ry) / float64(rx)
-				grad = c.ctxEllipse.Call("createRadialGradient", scale/2, float64(scale/2)*invScaleY, 0, scale/2, float64(scale/2)*invScaleY, scx)
+	for _, f := range faces {
+		det, leftPupil, rightPupil := f.det, f.leftPupil, f.rightPupil
+
+		c.ctx.Call("beginPath")
+		c.ctx.Set("lineWidth", 2)
+		c.ctx.Set("strokeStyle", "rgba(255, 0, 0, 0.5)")
+
+		row, col, scale := det[1], det[0], int(float64(det[2])*1.2)
+
+		// The persons are already composited through the matte.
+		if !c.matted {
+			// The face contour requires both of the pupils, otherwise fall back to the ellipse mask.
+			useContour := c.maskKind == mask.Contour && f.contour != nil
+			if useContour {
+				c.ctxEllipse.Call("setTransform", 1, 0, 0, 1, 0, 0)
+				c.ctxEllipse.Call("clearRect", 0, 0, c.windowSize.width, c.windowSize.height)
+				c.ctxEllipse.Call("putImageData", mask.ToImageData(f.contour, row-scale/2, col-scale/2, scale), 0, 0)
 			} else {
-				scaleY, invScaleY = 1, 1
-				scaleX = float64(ry) / float64(rx)
-				invScaleX = float64(rx) / float64(ry)
-				grad = c.ctxEllipse.Call("createRadialGradient", float64(scale/2)*invScaleX, scale/2, 0, float64(scale/2)*invScaleX, scale/2, scy)
-			}
+				scx, scy := int(float64(scale)*0.8/1.6), int(float64(scale)*0.8/2.1)
+				rx, ry := scx/2, scy/2
+
+				// Create an ellipse radial gradient.
+				if rx >= ry {
+					scaleX, invScaleX = 1, 1
+					scaleY = float64(rx) / float64(ry)
+					invScaleY = float64(ry) / float64(rx)
+					grad = c.ctxEllipse.Call("createRadialGradient", scale/2, float64(scale/2)*invScaleY, 0, scale/2, float64(scale/2)*invScaleY, scx)
+				} else {
+					scaleY, invScaleY = 1, 1
+					scaleX = float64(ry) / float64(rx)
+					invScaleX = float64(rx) / float64(ry)
+					grad = c.ctxEllipse.Call("createRadialGradient", float64(scale/2)*invScaleX, scale/2, 0, float64(scale/2)*invScaleX, scale/2, scy)
+				}
 
-			grad.Call("addColorStop", 0.55, "rgba(0, 0, 0, 255)")
-			grad.Call("addColorStop", 0.75, "rgba(255, 255, 255, 0)")
+				grad.Call("addColorStop", 0.55, "rgba(0, 0, 0, 255)")
+				grad.Call("addColorStop", 0.75, "rgba(255, 255, 255, 0)")
 
-			// Clear the canvas on each frame.
-			c.ctxEllipse.Call("clearRect", 0, 0, c.windowSize.width, c.windowSize.height)
-			c.ctxEllipse.Call("setTransform", scaleX, 0, 0, scaleY, 0, 0)
+				// Clear the canvas on each frame.
+				c.ctxEllipse.Call("clearRect", 0, 0, c.windowSize.width, c.windowSize.height)
+				c.ctxEllipse.Call("setTransform", scaleX, 0, 0, scaleY, 0, 0)
 
-			c.ctxEllipse.Set("fillStyle", grad)
-			c.ctxEllipse.Call("fillRect", 0, 0, float64(scale)*invScaleX, float64(scale)*invScaleY)
+				c.ctxEllipse.Set("fillStyle", grad)
+				c.ctxEllipse.Call("fillRect", 0, 0, float64(scale)*invScaleX, float64(scale)*invScaleY)
+			}
 
 			// Replace the underlying face region with the original image.
 			c.ctxFace.Call("putImageData", imageData, 0, 0)
 
-			// Calculate the lean angle between the eyes.
-			angle := 1 - (math.Atan2(float64(rightPupil.Col-leftPupil.Col), float64(rightPupil.Row-leftPupil.Row)) * 180 / math.Pi / 90)
-
 			c.ctxFace.Call("save")
-			c.ctxFace.Call("translate", float64(scale)*invScaleX, float64(scale)*invScaleY)
-			c.ctxFace.Call("rotate", js.ValueOf(angle).Float())
-			c.ctxFace.Call("translate", float64(-scale)*invScaleX, float64(-scale)*invScaleY)
+			// The face contour is already fitted over the facial landmarks, so it needs no rotation,
+			// while the ellipse is rotated only if both of the pupils are detected.
+			if !useContour && f.contour != nil {
+				// Calculate the lean angle between the eyes.
+				angle := 1 - (math.Atan2(float64(rightPupil.Col-leftPupil.Col), float64(rightPupil.Row-leftPupil.Row)) * 180 / math.Pi / 90)
+
+				c.ctxFace.Call("translate", float64(scale)*invScaleX, float64(scale)*invScaleY)
+				c.ctxFace.Call("rotate", js.ValueOf(angle).Float())
+				c.ctxFace.Call("translate", float64(-scale)*invScaleX, float64(-scale)*invScaleY)
+			}
 
 			// Apply the ellipse mask over the source image by using composite operation.
 			c.ctxFace.Set("globalCompositeOperation", "destination-in")
@@ -305,26 +447,26 @@ func (c *Canvas) drawDetection(dets [][]int, imageData js.Value) error {
 
 			// Apply the ellipse mask over the blurred face by using composite operation.
 			c.ctx.Call("drawImage", c.face, 0, 0)
+		}
 
-			if c.showFrame {
-				c.ctx.Call("rect", row-scale/2, col-scale/2, scale, scale)
-				c.ctx.Call("stroke")
-			}
+		if c.showFrame {
+			c.ctx.Call("rect", row-scale/2, col-scale/2, scale, scale)
+			c.ctx.Call("stroke")
+		}
 
-			if c.showPupil {
-				if leftPupil != nil {
-					col, row, scale := leftPupil.Col, leftPupil.Row, leftPupil.Scale/8
-					c.ctx.Call("moveTo", col+int(scale), row)
-					c.ctx.Call("arc", col, row, scale, 0, 2*math.Pi, true)
-				}
+		if c.showPupil {
+			if leftPupil != nil {
+				col, row, scale := leftPupil.Col, leftPupil.Row, leftPupil.Scale/8
+				c.ctx.Call("moveTo", col+int(scale), row)
+				c.ctx.Call("arc", col, row, scale, 0, 2*math.Pi, true)
+			}
 
-				if rightPupil != nil {
-					col, row, scale := rightPupil.Col, rightPupil.Row, rightPupil.Scale/8
-					c.ctx.Call("moveTo", col+int(scale), row)
-					c.ctx.Call("arc", col, row, scale, 0, 2*math.Pi, true)
-				}
-				c.ctx.Call("stroke")
+			if rightPupil != nil {
+				col, row, scale := rightPupil.Col, rightPupil.Row, rightPupil.Scale/8
+				c.ctx.Call("moveTo", col+int(scale), row)
+				c.ctx.Call("arc", col, row, scale, 0, 2*math.Pi, true)
 			}
+			c.ctx.Call("stroke")
 		}
 	}
 	return nil
@@ -339,6 +481,44 @@ func (c *Canvas) detectKeyPress() {
 			c.showPupil = !c.showPupil
 		case keyCode.String() == "f":
 			c.showFrame = !c.showFrame
+		case keyCode.String() == "m":
+			if c.maskKind == mask.Ellipse {
+				c.maskKind = mask.Contour
+			} else {
+				c.maskKind = mask.Ellipse
+			}
+		case keyCode.String() == "p":
+			c.segmented = !c.segmented
+			c.segmenter.Reset()
+		case keyCode.String() == "l":
+			c.modeled = !c.modeled
+			c.bgModel.Relearn()
+			if c.modeled {
+				c.Log("Learning the background, step out of the frame...")
+			}
+		case keyCode.String() == "r":
+			c.bgModel.Relearn()
+		case keyCode.String() == "b":
+			c.nextBackground()
+		case keyCode.String() == "c":
+			c.nextColor()
+		case keyCode.String() == "d":
+			c.graded = !c.graded
+		case keyCode.String() == ".":
+			if c.dof.falloff < maxFalloff {
+				c.dof.falloff += 0.25
+			}
+		case keyCode.String() == ",":
+			if c.dof.falloff > minFalloff {
+				c.dof.falloff -= 0.25
+			}
+		case keyCode.String() == "k":
+			c.blurrer.Kernel = (c.blurrer.Kernel + 1) % blur.Kernels
+			c.Log("Blur kernel: " + c.blurrer.Kernel.String())
+		case keyCode.String() == "a":
+			// The line kernel is symmetric, so the directions are repeating after a half turn.
+			c.blurrer.Angle = math.Mod(c.blurrer.Angle+45, 180)
+			c.Log(fmt.Sprintf("Motion blur angle: %g°", c.blurrer.Angle))
 		case keyCode.String() == "]":
 			if c.blurRadius <= maxBlurRadius {
 				c.blurRadius++
@@ -0,0 +1,190 @@
+//go:build js && wasm
+
+package bgblur
+
+import (
+	"image"
+	"math"
+
+	"github.com/esimov/pigo-wasm-demos/blur"
+	"github.com/esimov/pigo-wasm-demos/pixels"
+)
+
+const (
+	// dofLevels is the number of blurred copies of the frame, having evenly increasing blur radii.
+	dofLevels = 3
+	// dofDownscale is the factor by which the distance field is downscaled relative to the frame.
+	dofDownscale = 4
+
+	minFalloff = 0.5
+	maxFalloff = 6
+)
+
+// depthOfField blurs the frame with a radius growing with the distance from the persons,
+// imitating the shallow depth of field of a camera focused on them. The frame is blurred
+// with a few increasing radii, then each pixel is blended between the two levels closest
+// to the radius required by its distance.
+type depthOfField struct {
+	// focus is the distance from the persons, relative to the face scale, up to which the background stays sharp.
+	focus float64
+	// falloff is the distance beyond the focus, relative to the face scale, over which the blur reaches its radius.
+	falloff float64
+
+	w, h   int
+	dist   []float64 // distance field from the persons, in frame pixels
+	levels [dofLevels + 1]*image.NRGBA
+	dst    *image.NRGBA
+}
+
+// newDepthOfField creates a new depth of field blur with the default focus and falloff.
+func newDepthOfField() *depthOfField {
+	return &depthOfField{
+		focus:   0.3,
+		falloff: 2,
+	}
+}
+
+// blur blurs the frame with the radius graded by the distance from the persons. The persons are located
+// by the matte if it's available, otherwise by the detected face boxes. If no person is detected,
+// the frame is uniformly blurred with the provided radius. The blurrer selects the blur kernel.
+func (d *depthOfField) blur(blurrer *blur.Blurrer, src *image.NRGBA, radius int, dets [][]int, matte *image.Alpha) *image.NRGBA {
+	b := src.Bounds()
+	width, height := b.Dx(), b.Dy()
+	d.init(width, height)
+
+	var scale float64
+	var faces int
+	for _, det := range dets {
+		if det[3] > 50 {
+			scale += float64(det[2])
+			faces++
+		}
+	}
+	if faces == 0 {
+		return blurrer.Blur(src, src, radius)
+	}
+	scale /= float64(faces)
+
+	d.seed(dets, matte)
+	d.distanceTransform()
+
+	// The levels are kept between the frames, so the blurrer reuses them as destination images.
+	d.levels[0] = src
+	for i := 1; i <= dofLevels; i++ {
+		if d.levels[i] == src {
+			d.levels[i] = nil
+		}
+		r := int(math.Round(float64(radius) * float64(i) / dofLevels))
+		d.levels[i] = blurrer.Blur(d.levels[i], src, r)
+	}
+
+	if d.dst == nil || d.dst.Rect != b {
+		d.dst = image.NewNRGBA(b)
+	}
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			dist := d.distanceAt(x, y) / scale
+			t := pixels.Smoothstep(0, 1, (dist-d.focus)/d.falloff) * dofLevels
+			lo := int(t)
+			if lo >= dofLevels {
+				lo = dofLevels - 1
+			}
+			f := t - float64(lo)
+
+			i := y*d.dst.Stride + x*4
+			p0 := d.levels[lo].Pix[y*d.levels[lo].Stride+x*4:]
+			p1 := d.levels[lo+1].Pix[y*d.levels[lo+1].Stride+x*4:]
+			for ch := 0; ch < 4; ch++ {
+				d.dst.Pix[i+ch] = uint8(float64(p0[ch])*(1-f) + float64(p1[ch])*f + 0.5)
+			}
+		}
+	}
+	return d.dst
+}
+
+// init allocates the distance field for the frame size.
+func (d *depthOfField) init(width, height int) {
+	w, h := (width+dofDownscale-1)/dofDownscale, (height+dofDownscale-1)/dofDownscale
+	if w == d.w && h == d.h {
+		return
+	}
+	d.w, d.h = w, h
+	d.dist = make([]float64, w*h)
+}
+
+// seed resets the distance field to zero on the persons and to infinity elsewhere.
+func (d *depthOfField) seed(dets [][]int, matte *image.Alpha) {
+	for i := range d.dist {
+		d.dist[i] = math.Inf(1)
+	}
+	if matte != nil {
+		for y := 0; y < d.h; y++ {
+			for x := 0; x < d.w; x++ {
+				px, py := x*dofDownscale+dofDownscale/2, y*dofDownscale+dofDownscale/2
+				if matte.AlphaAt(px, py).A >= 0x80 {
+					d.dist[y*d.w+x] = 0
+				}
+			}
+		}
+		return
+	}
+	for _, det := range dets {
+		if det[3] <= 50 {
+			continue
+		}
+		row, col, scale := det[1], det[0], det[2]
+		x0, y0 := pixels.ClampInt((row-scale/2)/dofDownscale, 0, d.w), pixels.ClampInt((col-scale/2)/dofDownscale, 0, d.h)
+		x1, y1 := pixels.ClampInt((row+scale/2)/dofDownscale, 0, d.w), pixels.ClampInt((col+scale/2)/dofDownscale, 0, d.h)
+		for y := y0; y < y1; y++ {
+			for x := x0; x < x1; x++ {
+				d.dist[y*d.w+x] = 0
+			}
+		}
+	}
+}
+
+// distanceTransform computes the distance of each cell from the closest seed with a two pass chamfer
+// algorithm, then converts it to frame pixels.
+func (d *depthOfField) distanceTransform() {
+	const diag = math.Sqrt2
+	w, h := d.w, d.h
+	at := func(x, y int) float64 {
+		if x < 0 || y < 0 || x >= w || y >= h {
+			return math.Inf(1)
+		}
+		return d.dist[y*w+x]
+	}
+	// Forward pass, from the top left corner.
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			v := d.dist[y*w+x]
+			v = math.Min(v, at(x-1, y)+1)
+			v = math.Min(v, at(x, y-1)+1)
+			v = math.Min(v, at(x-1, y-1)+diag)
+			v = math.Min(v, at(x+1, y-1)+diag)
+			d.dist[y*w+x] = v
+		}
+	}
+	// Backward pass, from the bottom right corner.
+	for y := h - 1; y >= 0; y-- {
+		for x := w - 1; x >= 0; x-- {
+			v := d.dist[y*w+x]
+			v = math.Min(v, at(x+1, y)+1)
+			v = math.Min(v, at(x, y+1)+1)
+			v = math.Min(v, at(x+1, y+1)+diag)
+			v = math.Min(v, at(x-1, y+1)+diag)
+			d.dist[y*w+x] = v
+		}
+	}
+	// Without any seed the distances remain infinite, which can't be interpolated.
+	for i := range d.dist {
+		d.dist[i] = math.Min(d.dist[i], float64(w+h)) * dofDownscale
+	}
+}
+
+// distanceAt bilinearly interpolates the distance field at the frame pixel.
+func (d *depthOfField) distanceAt(x, y int) float64 {
+	fx := (float64(x)+0.5)/dofDownscale - 0.5
+	fy := (float64(y)+0.5)/dofDownscale - 0.5
+	return pixels.Interpolate(d.dist, d.w, d.h, fx, fy)
+}
@@ -0,0 +1,239 @@
+package bgmodel
+
+import (
+	"image"
+	"math"
+
+	"github.com/esimov/pigo-wasm-demos/pixels"
+)
+
+// Config holds the parameters of the background model.
+type Config struct {
+	// Downscale is the factor by which the frames are downscaled before being modeled.
+	Downscale int
+	// LearningFrames is the number of frames the background plate is learned from, before the model is ready.
+	LearningFrames int
+	// LearningRate is the weight of the new frame in the running average of the background pixels, once the model is ready.
+	LearningRate float64
+	// Threshold is the distance from the background plate, measured in standard deviations,
+	// above which a pixel starts to be considered foreground. At twice the distance it's entirely foreground.
+	Threshold float64
+	// MinDeviation is the minimum standard deviation of the background pixels in 8-bit color levels,
+	// which prevents the camera noise from being detected as foreground in the very stable areas.
+	MinDeviation float64
+	// MotionThreshold is the difference in 8-bit color levels between consecutive frames above which a pixel is moving.
+	// The moving pixels are not learned into the plate.
+	MotionThreshold float64
+	// DriftRate is the rate at which the plate follows the global brightness changes, like the camera auto exposure.
+	DriftRate float64
+	// MaxForeground is the fraction of the frame above which the scene is considered changed, like after moving the camera.
+	MaxForeground float64
+	// RelearnFrames is the number of consecutive changed frames after which the plate is learned again.
+	RelearnFrames int
+}
+
+// DefaultConfig returns the default parameters of the background model.
+func DefaultConfig() Config {
+	return Config{
+		Downscale:       4,
+		LearningFrames:  30,
+		LearningRate:    0.02,
+		Threshold:       2.5,
+		MinDeviation:    6,
+		MotionThreshold: 12,
+		DriftRate:       0.5,
+		MaxForeground:   0.8,
+		RelearnFrames:   30,
+	}
+}
+
+// Model learns the background plate of a static camera as the running average and variance of
+// each pixel, then separates the foreground by the distance of the pixels from the plate. Only the
+// static background pixels update the plate, so the persons standing still are not absorbed into it.
+type Model struct {
+	Config
+
+	w, h    int
+	frames  int       // number of frames learned since the last reset
+	changed int       // number of consecutive frames in which the scene looked changed
+	cur     []float64 // downscaled RGB frame
+	prev    []float64 // downscaled RGB frame of the previous frame
+	mean    []float64 // background plate
+	vari    []float64 // variance of the background pixels
+	fg      []float64 // soft foreground mask
+	tmp     []float64
+	mask    *image.Alpha
+}
+
+// NewModel creates a new background model with the provided configuration.
+func NewModel(cfg Config) *Model {
+	if cfg.Downscale < 1 {
+		cfg.Downscale = 1
+	}
+	return &Model{Config: cfg}
+}
+
+// Ready reports whether the background plate is learned and the foreground mask is available.
+func (m *Model) Ready() bool {
+	return m.frames >= m.LearningFrames
+}
+
+// Relearn discards the background plate, which is learned again from the next frames.
+func (m *Model) Relearn() {
+	m.frames = 0
+	m.changed = 0
+}
+
+// Update feeds the RGBA frame buffer of the provided size into the model and returns the foreground mask.
+// While the plate is being learned the mask is empty. The returned mask is reused by the next Update call.
+func (m *Model) Update(pix []uint8, width, height int) *image.Alpha {
+	m.init(width, height)
+	pixels.Downscale(m.cur, pix, width, height, m.Downscale)
+
+	if m.frames == 0 {
+		copy(m.mean, m.cur)
+		copy(m.prev, m.cur)
+		for i := range m.vari {
+			m.vari[i] = m.MinDeviation * m.MinDeviation
+		}
+		for i := range m.fg {
+			m.fg[i] = 0
+		}
+		m.frames++
+		pixels.UpscaleAlpha(m.mask, m.fg, m.w, m.h, m.Downscale)
+		return m.mask
+	}
+
+	learning := !m.Ready()
+	if !learning {
+		m.compensateDrift()
+	}
+
+	var foreground float64
+	minVar := m.MinDeviation * m.MinDeviation
+	for i := range m.fg {
+		c, p, mean := m.cur[i*3:i*3+3], m.prev[i*3:i*3+3], m.mean[i*3:i*3+3]
+		var dist, motion float64
+		for ch := 0; ch < 3; ch++ {
+			d := c[ch] - mean[ch]
+			dist += d * d
+			motion += math.Abs(c[ch] - p[ch])
+		}
+		dist /= 3
+		static := motion/3 < m.MotionThreshold
+
+		v := math.Max(m.vari[i], minVar)
+		fg := pixels.Smoothstep(m.Threshold, 2*m.Threshold, math.Sqrt(dist/v))
+		if learning {
+			fg = 0
+		}
+		m.fg[i] = fg
+		foreground += fg
+
+		// Only the static pixels are learned, and once the model is ready, only the background ones.
+		var rate float64
+		switch {
+		case !static:
+		case learning:
+			rate = 1 / float64(m.frames+1)
+		case fg < 0.5:
+			rate = m.LearningRate
+		}
+		if rate > 0 {
+			for ch := 0; ch < 3; ch++ {
+				mean[ch] += (c[ch] - mean[ch]) * rate
+			}
+			m.vari[i] += (dist - m.vari[i]) * rate
+		}
+	}
+	copy(m.prev, m.cur)
+	m.frames++
+
+	// A frame dominated by the foreground means that the scene has changed, so the plate is no longer valid.
+	if !learning && foreground/float64(len(m.fg)) > m.MaxForeground {
+		m.changed++
+		if m.changed >= m.RelearnFrames {
+			m.Relearn()
+		}
+	} else {
+		m.changed = 0
+	}
+
+	m.blur()
+	m.blur()
+	pixels.UpscaleAlpha(m.mask, m.fg, m.w, m.h, m.Downscale)
+	return m.mask
+}
+
+// Plate returns the learned background plate as an RGBA image of the downscaled size.
+func (m *Model) Plate() *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, m.w, m.h))
+	for i := 0; i < m.w*m.h; i++ {
+		for ch := 0; ch < 3; ch++ {
+			img.Pix[i*4+ch] = uint8(pixels.Clamp(m.mean[i*3+ch], 0, 255) + 0.5)
+		}
+		img.Pix[i*4+3] = 0xff
+	}
+	return img
+}
+
+// init allocates the buffers for the frame size. A different frame size resets the model.
+func (m *Model) init(width, height int) {
+	w, h := pixels.ScaledSize(width, height, m.Downscale)
+	if w == m.w && h == m.h {
+		return
+	}
+	m.w, m.h = w, h
+	m.cur = make([]float64, w*h*3)
+	m.prev = make([]float64, w*h*3)
+	m.mean = make([]float64, w*h*3)
+	m.vari = make([]float64, w*h)
+	m.fg = make([]float64, w*h)
+	m.tmp = make([]float64, w*h)
+	m.mask = image.NewAlpha(image.Rect(0, 0, width, height))
+	m.Relearn()
+}
+
+// compensateDrift scales the plate by the brightness change of the background pixels
+// of the previous frame, so that a global lighting change is not detected as foreground.
+func (m *Model) compensateDrift() {
+	var sumCur, sumPlate float64
+	for i, fg := range m.fg {
+		if fg >= 0.5 {
+			continue
+		}
+		for ch := 0; ch < 3; ch++ {
+			sumCur += m.cur[i*3+ch]
+			sumPlate += m.mean[i*3+ch]
+		}
+	}
+	if sumCur == 0 || sumPlate == 0 {
+		return
+	}
+	gain := pixels.Clamp(sumCur/sumPlate, 0.5, 2)
+	gain = 1 + (gain-1)*m.DriftRate
+	for i := range m.mean {
+		m.mean[i] *= gain
+	}
+}
+
+// blur applies a 3x3 box blur over the foreground mask, removing the isolated foreground pixels.
+func (m *Model) blur() {
+	for y := 0; y < m.h; y++ {
+		for x := 0; x < m.w; x++ {
+			var sum float64
+			var n int
+			for ny := y - 1; ny <= y+1; ny++ {
+				for nx := x - 1; nx <= x+1; nx++ {
+					if nx < 0 || ny < 0 || nx >= m.w || ny >= m.h {
+						continue
+					}
+					sum += m.fg[ny*m.w+nx]
+					n++
+				}
+			}
+			m.tmp[y*m.w+x] = sum / float64(n)
+		}
+	}
+	m.fg, m.tmp = m.tmp, m.fg
+}
@@ -0,0 +1,377 @@
+package blur
+
+import (
+	"image"
+	"math"
+	"runtime"
+	"sync"
+)
+
+// Kernel defines the shape of the blur kernel.
+type Kernel int
+
+const (
+	// Box averages the pixels of a square, applied in multiple passes for a smoother result.
+	Box Kernel = iota
+	// Gaussian convolves the image with a separable Gaussian kernel.
+	Gaussian
+	// Stack weights the pixels by a triangular kernel, like the stack blur algorithm.
+	Stack
+	// Lens averages the pixels of a disc, imitating the bokeh of an out of focus camera lens.
+	Lens
+	// Motion averages the pixels along a line, imitating the blur of a moving camera.
+	Motion
+
+	// Kernels is the number of available blur kernels.
+	Kernels = iota
+)
+
+const (
+	// maxLensTaps is the maximum number of samples of the disc kernel.
+	maxLensTaps = 64
+	// bokehGain is the additional weight of the brightest pixels in the lens blur,
+	// which makes the highlights bloom into discs, like the bokeh of a real lens.
+	bokehGain = 4
+)
+
+// String returns the name of the blur kernel.
+func (k Kernel) String() string {
+	switch k {
+	case Gaussian:
+		return "gaussian"
+	case Stack:
+		return "stack"
+	case Lens:
+		return "lens"
+	case Motion:
+		return "motion"
+	default:
+		return "box"
+	}
+}
+
+// Blurrer blurs the images with the selected kernel. The intermediate buffers are kept
+// between the Blur calls, so that consecutive frames of the same size are blurred without
+// new memory allocations. The rows are processed in parallel by multiple goroutines.
+type Blurrer struct {
+	Kernel Kernel
+	// Passes is the number of box blur passes. Three passes closely approximate the Gaussian blur.
+	Passes int
+	// Angle is the direction of the motion blur in degrees, measured clockwise from the horizontal axis.
+	Angle float64
+
+	tmp     []uint8
+	cp      []uint8
+	weights []int32
+	taps    []image.Point
+	lumaWts []int32
+}
+
+// NewBlurrer creates a new blurrer with the provided kernel.
+func NewBlurrer(kernel Kernel) *Blurrer {
+	return &Blurrer{
+		Kernel: kernel,
+		Passes: 3,
+	}
+}
+
+// Blur blurs the source image with the provided radius and writes the result into the dst image.
+// The dst image is reused if its bounds are matching the source image bounds, otherwise a new image
+// is allocated. The dst image can be the source image itself, in which case it's blurred in place.
+func (b *Blurrer) Blur(dst, src *image.NRGBA, radius int) *image.NRGBA {
+	r := src.Bounds()
+	if dst == nil || dst.Rect != r {
+		dst = image.NewNRGBA(r)
+	}
+	w, h := r.Dx(), r.Dy()
+	if w == 0 || h == 0 {
+		return dst
+	}
+	in := layer{pix: src.Pix, stride: src.Stride}
+	out := layer{pix: dst.Pix, stride: dst.Stride}
+	if radius < 1 {
+		if &dst.Pix[0] != &src.Pix[0] {
+			for y := 0; y < h; y++ {
+				copy(out.row(y, w), in.row(y, w))
+			}
+		}
+		return dst
+	}
+
+	b.tmp = grow(b.tmp, w*h*4)
+	tmp := layer{pix: b.tmp, stride: w * 4}
+
+	switch b.Kernel {
+	case Gaussian:
+		b.gaussianWeights(radius)
+		b.separable(out, in, tmp, w, h, func(l line) { l.convolve(b.weights) })
+	case Stack:
+		// The convolution of two opposite one-sided boxes is the triangular kernel of the stack blur.
+		b.separable(out, in, tmp, w, h, func(l line) { l.box(0, radius) })
+		b.separable(out, out, tmp, w, h, func(l line) { l.box(radius, 0) })
+	case Lens, Motion:
+		// The kernels are not separable, so the source can't be overwritten while it's being read.
+		if &dst.Pix[0] == &src.Pix[0] {
+			b.cp = grow(b.cp, w*h*4)
+			cp := layer{pix: b.cp, stride: w * 4}
+			for y := 0; y < h; y++ {
+				copy(cp.row(y, w), in.row(y, w))
+			}
+			in = cp
+		}
+		if b.Kernel == Lens {
+			b.lensTaps(radius)
+			b.lens(out, in, w, h)
+		} else {
+			b.motionTaps(radius)
+			b.average(out, in, w, h)
+		}
+	default:
+		passes := b.Passes
+		if passes < 1 {
+			passes = 1
+		}
+		for i := 0; i < passes; i++ {
+			b.separable(out, in, tmp, w, h, func(l line) { l.box(radius, radius) })
+			in = out
+		}
+	}
+	return dst
+}
+
+// layer is a pixel buffer with its stride.
+type layer struct {
+	pix    []uint8
+	stride int
+}
+
+// row returns the pixels of the row having the provided width.
+func (l layer) row(y, w int) []uint8 {
+	return l.pix[y*l.stride : y*l.stride+w*4]
+}
+
+// line is a row or column of pixels read from one buffer and written into another one.
+type line struct {
+	in, out            []uint8
+	inOff, inStep      int
+	outOff, outStep, n int
+}
+
+// separable applies the line filter horizontally from the source into the temporary buffer,
+// then vertically from the temporary buffer into the destination.
+func (b *Blurrer) separable(dst, src, tmp layer, w, h int, filter func(line)) {
+	parallel(h, func(start, end int) {
+		for y := start; y < end; y++ {
+			filter(line{in: src.pix, inOff: y * src.stride, inStep: 4, out: tmp.pix, outOff: y * tmp.stride, outStep: 4, n: w})
+		}
+	})
+	parallel(w, func(start, end int) {
+		for x := start; x < end; x++ {
+			filter(line{in: tmp.pix, inOff: x * 4, inStep: tmp.stride, out: dst.pix, outOff: x * 4, outStep: dst.stride, n: h})
+		}
+	})
+}
+
+// box averages the pixels of the [i-lo, i+hi] window of each pixel with a running sum.
+// The pixels outside of the line are replaced by the closest edge pixel.
+func (l line) box(lo, hi int) {
+	size := lo + hi + 1
+	var sum [4]int
+	for k := -lo; k <= hi; k++ {
+		p := l.inOff + clampInt(k, 0, l.n-1)*l.inStep
+		for ch := 0; ch < 4; ch++ {
+			sum[ch] += int(l.in[p+ch])
+		}
+	}
+	for i := 0; i < l.n; i++ {
+		o := l.outOff + i*l.outStep
+		for ch := 0; ch < 4; ch++ {
+			l.out[o+ch] = uint8((sum[ch] + size/2) / size)
+		}
+		add := l.inOff + clampInt(i+hi+1, 0, l.n-1)*l.inStep
+		rem := l.inOff + clampInt(i-lo, 0, l.n-1)*l.inStep
+		for ch := 0; ch < 4; ch++ {
+			sum[ch] += int(l.in[add+ch]) - int(l.in[rem+ch])
+		}
+	}
+}
+
+// convolve convolves the line with the symmetric fixed point kernel, centered on the middle weight.
+func (l line) convolve(weights []int32) {
+	radius := len(weights) / 2
+	for i := 0; i < l.n; i++ {
+		var sum [4]int32
+		for k, wt := range weights {
+			p := l.inOff + clampInt(i+k-radius, 0, l.n-1)*l.inStep
+			for ch := 0; ch < 4; ch++ {
+				sum[ch] += int32(l.in[p+ch]) * wt
+			}
+		}
+		o := l.outOff + i*l.outStep
+		for ch := 0; ch < 4; ch++ {
+			l.out[o+ch] = uint8((sum[ch] + 1<<15) >> 16)
+		}
+	}
+}
+
+// gaussianWeights computes the Gaussian kernel of the radius as 16-bit fixed point weights summing to one.
+func (b *Blurrer) gaussianWeights(radius int) {
+	if len(b.weights) == 2*radius+1 {
+		return
+	}
+	sigma := math.Max(float64(radius)/3, 0.5)
+	fw := make([]float64, 2*radius+1)
+	var total float64
+	for i := range fw {
+		x := float64(i - radius)
+		fw[i] = math.Exp(-x * x / (2 * sigma * sigma))
+		total += fw[i]
+	}
+	b.weights = make([]int32, len(fw))
+	var sum int32
+	for i, v := range fw {
+		b.weights[i] = int32(math.Round(v / total * (1 << 16)))
+		sum += b.weights[i]
+	}
+	// Assign the rounding error to the center weight, so the weights are summing exactly to one.
+	b.weights[radius] += 1<<16 - sum
+}
+
+// lensTaps computes the sample offsets of the disc kernel. The small discs are fully sampled,
+// the larger ones by a Fibonacci spiral of evenly distributed samples.
+func (b *Blurrer) lensTaps(radius int) {
+	b.taps = b.taps[:0]
+	if math.Pi*float64(radius*radius) <= maxLensTaps {
+		for y := -radius; y <= radius; y++ {
+			for x := -radius; x <= radius; x++ {
+				if x*x+y*y <= radius*radius {
+					b.taps = append(b.taps, image.Pt(x, y))
+				}
+			}
+		}
+		return
+	}
+	golden := math.Pi * (3 - math.Sqrt(5))
+	for i := 0; i < maxLensTaps; i++ {
+		rad := float64(radius) * math.Sqrt((float64(i)+0.5)/maxLensTaps)
+		sin, cos := math.Sincos(float64(i) * golden)
+		b.taps = append(b.taps, image.Pt(int(math.Round(rad*cos)), int(math.Round(rad*sin))))
+	}
+}
+
+// motionTaps computes the sample offsets of the line kernel oriented by the motion angle.
+func (b *Blurrer) motionTaps(radius int) {
+	b.taps = b.taps[:0]
+	sin, cos := math.Sincos(b.Angle * math.Pi / 180)
+	for i := -radius; i <= radius; i++ {
+		b.taps = append(b.taps, image.Pt(int(math.Round(float64(i)*cos)), int(math.Round(float64(i)*sin))))
+	}
+}
+
+// average averages the pixels at the tap offsets of each pixel.
+func (b *Blurrer) average(dst, src layer, w, h int) {
+	n := int32(len(b.taps))
+	parallel(h, func(start, end int) {
+		for y := start; y < end; y++ {
+			for x := 0; x < w; x++ {
+				var sum [4]int32
+				for _, t := range b.taps {
+					p := clampInt(y+t.Y, 0, h-1)*src.stride + clampInt(x+t.X, 0, w-1)*4
+					for ch := 0; ch < 4; ch++ {
+						sum[ch] += int32(src.pix[p+ch])
+					}
+				}
+				o := y*dst.stride + x*4
+				for ch := 0; ch < 4; ch++ {
+					dst.pix[o+ch] = uint8((sum[ch] + n/2) / n)
+				}
+			}
+		}
+	})
+}
+
+// lens averages the pixels at the tap offsets of each pixel, weighting the bright pixels more.
+// The weights are computed once per pixel, as 8-bit fixed point values.
+func (b *Blurrer) lens(dst, src layer, w, h int) {
+	if cap(b.lumaWts) < w*h {
+		b.lumaWts = make([]int32, w*h)
+	}
+	wts := b.lumaWts[:w*h]
+	parallel(h, func(start, end int) {
+		for y := start; y < end; y++ {
+			for x := 0; x < w; x++ {
+				c := src.pix[y*src.stride+x*4:]
+				luma := (0.2126*float64(c[0]) + 0.7152*float64(c[1]) + 0.0722*float64(c[2])) / 255
+				l2 := luma * luma
+				wts[y*w+x] = int32((1 + bokehGain*l2*l2) * 256)
+			}
+		}
+	})
+	parallel(h, func(start, end int) {
+		for y := start; y < end; y++ {
+			for x := 0; x < w; x++ {
+				var sum [4]int32
+				var total int32
+				for _, t := range b.taps {
+					sx, sy := clampInt(x+t.X, 0, w-1), clampInt(y+t.Y, 0, h-1)
+					wt := wts[sy*w+sx]
+					c := src.pix[sy*src.stride+sx*4 : sy*src.stride+sx*4+4 : sy*src.stride+sx*4+4]
+					sum[0] += int32(c[0]) * wt
+					sum[1] += int32(c[1]) * wt
+					sum[2] += int32(c[2]) * wt
+					sum[3] += int32(c[3]) * wt
+					total += wt
+				}
+				o := y*dst.stride + x*4
+				for ch := 0; ch < 4; ch++ {
+					dst.pix[o+ch] = uint8((sum[ch] + total/2) / total)
+				}
+			}
+		}
+	})
+}
+
+// parallel splits the [0, n) range between the available processors and calls fn for each part.
+func parallel(n int, fn func(start, end int)) {
+	workers := runtime.GOMAXPROCS(0)
+	if workers > n {
+		workers = n
+	}
+	if workers <= 1 {
+		fn(0, n)
+		return
+	}
+	var wg sync.WaitGroup
+	chunk := (n + workers - 1) / workers
+	for start := 0; start < n; start += chunk {
+		end := start + chunk
+		if end > n {
+			end = n
+		}
+		wg.Add(1)
+		go func(start, end int) {
+			defer wg.Done()
+			fn(start, end)
+		}(start, end)
+	}
+	wg.Wait()
+}
+
+// grow returns a buffer of the provided size, reusing the existing one if it's large enough.
+func grow(buf []uint8, size int) []uint8 {
+	if cap(buf) < size {
+		return make([]uint8, size)
+	}
+	return buf[:size]
+}
+
+// clampInt restricts the integer value between the min and max limits.
+func clampInt(v, min, max int) int {
+	if v < min {
+		return min
+	}
+	if v > max {
+		return max
+	}
+	return v
+}
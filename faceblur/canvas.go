@@ -6,9 +6,14 @@ import (
 	"math"
 	"syscall/js"
 
+	"github.com/esimov/pigo-wasm-demos/blur"
 	"github.com/esimov/pigo-wasm-demos/detector"
+	"github.com/esimov/pigo-wasm-demos/mask"
 	"github.com/esimov/pigo-wasm-demos/pixels"
-	"github.com/esimov/stackblur-go"
+	"github.com/esimov/pigo-wasm-demos/privacy"
+	"github.com/esimov/pigo-wasm-demos/selection"
+	"github.com/esimov/pigo-wasm-demos/tracker"
+	pigocore "github.com/esimov/pigo/core"
 )
 
 // Canvas struct holds the Javascript objects needed for the Canvas creation
@@ -30,6 +35,8 @@ type Canvas struct {
 	ctx        js.Value
 	ctxEllipse js.Value
 	ctxOffscr  js.Value
+	cropSize   struct{ width, height int }
+	maskSize   struct{ width, height int }
 	reqID      js.Value
 	renderer   js.Func
 
@@ -42,8 +49,20 @@ type Canvas struct {
 	showFrame  bool
 	isBlurred  bool
 	blurRadius uint32
+	blurrer    *blur.Blurrer
+	maskKind   mask.Kind
+
+	// Privacy mode related variables
+	privacy  bool
+	redactor *privacy.Redactor
+	failSafe bool
+	policy   *privacy.Engine
+
+	// selection holds the faces exempted from, or targeted by the effect.
+	selection *selection.Selection
 
 	frame *image.NRGBA
+	pool  *pixels.FramePool
 }
 
 const (
@@ -72,11 +91,11 @@ func NewCanvas() *Canvas {
 	c.canvas.Set("id", "canvas")
 	c.body.Call("appendChild", c.canvas)
 
-	c.ellipse.Set("width", c.windowSize.width)
-	c.ellipse.Set("height", c.windowSize.height)
-
-	c.offscreen.Set("width", c.windowSize.width)
-	c.offscreen.Set("height", c.windowSize.height)
+	// The ellipse and offscreen canvases hold a single face crop, so they are sized by the largest crop.
+	c.ellipse.Set("width", 0)
+	c.ellipse.Set("height", 0)
+	c.offscreen.Set("width", 0)
+	c.offscreen.Set("height", 0)
 
 	c.ctx = c.canvas.Call("getContext", "2d")
 	c.ctxEllipse = c.ellipse.Call("getContext", "2d")
@@ -86,6 +105,13 @@ func NewCanvas() *Canvas {
 	c.showFrame = false
 	c.isBlurred = true
 	c.blurRadius = 20
+	c.blurrer = blur.NewBlurrer(blur.Stack)
+	c.maskKind = mask.Ellipse
+	c.pool = pixels.NewFramePool()
+	c.redactor = privacy.NewRedactor(privacy.DefaultConfig())
+	c.policy = privacy.NewEngine(privacy.DefaultPolicy())
+	c.selection = selection.New()
+	c.selection.Expose("faceSelection")
 
 	pigo = detector.NewDetector()
 	return &c
@@ -95,6 +121,7 @@ func NewCanvas() *Canvas {
 func (c *Canvas) Render() error {
 	width, height := c.windowSize.width, c.windowSize.height
 	var data = make([]byte, width*height*4)
+	var gray = make([]byte, width*height)
 	c.done = make(chan struct{})
 
 	err := pigo.UnpackCascades()
@@ -115,18 +142,40 @@ func (c *Canvas) Render() error {
 			uint8Arr := js.Global().Get("Uint8Array").New(rgba)
 			js.CopyBytesToGo(data, uint8Arr)
 
-			gray := pixels.RgbaToGrayscale(data, width, height)
-
-			// Reset the data slice to its default values to avoid unnecessary memory allocation.
-			// Otherwise, the GC won't clean up the memory address allocated by this slice
-			// and the memory will keep increasing by each iteration.
-			data = make([]byte, len(data))
+			gray = pixels.Grayscale(gray, data, pixels.BT709)
 
 			res := pigo.DetectFaces(gray, height, width)
-			if len(res) > 0 {
-				if err := c.drawDetection(res); err != nil {
-					return err
+			tracks := c.redactor.Track(res)
+			c.selection.Update(tracks)
+			var decision privacy.Decision
+			if c.failSafe {
+				decision = c.policy.Evaluate(res, tracks)
+			}
+
+			switch {
+			case decision.Action == privacy.RedactFrame:
+				c.redactor.RedactFrame(data, width)
+				privacy.PutFrame(c.ctx, data, width, height)
+			case c.privacy:
+				c.redactor.RedactTracks(data, width, c.selection.Filter(tracks))
+				c.redactor.RedactRegions(data, width, decision.Regions)
+				privacy.PutFrame(c.ctx, data, width, height)
+				if c.showFrame {
+					privacy.DrawTracks(c.ctx, tracks)
+				}
+				c.selection.Draw(c.ctx, tracks)
+			default:
+				// Redact the faces which could not be confirmed, then apply the effect over the detected ones.
+				if decision.Action == privacy.RedactRegions {
+					c.redactor.RedactRegions(data, width, decision.Regions)
+					privacy.PutFrame(c.ctx, data, width, height)
 				}
+				if dets := c.selection.Dets(tracks); len(dets) > 0 {
+					if err := c.drawDetection(data, dets); err != nil {
+						return err
+					}
+				}
+				c.selection.Draw(c.ctx, tracks)
 			}
 			c.window.Get("stats").Call("end")
 
@@ -139,6 +188,9 @@ func (c *Canvas) Render() error {
 
 	c.window.Call("requestAnimationFrame", c.renderer)
 	c.detectKeyPress()
+	c.selection.ListenClicks(c.canvas, func(tr *tracker.Track) {
+		c.Log(fmt.Sprintf("Face #%d marked: %t, selection mode: %s", tr.ID, c.selection.IsMarked(tr), c.selection.Mode()))
+	})
 	<-c.done
 
 	return nil
@@ -209,101 +261,154 @@ func (c *Canvas) StartWebcam() (*Canvas, error) {
 	}
 }
 
-// blurFace blures out the detected face region
-func (c *Canvas) blurFace(src image.Image) (*image.NRGBA, error) {
-	img, err := stackblur.Process(src, c.blurRadius)
-	if err != nil {
-		return nil, err
-	}
-
-	return img, nil
+// blurFace blurs out the detected face region in place, with the selected blur kernel.
+func (c *Canvas) blurFace(src *image.NRGBA) *image.NRGBA {
+	return c.blurrer.Blur(src, src, int(c.blurRadius))
 }
 
-// drawDetection draws the detected faces and eyes.
-func (c *Canvas) drawDetection(dets [][]int) error {
+// drawEllipseMask draws the feathered ellipse mask of the face region into the ellipse canvas.
+func (c *Canvas) drawEllipseMask(scale int) {
 	var scaleX, scaleY, invScaleX, invScaleY float64
 	var grad js.Value
 
-	for _, det := range dets {
-		leftPupil := pigo.DetectLeftPupil(det)
-		rightPupil := pigo.DetectRightPupil(det)
+	scx, scy := int(float64(scale)*0.8/1.6), int(float64(scale)*0.8/2.1)
+	rx, ry := scx/2, scy/2
+
+	if rx >= ry {
+		scaleX, invScaleX = 1, 1
+		scaleY = float64(rx) / float64(ry)
+		invScaleY = float64(ry) / float64(rx)
+		grad = c.ctxEllipse.Call("createRadialGradient", scale/2, float64(scale/2)*invScaleY, 0, scale/2, float64(scale/2)*invScaleY, scx)
+	} else {
+		scaleY, invScaleY = 1, 1
+		scaleX = float64(ry) / float64(rx)
+		invScaleX = float64(rx) / float64(ry)
+		grad = c.ctxEllipse.Call("createRadialGradient", float64(scale/2)*invScaleX, scale/2, 0, float64(scale/2)*invScaleX, scale/2, scy)
+	}
 
-		if det[3] > 50 {
-			c.ctx.Call("beginPath")
-			c.ctx.Set("lineWidth", 2)
-			c.ctx.Set("strokeStyle", "rgba(255, 0, 0, 0.5)")
+	grad.Call("addColorStop", 0.55, "rgba(0, 0, 0, 255)")
+	grad.Call("addColorStop", 0.75, "rgba(255, 255, 255, 0)")
 
-			row, col, scale := det[1], det[0], int(float64(det[2])*1.2)
+	// Clear only the face region, which is all that is used from the canvas.
+	c.ctxEllipse.Call("setTransform", 1, 0, 0, 1, 0, 0)
+	c.ctxEllipse.Call("clearRect", 0, 0, scale, scale)
+	c.ctxEllipse.Call("setTransform", scaleX, 0, 0, scaleY, 0, 0)
 
-			if c.isBlurred {
-				// Substract the image under the detected face region.
-				imgData := make([]byte, scale*scale*4)
-				subimg := c.ctx.Call("getImageData", row-scale/2, col-scale/2, scale, scale).Get("data")
-				uint8Arr := js.Global().Get("Uint8Array").New(subimg)
-				js.CopyBytesToGo(imgData, uint8Arr)
-
-				scx, scy := int(float64(scale)*0.8/1.6), int(float64(scale)*0.8/2.1)
-				rx, ry := scx/2, scy/2
-
-				if rx >= ry {
-					scaleX, invScaleX = 1, 1
-					scaleY = float64(rx) / float64(ry)
-					invScaleY = float64(ry) / float64(rx)
-					grad = c.ctxEllipse.Call("createRadialGradient", scale/2, float64(scale/2)*invScaleY, 0, scale/2, float64(scale/2)*invScaleY, scx)
-				} else {
-					scaleY, invScaleY = 1, 1
-					scaleX = float64(ry) / float64(rx)
-					invScaleX = float64(rx) / float64(ry)
-					grad = c.ctxEllipse.Call("createRadialGradient", float64(scale/2)*invScaleX, scale/2, 0, float64(scale/2)*invScaleX, scale/2, scy)
-				}
+	c.ctxEllipse.Set("fillStyle", grad)
+	c.ctxEllipse.Call("fillRect", 0, 0, float64(scale)*invScaleX, float64(scale)*invScaleY)
+}
 
-				grad.Call("addColorStop", 0.55, "rgba(0, 0, 0, 255)")
-				grad.Call("addColorStop", 0.75, "rgba(255, 255, 255, 0)")
+// growCropCanvases enlarges the offscreen canvas to fit the face crop of the provided size, and the ellipse
+// canvas to fit the face mask of the provided scale too, since the crop is clipped at the frame edges,
+// while the mask is always drawn whole. The canvases are never shrunk, since resizing a canvas reallocates
+// and clears its content.
+func (c *Canvas) growCropCanvases(width, height, scale int) {
+	if width > c.cropSize.width {
+		c.cropSize.width = width
+		c.offscreen.Set("width", width)
+	}
+	if height > c.cropSize.height {
+		c.cropSize.height = height
+		c.offscreen.Set("height", height)
+	}
 
-				// Clear the canvas on each frame.
-				c.ctxEllipse.Call("clearRect", 0, 0, c.windowSize.width, c.windowSize.height)
-				c.ctxEllipse.Call("setTransform", scaleX, 0, 0, scaleY, 0, 0)
+	maskWidth, maskHeight := width, height
+	if maskWidth < scale {
+		maskWidth = scale
+	}
+	if maskHeight < scale {
+		maskHeight = scale
+	}
+	if maskWidth > c.maskSize.width {
+		c.maskSize.width = maskWidth
+		c.ellipse.Set("width", maskWidth)
+	}
+	if maskHeight > c.maskSize.height {
+		c.maskSize.height = maskHeight
+		c.ellipse.Set("height", maskHeight)
+	}
+}
 
-				c.ctxEllipse.Set("fillStyle", grad)
-				c.ctxEllipse.Call("fillRect", 0, 0, float64(scale)*invScaleX, float64(scale)*invScaleY)
+// blurFaceRegion blurs out the face region centered at the provided position, then composites it over
+// the canvas through the face mask. Only the face region, padded by the blur radius, is extracted from
+// the frame buffer, so the cost of the effect depends on the face size rather than the canvas size.
+// The regions are cropped from the frame buffer, so the overlapping faces are not blurred twice.
+func (c *Canvas) blurFaceRegion(data []uint8, row, col, scale int, leftPupil, rightPupil *pigocore.Puploc) {
+	width, height := c.windowSize.width, c.windowSize.height
 
-				// Converts the buffer array to an image.
-				rect := image.Rect(0, 0, scale, scale)
-				img := pixels.PixToImage(imgData, rect)
+	// The padding lets the blur near the mask edges sample the pixels surrounding the face region.
+	x, y, pad := row-scale/2, col-scale/2, int(c.blurRadius)
+	crop := image.Rect(x-pad, y-pad, x+scale+pad, y+scale+pad).Intersect(image.Rect(0, 0, width, height))
+	if crop.Empty() {
+		return
+	}
+	cw, ch := crop.Dx(), crop.Dy()
+	// The position of the face region relative to the crop.
+	fx, fy := x-crop.Min.X, y-crop.Min.Y
+	c.growCropCanvases(cw, ch, scale)
+
+	// The face contour requires both of the pupils, otherwise fall back to the ellipse mask.
+	useContour := c.maskKind == mask.Contour && leftPupil != nil && rightPupil != nil
+	if useContour {
+		face := mask.NewFace(leftPupil, rightPupil, pigo.DetectLandmarkPoints(leftPupil, rightPupil))
+		c.ctxEllipse.Call("setTransform", 1, 0, 0, 1, 0, 0)
+		c.ctxEllipse.Call("putImageData", mask.ToImageData(face, x, y, scale), 0, 0)
+	} else {
+		c.drawEllipseMask(scale)
+	}
 
-				// Blur out the image.
-				blurred, err := c.blurFace(img)
-				if err != nil {
-					return err
-				}
+	// Copy the face region out of the frame buffer and blur it out in place.
+	imgData := pixels.CropInto(c.pool.Get(cw*ch*4), data, width, crop)
+	c.blurFace(pixels.NewNRGBAView(imgData, image.Rect(0, 0, cw, ch)))
+
+	uint8Arr := js.Global().Get("Uint8Array").New(cw * ch * 4)
+	js.CopyBytesToJS(uint8Arr, imgData)
+	c.pool.Put(imgData)
 
-				uint8Arr = js.Global().Get("Uint8Array").New(scale * scale * 4)
-				js.CopyBytesToJS(uint8Arr, pixels.ImgToPix(blurred))
+	uint8Clamped := js.Global().Get("Uint8ClampedArray").New(uint8Arr)
+	rawData := js.Global().Get("ImageData").New(uint8Clamped, cw, ch)
 
-				uint8Clamped := js.Global().Get("Uint8ClampedArray").New(uint8Arr)
-				rawData := js.Global().Get("ImageData").New(uint8Clamped, scale)
+	// The image data overwrites the crop area of the offscreen canvas, so it needs no clearing.
+	c.ctxOffscr.Call("putImageData", rawData, 0, 0)
+
+	c.ctxOffscr.Call("save")
+	c.ctxOffscr.Call("translate", fx, fy)
+	// The face contour is already fitted over the facial landmarks, so it needs no rotation.
+	if !useContour && leftPupil != nil && rightPupil != nil {
+		// Calculate the lean angle between the eyes.
+		angle := 1 - (math.Atan2(float64(rightPupil.Col-leftPupil.Col), float64(rightPupil.Row-leftPupil.Row)) * 180 / math.Pi / 90)
+
+		c.ctxOffscr.Call("translate", scale/2, scale/2)
+		c.ctxOffscr.Call("rotate", js.ValueOf(angle).Float())
+		c.ctxOffscr.Call("translate", -scale/2, -scale/2)
+	}
 
-				// Clear out the canvas on each frame.
-				c.ctxOffscr.Call("clearRect", 0, 0, c.windowSize.width, c.windowSize.height)
-				// Replace the underlying face region with the blurred image.
-				c.ctxOffscr.Call("putImageData", rawData, 0, 0)
+	// Apply the face mask over the blurred image by using composite operation.
+	// Outside of the mask the crop becomes transparent, including its padding.
+	c.ctxOffscr.Set("globalCompositeOperation", "destination-atop")
+	c.ctxOffscr.Call("drawImage", c.ellipse, 0, 0, scale, scale, 0, 0, scale, scale)
+	c.ctxOffscr.Call("restore")
 
-				// Calculate the lean angle between the eyes.
-				angle := 1 - (math.Atan2(float64(rightPupil.Col-leftPupil.Col), float64(rightPupil.Row-leftPupil.Row)) * 180 / math.Pi / 90)
+	c.ctx.Call("drawImage", c.offscreen, 0, 0, cw, ch, crop.Min.X, crop.Min.Y, cw, ch)
+}
 
-				c.ctxOffscr.Call("save")
-				c.ctxOffscr.Call("translate", scale/2, scale/2)
-				c.ctxOffscr.Call("rotate", js.ValueOf(angle).Float())
-				c.ctxOffscr.Call("translate", -scale/2, -scale/2)
+// drawDetection draws the detected faces and eyes. The faces are blurred out from the frame buffer.
+func (c *Canvas) drawDetection(data []uint8, dets [][]int) error {
+	for _, det := range dets {
+		leftPupil := pigo.DetectLeftPupil(det)
+		rightPupil := pigo.DetectRightPupil(det)
 
-				// Apply the ellipse mask over the source image by using composite operation.
-				c.ctxOffscr.Set("globalCompositeOperation", "destination-atop")
-				c.ctxOffscr.Call("drawImage", c.ellipse, 0, 0)
-				c.ctxOffscr.Call("restore")
+		if det[3] > 50 {
+			row, col, scale := det[1], det[0], int(float64(det[2])*1.2)
 
-				c.ctx.Call("drawImage", c.offscreen, row-scale/2, col-scale/2)
+			if c.isBlurred {
+				c.blurFaceRegion(data, row, col, scale, leftPupil, rightPupil)
 			}
 
+			c.ctx.Call("beginPath")
+			c.ctx.Set("lineWidth", 2)
+			c.ctx.Set("strokeStyle", "rgba(255, 0, 0, 0.5)")
+
 			if c.showFrame {
 				c.ctx.Call("rect", row-scale/2, col-scale/2, scale, scale)
 				c.ctx.Call("stroke")
@@ -339,6 +444,37 @@ func (c *Canvas) detectKeyPress() {
 			c.showFrame = !c.showFrame
 		case keyCode.String() == "b":
 			c.isBlurred = !c.isBlurred
+		case keyCode.String() == "m":
+			if c.maskKind == mask.Ellipse {
+				c.maskKind = mask.Contour
+			} else {
+				c.maskKind = mask.Ellipse
+			}
+		case keyCode.String() == "p":
+			c.privacy = !c.privacy
+		case keyCode.String() == "o":
+			if c.redactor.Fill == privacy.Blocks {
+				c.redactor.Fill = privacy.Solid
+			} else {
+				c.redactor.Fill = privacy.Blocks
+			}
+		case keyCode.String() == "e":
+			c.failSafe = !c.failSafe
+			c.policy.Reset()
+		case keyCode.String() == "i":
+			c.Log(c.redactor.Summary())
+		case keyCode.String() == "x":
+			c.selection.SetMode((c.selection.Mode() + 1) % selection.Modes)
+			c.Log("Selection mode: " + c.selection.Mode().String())
+		case keyCode.String() == "u":
+			c.selection.Clear()
+		case keyCode.String() == "k":
+			c.blurrer.Kernel = (c.blurrer.Kernel + 1) % blur.Kernels
+			c.Log("Blur kernel: " + c.blurrer.Kernel.String())
+		case keyCode.String() == "a":
+			// The line kernel is symmetric, so the directions are repeating after a half turn.
+			c.blurrer.Angle = math.Mod(c.blurrer.Angle+45, 180)
+			c.Log(fmt.Sprintf("Motion blur angle: %g°", c.blurrer.Angle))
 		case keyCode.String() == "]":
 			if c.blurRadius <= maxBlurRadius {
 				c.blurRadius++
@@ -3,13 +3,20 @@ package facemask
 import (
 	"fmt"
 	"image"
+	"image/color"
 	"image/draw"
 	"math"
 	"sync"
 	"syscall/js"
 
+	"github.com/esimov/pigo-wasm-demos/asset"
 	"github.com/esimov/pigo-wasm-demos/detector"
+	msk "github.com/esimov/pigo-wasm-demos/mask"
+	"github.com/esimov/pigo-wasm-demos/mesh"
+	"github.com/esimov/pigo-wasm-demos/overlay"
 	"github.com/esimov/pigo-wasm-demos/pixels"
+	"github.com/esimov/pigo-wasm-demos/tracker"
+	pigocore "github.com/esimov/pigo/core"
 	"github.com/esimov/triangle/v2"
 	"golang.org/x/sync/errgroup"
 )
@@ -45,6 +52,23 @@ type Canvas struct {
 	triangle  *triangle.Image
 	processor *triangle.Processor
 	frame     *image.NRGBA
+	pool      *pixels.FramePool
+	// coherent reuses the mesh of each tracked face between the frames, moving it along with the face.
+	coherent bool
+	tracker  *tracker.Tracker
+	meshes   *mesh.Cache
+
+	// Mesh export and capture related variables
+	frameNo      int
+	snapshot     *faceSnapshot
+	exportFormat mesh.Format
+	captureDue   bool // the current frame is captured
+	capture      capture
+	onCapture    js.Value
+
+	// masks holds the mask templates, the face region being cut out through the selected one.
+	masks  *overlay.Library
+	assets *asset.Loader
 
 	// Canvas interaction related variables
 	showFrame       bool
@@ -66,16 +90,20 @@ const (
 	minStrokeWidth = 0
 	maxStrokeWidth = 4
 	minScale       = 170
-)
 
-var (
-	pigo *detector.Detector
-	mask js.Value
+	// holdFrames is the number of frames a face keeps its track identifier after a missed detection.
+	holdFrames = 10
+	// rebuildFrames is the number of frames after which the mesh of a face is rebuilt in the coherent mode.
+	rebuildFrames = 60
 
-	maskWidth  int
-	maskHeight int
+	// manifest lists the mask templates loaded on start.
+	manifest = "/images/facemask.json"
+	// maskGroup is the group of the mask templates used for cutting out the face region.
+	maskGroup = "mouth"
 )
 
+var pigo *detector.Detector
+
 // NewCanvas creates and initializes the new Canvas element
 func NewCanvas() *Canvas {
 	var c Canvas
@@ -131,6 +159,13 @@ func NewCanvas() *Canvas {
 
 	c.mu = sync.Mutex{}
 	c.g = &errgroup.Group{}
+	c.pool = pixels.NewFramePool()
+	c.tracker = tracker.NewTracker(0.1, holdFrames)
+	c.meshes = mesh.NewCache(rebuildFrames)
+	c.exposeCapture("facemask")
+	c.assets = asset.NewLoader()
+	c.masks = overlay.NewLibrary(c.assets)
+	c.masks.Expose("masks")
 
 	c.triangle = &triangle.Image{*c.processor}
 	return &c
@@ -140,21 +175,14 @@ func NewCanvas() *Canvas {
 func (c *Canvas) Render() error {
 	width, height := c.windowSize.width, c.windowSize.height
 	var data = make([]byte, width*height*4)
+	var gray = make([]byte, width*height)
 	c.done = make(chan struct{})
 
-	img, err := pixels.LoadImage("/images/surgical-mask.png")
-	if err != nil {
-		return err
+	if err := c.masks.Load(manifest); err != nil {
+		return fmt.Errorf("failed loading the masks: %v", err)
 	}
-	mask = js.Global().Call("eval", "new Image()")
-	mask.Set("src", "data:image/png;base64,"+img)
-	mask.Call("addEventListener", "load", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
-		maskWidth = js.ValueOf(mask.Get("naturalWidth")).Int()
-		maskHeight = js.ValueOf(mask.Get("naturalHeight")).Int()
-		return nil
-	}))
 
-	err = pigo.UnpackCascades()
+	err := pigo.UnpackCascades()
 	if err != nil {
 		return err
 	}
@@ -174,15 +202,28 @@ func (c *Canvas) Render() error {
 			uint8Arr := js.Global().Get("Uint8Array").New(rgba)
 			js.CopyBytesToGo(data, uint8Arr)
 
-			gray := pixels.RgbaToGrayscale(data, width, height)
-
-			// Reset the data slice to its default values to avoid unnecessary memory allocation.
-			// Otherwise, the GC won't clean up the memory address allocated by this slice
-			// and the memory will keep up increasing by each iteration.
-			data = make([]byte, len(data))
+			gray = pixels.Grayscale(gray, data, pixels.BT709)
 
 			res := pigo.DetectFaces(gray, height, width)
-			c.drawDetection(data, res)
+			// Track only the faces which are triangulated, so that the identifiers are not spent on false detections.
+			faces := make([][]int, 0, len(res))
+			for _, det := range res {
+				if det[3] > 50 {
+					faces = append(faces, det)
+				}
+			}
+			tracks := c.tracker.Update(faces)
+
+			// The meshes of the held tracks are kept, so that they are reused if the faces are detected again.
+			ids := make([]int, len(tracks))
+			for i, tr := range tracks {
+				ids[i] = tr.ID
+			}
+			c.meshes.Retain(ids)
+
+			c.captureDue = c.capture.due()
+			c.drawDetection(data, tracks)
+			c.updateCapture()
 
 			c.window.Get("stats").Call("end")
 		}()
@@ -193,6 +234,7 @@ func (c *Canvas) Render() error {
 
 	c.window.Call("requestAnimationFrame", c.renderer)
 	c.detectKeyPress()
+	c.detectSnapshot()
 	<-c.done
 
 	return nil
@@ -264,24 +306,79 @@ func (c *Canvas) StartWebcam() (*Canvas, error) {
 	}
 }
 
-// triangulate triangulates the image passed as pixel data
-func (c *Canvas) triangulate(data []uint8, size image.Rectangle) ([]uint8, error) {
-	// Converts the buffer array to an image.
-	img := pixels.PixToImage(data, size)
+// triangulate triangulates the image passed as pixel data. The result is written back into the source buffer.
+// If the current frame is captured, it's also returned as a mesh, otherwise the returned mesh is nil.
+func (c *Canvas) triangulate(data []uint8, size image.Rectangle) ([]uint8, *mesh.Mesh, error) {
+	// Wrap the buffer array into an image without copying it.
+	img := pixels.NewNRGBAView(data, size)
 
 	// Call the face triangulation algorithm.
-	res, _, _, err := c.triangle.Draw(img, *c.processor, func() {})
+	res, triangles, _, err := c.triangle.Draw(img, *c.processor, func() {})
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	dst := image.NewNRGBA(res.Bounds())
-	draw.Draw(dst, res.Bounds(), res, image.Point{}, draw.Over)
+	// Reuse the destination image between the frames if the face region size has not changed.
+	if c.frame == nil || c.frame.Rect != res.Bounds() {
+		c.frame = image.NewNRGBA(res.Bounds())
+	}
+	draw.Draw(c.frame, res.Bounds(), res, image.Point{}, draw.Src)
 
-	return pixels.ImgToPix(dst), nil
+	// The mesh is only exported from the captured frames, so it's not built on every frame.
+	var m *mesh.Mesh
+	if c.captureDue {
+		m = mesh.FromTriangles(triangles, c.frame)
+	}
+	return pixels.ImgToPixInto(data, c.frame), m, nil
 }
 
-// drawDetection draws the detected faces and eyes.
-func (c *Canvas) drawDetection(data []uint8, dets [][]int) error {
+// triangulateCoherent triangulates the face with the identifier by reusing its mesh from the previous
+// frames, moved along with the pupils. Only the triangle colors are refreshed on each frame, until the
+// mesh is periodically rebuilt. The face region is located at the provided offset.
+// The result is written back into the source buffer, and it's also returned as a mesh.
+func (c *Canvas) triangulateCoherent(id int, data []uint8, size image.Rectangle, leftPupil, rightPupil *pigocore.Puploc, x, y int) ([]uint8, *mesh.Mesh, error) {
+	// Wrap the buffer array into an image without copying it.
+	img := pixels.NewNRGBAView(data, size)
+
+	t := mesh.PupilTransform(
+		msk.Point{X: float64(leftPupil.Col - x), Y: float64(leftPupil.Row - y)},
+		msk.Point{X: float64(rightPupil.Col - x), Y: float64(rightPupil.Row - y)},
+	)
+	var err error
+	m := c.meshes.Mesh(id, t, func() *mesh.Mesh {
+		// The processor runs its edge detection filters in place, so it receives a copy of the image.
+		buf := c.pool.Get(len(data))
+		defer c.pool.Put(buf)
+		copy(buf, data)
+
+		_, _, points, e := c.triangle.Draw(pixels.NewNRGBAView(buf, size), *c.processor, func() {})
+		if e != nil {
+			err = e
+			return nil
+		}
+		return mesh.Triangulate(mesh.FromTrianglePoints(points), 0, size.Dx(), size.Dy())
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	opts := mesh.RenderOptions{Grayscale: c.isGrayScaled}
+	if c.wireframe == triangle.WithWireframe {
+		opts.StrokeWidth = c.strokeWidth
+		opts.StrokeColor = color.NRGBA{A: 20}
+	}
+	// The triangle colors are sampled from the source, so the mesh can't be drawn in place. The source
+	// is copied first, since a mesh moved along with the face might not cover the whole region.
+	if c.frame == nil || c.frame.Rect != size {
+		c.frame = image.NewNRGBA(size)
+	}
+	copy(c.frame.Pix, img.Pix)
+	m.Render(c.frame, img, opts)
+
+	return pixels.ImgToPixInto(data, c.frame), m, nil
+}
+
+// drawDetection draws the tracked faces detected in the current frame.
+func (c *Canvas) drawDetection(data []uint8, tracks []*tracker.Track) error {
 	c.processor.MaxPoints = c.trianglePoints
 	c.processor.Grayscale = c.isGrayScaled
 	c.processor.StrokeWidth = c.strokeWidth
@@ -290,10 +387,21 @@ func (c *Canvas) drawDetection(data []uint8, dets [][]int) error {
 
 	c.triangle = &triangle.Image{*c.processor}
 
-	var imgScale float64
+	c.frameNo++
+	frame := c.frameNo
+
+	// The face region is cut out through the selected mask.
+	tpl := c.masks.Selected(maskGroup)
+	if tpl == nil {
+		return nil
+	}
 
-	for _, det := range dets {
-		det := det
+	for _, tr := range tracks {
+		// The held tracks are skipped, since their faces were not detected in the current frame.
+		if tr.Held() {
+			continue
+		}
+		id, det := tr.ID, tr.Det
 		c.g.Go(func() error {
 			if det[3] > 50 {
 				c.ctx.Call("beginPath")
@@ -311,30 +419,21 @@ func (c *Canvas) drawDetection(data []uint8, dets [][]int) error {
 
 					// Calculate the lean angle between the two mouth points.
 					angle := 1 - (math.Atan2(float64(p2[0]-p1[0]), float64(p2[1]-p1[1])) * 180 / math.Pi / 90)
-					if scale < minScale || math.Abs(angle) > 0.05 {
-						c.snapshotBtn.Get("style").Set("backgroundColor", "#ff0000")
-					} else {
-						c.snapshotBtn.Get("style").Set("backgroundColor", "#0da307")
-					}
+					aligned := scale >= minScale && math.Abs(angle) <= 0.05
 
-					if scale < maskWidth || scale < maskHeight {
-						if maskHeight > maskWidth {
-							imgScale = float64(scale) / float64(maskHeight)
-						} else {
-							imgScale = float64(scale) / float64(maskWidth)
-						}
+					// Place the mask over the mouth corners and the nose, relative to the detected face size.
+					features := overlay.NewFeatures(leftPupil, rightPupil, points)
+					place, ok := tpl.Place(features, float64(det[2]))
+					if !ok {
+						return nil
 					}
-					imgScale *= 0.9
-
-					maskWidth, maskHeight := float64(maskWidth)*imgScale, float64(maskHeight)*imgScale*0.9
-					tx := row - int(maskWidth/2)
-					ty := p1[1] + (p1[1]-p2[1])/2 - int(maskHeight*0.5)
+					tx, ty := place.X, place.Y
 
 					row += int(float64(row) * 0.02)
 					col += int(float64(scale) * 0.4)
 
 					// Substract the image under the detected face region.
-					imgData := make([]byte, scale*scale*4)
+					imgData := c.pool.Get(scale * scale * 4)
 					subimg := c.ctx.Call("getImageData", row-scale/2, col-scale/2, scale, scale).Get("data")
 					uint8Arr := js.Global().Get("Uint8Array").New(subimg)
 					js.CopyBytesToGo(imgData, uint8Arr)
@@ -342,14 +441,45 @@ func (c *Canvas) drawDetection(data []uint8, dets [][]int) error {
 					// Triangulate the facemask part.
 					c.mu.Lock()
 					rect := image.Rect(0, 0, scale, scale)
-					triangle, err := c.triangulate(imgData, rect)
+					var (
+						buffer []uint8
+						m      *mesh.Mesh
+						err    error
+					)
+					if c.coherent {
+						buffer, m, err = c.triangulateCoherent(id, imgData, rect, leftPupil, rightPupil, row-scale/2, col-scale/2)
+					} else {
+						buffer, m, err = c.triangulate(imgData, rect)
+					}
 					if err != nil {
+						c.mu.Unlock()
 						return err
 					}
+					// Keep the largest face of the frame for exporting, along with the mask placement relative to the face region.
+					if s := c.snapshot; s == nil || s.frame != frame || s.scale < scale {
+						c.snapshot = &faceSnapshot{
+							frame:   frame,
+							scale:   scale,
+							aligned: aligned,
+							mesh:    m,
+							place: overlay.Placement{
+								X:     tx - float64(row-scale/2),
+								Y:     ty - float64(col-scale/2),
+								Scale: place.Scale,
+								Angle: place.Angle,
+							},
+							maskImg: tpl.Source,
+						}
+						// The triangulated face region is only kept when it's captured, since the buffer is reused.
+						if c.captureDue {
+							c.snapshot.pixels = append([]uint8(nil), buffer...)
+						}
+					}
 					c.mu.Unlock()
 
 					uint8Arr = js.Global().Get("Uint8Array").New(scale * scale * 4)
-					js.CopyBytesToJS(uint8Arr, triangle)
+					js.CopyBytesToJS(uint8Arr, buffer)
+					c.pool.Put(buffer)
 
 					uint8Clamped := js.Global().Get("Uint8ClampedArray").New(uint8Arr)
 					rawData := js.Global().Get("ImageData").New(uint8Clamped, scale)
@@ -357,32 +487,18 @@ func (c *Canvas) drawDetection(data []uint8, dets [][]int) error {
 					// Clear out the canvas on each frame.
 					c.ctx2.Call("clearRect", 0, 0, c.windowSize.width, c.windowSize.height)
 
-					c.ctx2.Call("save")
-					c.ctx2.Call("translate", js.ValueOf(tx).Int(), js.ValueOf(ty).Int())
-					c.ctx2.Call("rotate", js.ValueOf(angle).Float())
-					c.ctx2.Call("translate", js.ValueOf(-tx).Int(), js.ValueOf(-ty).Int())
-
 					// Replace the underlying face region with the triangulated image.
 					c.ctx2.Call("putImageData", rawData, row-scale/2, col-scale/2)
 
 					// We are using globalCompositeOperation `destination-atop` drawing method to
 					// substract the overlayed facemask from the detected face region.
+					c.ctx2.Call("save")
 					c.ctx2.Set("globalCompositeOperation", "destination-in")
-
-					c.ctx2.Call("drawImage", mask,
-						js.ValueOf(tx).Int(), js.ValueOf(ty).Int(),
-						js.ValueOf(maskWidth).Int(), js.ValueOf(maskHeight).Int(),
-					)
+					tpl.Draw(c.ctx2, place)
 					c.ctx2.Call("restore")
 
-					c.ctx.Call("save")
-					c.ctx.Call("translate", js.ValueOf(tx).Int(), js.ValueOf(ty).Int())
-					c.ctx.Call("rotate", js.ValueOf(angle).Float())
-					c.ctx.Call("translate", js.ValueOf(-tx).Int(), js.ValueOf(-ty).Int())
-
-					// Draw the mask canvas into the main canvas.
+					// Draw the mask canvas into the main canvas. The mask is already rotated over the mask canvas.
 					c.ctx.Call("drawImage", c.maskCanvas, 0, 0)
-					c.ctx.Call("restore")
 				}
 
 				if c.showFrame {
@@ -409,6 +525,20 @@ func (c *Canvas) detectKeyPress() {
 			c.showFrame = !c.showFrame
 		case keyCode.String() == "g":
 			c.isGrayScaled = !c.isGrayScaled
+		case keyCode.String() == "a":
+			c.capture.auto = !c.capture.auto
+			c.Log(fmt.Sprintf("Auto capture: %t", c.capture.auto))
+		case keyCode.String() == "m":
+			if m := c.masks.Cycle(maskGroup, 1); m != nil {
+				c.Log("Mask: " + m.Name)
+			}
+		case keyCode.String() == "e":
+			c.exportFormat = (c.exportFormat + 1) % mesh.Formats
+			c.Log("Export format: " + c.exportFormat.String())
+		case keyCode.String() == "c":
+			c.coherent = !c.coherent
+			c.meshes.Reset()
+			c.Log(fmt.Sprintf("Temporally coherent triangulation: %t", c.coherent))
 		case keyCode.String() == "-":
 			if c.trianglePoints > minTrianglePoints {
 				c.trianglePoints -= 20
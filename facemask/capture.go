@@ -0,0 +1,240 @@
+package facemask
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/png"
+	"math"
+	"syscall/js"
+	"time"
+)
+
+const (
+	// autoCaptureFrames is the number of consecutive frames the head alignment has to be held for the auto capture.
+	autoCaptureFrames = 30
+	// countdown is the delay between starting the capture and taking the snapshot.
+	countdown = 3 * time.Second
+	// flashFrames is the number of frames the flash fades out over.
+	flashFrames = 12
+)
+
+// captureState defines the stage of the capture flow.
+type captureState int
+
+const (
+	captureIdle captureState = iota
+	captureCountdown
+	captureFlash
+)
+
+// capture holds the state of the capture flow: the countdown started either by the snapshot
+// button or by holding the head alignment, followed by the snapshot and a fading flash.
+type capture struct {
+	state captureState
+	// auto starts the countdown once the head alignment has been held for autoCaptureFrames frames.
+	auto bool
+	// armed is cleared after an auto capture, until the head alignment is lost,
+	// so that the same pose is not captured repeatedly.
+	armed   bool
+	aligned int // number of consecutive aligned frames
+	started time.Time
+	flash   int
+}
+
+// start starts the countdown, unless a capture is already in progress.
+func (cp *capture) start() {
+	if cp.state == captureIdle {
+		cp.state = captureCountdown
+		cp.started = time.Now()
+	}
+}
+
+// due reports whether the countdown is over, so the current frame has to be captured.
+func (cp *capture) due() bool {
+	return cp.state == captureCountdown && time.Since(cp.started) >= countdown
+}
+
+// updateCapture advances the capture flow after the current frame is drawn: it starts the auto capture,
+// draws the countdown, takes the snapshot when the countdown is over, then draws the flash.
+func (c *Canvas) updateCapture() {
+	cp := &c.capture
+	width, height := c.windowSize.width, c.windowSize.height
+
+	// The alignment is checked on the face which would be captured, i.e. the largest one.
+	c.mu.Lock()
+	s := c.snapshot
+	c.mu.Unlock()
+	aligned := s != nil && s.frame == c.frameNo && s.aligned
+	if aligned {
+		c.snapshotBtn.Get("style").Set("backgroundColor", "#0da307")
+	} else {
+		c.snapshotBtn.Get("style").Set("backgroundColor", "#ff0000")
+	}
+
+	switch cp.state {
+	case captureIdle:
+		if !aligned {
+			cp.aligned = 0
+			cp.armed = true
+			return
+		}
+		cp.aligned++
+		if cp.auto && cp.armed && cp.aligned >= autoCaptureFrames {
+			cp.armed = false
+			cp.start()
+		}
+	case captureCountdown:
+		if c.captureDue {
+			if err := c.takeSnapshot(); err != nil {
+				c.Log(fmt.Sprintf("failed capturing the face mask: %v", err))
+			}
+			cp.state = captureFlash
+			cp.flash = flashFrames
+			return
+		}
+		remaining := math.Ceil((countdown - time.Since(cp.started)).Seconds())
+		c.ctx.Call("save")
+		c.ctx.Set("font", "bold 96px sans-serif")
+		c.ctx.Set("textAlign", "center")
+		c.ctx.Set("textBaseline", "middle")
+		c.ctx.Set("fillStyle", "rgba(255, 255, 255, 0.8)")
+		c.ctx.Call("fillText", fmt.Sprintf("%.0f", remaining), width/2, height/2)
+		c.ctx.Call("restore")
+	case captureFlash:
+		c.ctx.Call("save")
+		c.ctx.Set("fillStyle", fmt.Sprintf("rgba(255, 255, 255, %.2f)", float64(cp.flash)/flashFrames))
+		c.ctx.Call("fillRect", 0, 0, width, height)
+		c.ctx.Call("restore")
+		if cp.flash--; cp.flash <= 0 {
+			cp.state = captureIdle
+		}
+	}
+}
+
+// takeSnapshot captures the current frame as a PNG image, the isolated mask of the largest face as a PNG image
+// with transparent background, and the triangulated mask in the selected export format. The results are
+// passed to the capture callback if one is registered through the Javascript API, otherwise they are downloaded.
+func (c *Canvas) takeSnapshot() error {
+	width, height := c.windowSize.width, c.windowSize.height
+
+	rgba := c.ctx.Call("getImageData", 0, 0, width, height).Get("data")
+	frame := image.NewNRGBA(image.Rect(0, 0, width, height))
+	js.CopyBytesToGo(frame.Pix, js.Global().Get("Uint8Array").New(rgba))
+	photo, err := encodePNG(frame)
+	if err != nil {
+		return err
+	}
+
+	var maskPNG, meshData []byte
+	c.mu.Lock()
+	s := c.snapshot
+	c.mu.Unlock()
+	if s != nil && s.frame == c.frameNo && s.pixels != nil {
+		if img := c.isolateMask(s); img != nil {
+			if maskPNG, err = encodePNG(img); err != nil {
+				return err
+			}
+		}
+		if meshData, err = c.exportMesh(s); err != nil {
+			return err
+		}
+	}
+
+	result := js.Global().Get("Object").New()
+	result.Set("photo", newBlob(photo, "image/png"))
+	if maskPNG != nil {
+		result.Set("mask", newBlob(maskPNG, "image/png"))
+	}
+	if meshData != nil {
+		result.Set("mesh", newBlob(meshData, c.exportFormat.MimeType()))
+		result.Set("meshFormat", c.exportFormat.String())
+	}
+
+	if c.onCapture.Type() == js.TypeFunction {
+		c.onCapture.Invoke(result)
+		return nil
+	}
+	c.download("facemask-photo.png", result.Get("photo"))
+	if maskPNG != nil {
+		c.download("facemask.png", result.Get("mask"))
+	}
+	if meshData != nil {
+		c.download("facemask."+c.exportFormat.String(), result.Get("mesh"))
+	}
+	return nil
+}
+
+// isolateMask cuts the triangulated face region out through the placed mask, returning an image sized
+// to the bounds of the rotated mask, with transparent background. It returns nil if the mask is not available.
+func (c *Canvas) isolateMask(s *faceSnapshot) *image.NRGBA {
+	pm := s.placedMask()
+	if pm == nil || pm.Rect.Empty() {
+		return nil
+	}
+	// The placed mask is expressed in the face region coordinates.
+	b := pm.Rect
+	dst := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if x < 0 || y < 0 || x >= s.scale || y >= s.scale {
+				continue
+			}
+			a := pm.Pix[pm.PixOffset(x, y)+3]
+			if a == 0 {
+				continue
+			}
+			i, j := (y*s.scale+x)*4, dst.PixOffset(x-b.Min.X, y-b.Min.Y)
+			copy(dst.Pix[j:j+3], s.pixels[i:i+3])
+			dst.Pix[j+3] = a
+		}
+	}
+	return dst
+}
+
+// encodePNG encodes the image in PNG format.
+func encodePNG(img image.Image) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := png.Encoder{CompressionLevel: png.BestSpeed}
+	if err := enc.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// detectSnapshot listens for the click events of the snapshot button and starts the capture countdown.
+func (c *Canvas) detectSnapshot() {
+	clickEventHandler := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		c.capture.start()
+		return nil
+	})
+	c.snapshotBtn.Call("addEventListener", "click", clickEventHandler)
+}
+
+// exposeCapture registers the capture controls as a global Javascript object with the provided name:
+//
+//	capture()          starts the capture countdown
+//	autoCapture([on])  returns whether the auto capture is enabled, after changing it if a value is provided
+//	onCapture(fn)      registers the callback receiving the captured {photo, mask, mesh, meshFormat} Blobs
+//	                   instead of downloading them; the callback is removed by passing null
+func (c *Canvas) exposeCapture(name string) {
+	api := js.Global().Get("Object").New()
+
+	api.Set("capture", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		c.capture.start()
+		return nil
+	}))
+	api.Set("autoCapture", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		if len(args) > 0 {
+			c.capture.auto = args[0].Truthy()
+		}
+		return c.capture.auto
+	}))
+	api.Set("onCapture", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		if len(args) > 0 {
+			c.onCapture = args[0]
+		}
+		return nil
+	}))
+	js.Global().Set(name, api)
+}
@@ -0,0 +1,110 @@
+package facemask
+
+import (
+	"bytes"
+	"image"
+	"math"
+	"syscall/js"
+	"time"
+
+	"github.com/esimov/pigo-wasm-demos/mesh"
+	"github.com/esimov/pigo-wasm-demos/overlay"
+)
+
+// exportDepth is the extrusion depth of the exported 3D models, relative to the face region size.
+const exportDepth = 0.05
+
+// revokeDelay is the delay after which the URL of a downloaded file is revoked.
+const revokeDelay = 10 * time.Second
+
+// faceSnapshot holds the triangulated face region of a frame, which can be exported.
+type faceSnapshot struct {
+	frame int
+	scale int
+	// aligned reports whether the head alignment of the face is appropriate for capturing.
+	aligned bool
+	// mesh holds the triangles of the face region. It's only built for the captured frames,
+	// unless the triangulation is coherent, in which case the mesh is reused between the frames.
+	mesh *mesh.Mesh
+	// place is the placement of the mask image relative to the face region.
+	place overlay.Placement
+	// maskImg is the image of the mask the face region is cut out through.
+	maskImg image.Image
+	// placed is the mask image rendered with its placement, see placedMask.
+	placed *image.NRGBA
+	// pixels holds the triangulated face region, if the frame was captured.
+	pixels []uint8
+}
+
+// exportMesh exports the triangles of the face covered by the mask in the selected format.
+// It returns nil if the snapshot has no triangles covered by the mask.
+func (c *Canvas) exportMesh(s *faceSnapshot) ([]byte, error) {
+	m := s.mesh
+	if m == nil {
+		return nil, nil
+	}
+	if pm := s.placedMask(); pm != nil && !pm.Rect.Empty() {
+		m = m.Subset(func(t [3]int) bool {
+			return c.masked(s, t)
+		})
+	}
+	if len(m.Triangles) == 0 {
+		return nil, nil
+	}
+
+	var buf bytes.Buffer
+	if err := m.Export(&buf, c.exportFormat, float64(s.scale)*exportDepth); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// placedMask returns the mask image rotated and scaled over the face region, the same way it's drawn
+// over the canvas, or nil if the snapshot has no mask image. The mask is rendered on first use only.
+func (s *faceSnapshot) placedMask() *image.NRGBA {
+	if s.placed == nil && s.maskImg != nil {
+		s.placed = overlay.Render(s.maskImg, s.place)
+	}
+	return s.placed
+}
+
+// masked reports whether the centroid of the triangle is covered by the mask image.
+func (c *Canvas) masked(s *faceSnapshot, t [3]int) bool {
+	p0, p1, p2 := s.mesh.Points[t[0]], s.mesh.Points[t[1]], s.mesh.Points[t[2]]
+	cx, cy := (p0.X+p1.X+p2.X)/3, (p0.Y+p1.Y+p2.Y)/3
+
+	// The pixels outside of the mask bounds are transparent.
+	return s.placedMask().NRGBAAt(int(math.Floor(cx)), int(math.Floor(cy))).A >= 0x80
+}
+
+// newBlob copies the data into a new Javascript Blob of the provided media type.
+func newBlob(data []byte, mimeType string) js.Value {
+	uint8Arr := js.Global().Get("Uint8Array").New(len(data))
+	js.CopyBytesToJS(uint8Arr, data)
+
+	opts := js.Global().Get("Object").New()
+	opts.Set("type", mimeType)
+	return js.Global().Get("Blob").New([]interface{}{uint8Arr}, opts)
+}
+
+// download offers the Blob for download as a file with the provided name.
+func (c *Canvas) download(name string, blob js.Value) {
+	url := js.Global().Get("URL").Call("createObjectURL", blob)
+
+	link := c.doc.Call("createElement", "a")
+	link.Set("href", url)
+	link.Set("download", name)
+	c.body.Call("appendChild", link)
+	link.Call("click")
+	c.body.Call("removeChild", link)
+
+	// The download starts asynchronously, and some browsers (e.g. Firefox) cancel it
+	// if the URL is revoked right after the click, so the URL is revoked later.
+	var revoke js.Func
+	revoke = js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		js.Global().Get("URL").Call("revokeObjectURL", url)
+		revoke.Release()
+		return nil
+	})
+	js.Global().Call("setTimeout", revoke, revokeDelay.Milliseconds())
+}
@@ -0,0 +1,208 @@
+package mask
+
+import (
+	"math"
+	"sort"
+
+	pigo "github.com/esimov/pigo/core"
+)
+
+// Kind defines the shape used for masking out the detected face region.
+type Kind int
+
+const (
+	// Ellipse approximates the face with a fixed aspect ratio ellipse.
+	Ellipse Kind = iota
+	// Contour fits a face shaped hull over the pupils and the facial landmark points.
+	Contour
+)
+
+// String returns the name of the mask kind.
+func (k Kind) String() string {
+	switch k {
+	case Contour:
+		return "contour"
+	default:
+		return "ellipse"
+	}
+}
+
+// Point defines a point with floating point coordinates.
+type Point struct {
+	X, Y float64
+}
+
+// Face holds the facial features used for fitting the face contour.
+type Face struct {
+	LeftPupil  Point
+	RightPupil Point
+	Eyes       []Point
+	Mouth      []Point
+}
+
+// faceTemplate is a canonical face outline expressed in the coordinate system of the eyes:
+// the origin is the middle point between the pupils, the x axis points to the right pupil,
+// the y axis points to the chin and the unit is the distance between the pupils.
+var faceTemplate = []Point{
+	{0, -1.05},
+	{0.55, -0.98}, {0.85, -0.75}, {1.0, -0.35}, {1.05, 0},
+	{1.02, 0.45}, {0.92, 0.9}, {0.72, 1.3}, {0.4, 1.62},
+	{0, 1.75},
+	{-0.4, 1.62}, {-0.72, 1.3}, {-0.92, 0.9}, {-1.02, 0.45},
+	{-1.05, 0}, {-1.0, -0.35}, {-0.85, -0.75}, {-0.55, -0.98},
+}
+
+const (
+	// eyeToMouth is the distance between the eyes and the mouth center measured in pupil distance units.
+	eyeToMouth = 1.05
+	// splineSteps is the number of interpolated segments between two consecutive hull points.
+	splineSteps = 4
+	// eyePoints is the number of landmark points returned by the detector for the eyes.
+	eyePoints = 10
+)
+
+// NewFace creates a new Face from the detected pupils and facial landmark points.
+// The landmark points are expected in the format and order returned by the detector,
+// i.e. [col, row, scale], the eye points being followed by the mouth points.
+func NewFace(leftPupil, rightPupil *pigo.Puploc, landmarks [][]int) *Face {
+	f := &Face{
+		LeftPupil:  Point{X: float64(leftPupil.Col), Y: float64(leftPupil.Row)},
+		RightPupil: Point{X: float64(rightPupil.Col), Y: float64(rightPupil.Row)},
+	}
+	for i, lm := range landmarks {
+		if len(lm) < 2 {
+			continue
+		}
+		p := Point{X: float64(lm[0]), Y: float64(lm[1])}
+		if i < eyePoints {
+			f.Eyes = append(f.Eyes, p)
+		} else {
+			f.Mouth = append(f.Mouth, p)
+		}
+	}
+	return f
+}
+
+// Contour returns the closed face contour as a polygon, smoothed by a Catmull-Rom spline.
+// The canonical face template is oriented and scaled by the pupils, stretched vertically
+// to match the mouth position, then merged with the landmark points into a convex hull.
+func (f *Face) Contour() []Point {
+	ux, uy := f.RightPupil.X-f.LeftPupil.X, f.RightPupil.Y-f.LeftPupil.Y
+	dist := math.Hypot(ux, uy)
+	if dist == 0 {
+		return nil
+	}
+	ux, uy = ux/dist, uy/dist
+	// The normal pointing toward the chin.
+	nx, ny := -uy, ux
+	cx, cy := (f.LeftPupil.X+f.RightPupil.X)/2, (f.LeftPupil.Y+f.RightPupil.Y)/2
+
+	// Adjust the vertical stretch of the template by the distance between the eyes and the mouth.
+	stretch := 1.0
+	if len(f.Mouth) > 0 {
+		var my float64
+		for _, p := range f.Mouth {
+			my += (p.X-cx)*nx + (p.Y-cy)*ny
+		}
+		my /= float64(len(f.Mouth))
+		stretch = clamp(my/(dist*eyeToMouth), 0.8, 1.3)
+	}
+
+	points := make([]Point, 0, len(faceTemplate)+len(f.Eyes)+len(f.Mouth))
+	for _, p := range faceTemplate {
+		tx, ty := p.X*dist, p.Y*dist
+		if ty > 0 {
+			ty *= stretch
+		}
+		points = append(points, Point{
+			X: cx + tx*ux + ty*nx,
+			Y: cy + tx*uy + ty*ny,
+		})
+	}
+	points = append(points, f.Eyes...)
+	points = append(points, f.Mouth...)
+
+	return smooth(convexHull(points), splineSteps)
+}
+
+// Translate offsets the polygon points with the provided values.
+func Translate(poly []Point, dx, dy float64) []Point {
+	res := make([]Point, len(poly))
+	for i, p := range poly {
+		res[i] = Point{X: p.X + dx, Y: p.Y + dy}
+	}
+	return res
+}
+
+// convexHull computes the convex hull of the points using the monotone chain algorithm.
+// The hull is returned in counterclockwise order.
+func convexHull(points []Point) []Point {
+	if len(points) < 3 {
+		return points
+	}
+	pts := make([]Point, len(points))
+	copy(pts, points)
+	sort.Slice(pts, func(i, j int) bool {
+		if pts[i].X == pts[j].X {
+			return pts[i].Y < pts[j].Y
+		}
+		return pts[i].X < pts[j].X
+	})
+
+	cross := func(o, a, b Point) float64 {
+		return (a.X-o.X)*(b.Y-o.Y) - (a.Y-o.Y)*(b.X-o.X)
+	}
+
+	hull := make([]Point, 0, 2*len(pts))
+	// Build the lower hull.
+	for _, p := range pts {
+		for len(hull) >= 2 && cross(hull[len(hull)-2], hull[len(hull)-1], p) <= 0 {
+			hull = hull[:len(hull)-1]
+		}
+		hull = append(hull, p)
+	}
+	// Build the upper hull.
+	lower := len(hull) + 1
+	for i := len(pts) - 2; i >= 0; i-- {
+		p := pts[i]
+		for len(hull) >= lower && cross(hull[len(hull)-2], hull[len(hull)-1], p) <= 0 {
+			hull = hull[:len(hull)-1]
+		}
+		hull = append(hull, p)
+	}
+	return hull[:len(hull)-1]
+}
+
+// smooth interpolates the closed polygon with a uniform Catmull-Rom spline.
+func smooth(poly []Point, steps int) []Point {
+	n := len(poly)
+	if n < 3 || steps < 2 {
+		return poly
+	}
+	res := make([]Point, 0, n*steps)
+	for i := 0; i < n; i++ {
+		p0, p1 := poly[(i-1+n)%n], poly[i]
+		p2, p3 := poly[(i+1)%n], poly[(i+2)%n]
+
+		for s := 0; s < steps; s++ {
+			t := float64(s) / float64(steps)
+			t2, t3 := t*t, t*t*t
+			res = append(res, Point{
+				X: 0.5 * (2*p1.X + (p2.X-p0.X)*t + (2*p0.X-5*p1.X+4*p2.X-p3.X)*t2 + (3*p1.X-p0.X-3*p2.X+p3.X)*t3),
+				Y: 0.5 * (2*p1.Y + (p2.Y-p0.Y)*t + (2*p0.Y-5*p1.Y+4*p2.Y-p3.Y)*t2 + (3*p1.Y-p0.Y-3*p2.Y+p3.Y)*t3),
+			})
+		}
+	}
+	return res
+}
+
+// clamp restricts the value between the min and max limits.
+func clamp(v, min, max float64) float64 {
+	if v < min {
+		return min
+	}
+	if v > max {
+		return max
+	}
+	return v
+}
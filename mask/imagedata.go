@@ -0,0 +1,19 @@
+//go:build js && wasm
+
+package mask
+
+import (
+	"syscall/js"
+
+	"github.com/esimov/pigo-wasm-demos/pixels"
+)
+
+// ToImageData rasterizes the face contour mask of the square face region having the provided size,
+// located at (x, y), and returns it as a Javascript ImageData, having the mask in its alpha channel.
+func ToImageData(face *Face, x, y, scale int) js.Value {
+	uint8Arr := js.Global().Get("Uint8Array").New(scale * scale * 4)
+	js.CopyBytesToJS(uint8Arr, pixels.AlphaToPix(Rasterize(face, x, y, scale)))
+
+	uint8Clamped := js.Global().Get("Uint8ClampedArray").New(uint8Arr)
+	return js.Global().Get("ImageData").New(uint8Clamped, scale)
+}
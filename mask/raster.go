@@ -0,0 +1,138 @@
+package mask
+
+import (
+	"image"
+	"math"
+	"sort"
+)
+
+const (
+	// subSamples is the number of vertical samples per pixel row used for anti-aliasing.
+	subSamples = 4
+	// Feather is the feathering radius of the face contour mask relative to the face scale.
+	Feather = 0.05
+)
+
+// Rasterize fits the face contour over the facial landmark points and rasterizes it as a feathered
+// alpha mask of the square face region having the provided size, located at (x, y).
+func Rasterize(face *Face, x, y, scale int) *image.Alpha {
+	poly := Translate(face.Contour(), float64(-x), float64(-y))
+	alpha := image.NewAlpha(image.Rect(0, 0, scale, scale))
+	Fill(alpha, poly, int(float64(scale)*Feather))
+	return alpha
+}
+
+// Fill rasterizes the closed polygon into the alpha mask using the even-odd rule.
+// The polygon edges are anti-aliased by computing the horizontal coverage of each span
+// over a few vertical sub-samples. If feather is greater than zero the mask edges are
+// softened with a box blur of the provided radius applied twice.
+func Fill(dst *image.Alpha, poly []Point, feather int) {
+	for i := range dst.Pix {
+		dst.Pix[i] = 0
+	}
+	if len(poly) < 3 {
+		return
+	}
+
+	b := dst.Bounds()
+	width := b.Dx()
+	cover := make([]float64, width)
+	xs := make([]float64, 0, 8)
+	n := len(poly)
+
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for i := range cover {
+			cover[i] = 0
+		}
+		for s := 0; s < subSamples; s++ {
+			sy := float64(y) + (float64(s)+0.5)/subSamples
+			xs = xs[:0]
+			for i := 0; i < n; i++ {
+				p0, p1 := poly[i], poly[(i+1)%n]
+				if (p0.Y <= sy) != (p1.Y <= sy) {
+					xs = append(xs, p0.X+(sy-p0.Y)*(p1.X-p0.X)/(p1.Y-p0.Y))
+				}
+			}
+			sort.Float64s(xs)
+			for i := 0; i+1 < len(xs); i += 2 {
+				addSpan(cover, xs[i]-float64(b.Min.X), xs[i+1]-float64(b.Min.X), 1.0/subSamples)
+			}
+		}
+		row := dst.Pix[(y-b.Min.Y)*dst.Stride:]
+		for x, c := range cover {
+			row[x] = uint8(clamp(c, 0, 1)*255 + 0.5)
+		}
+	}
+
+	if feather > 0 {
+		boxBlur(dst, feather)
+		boxBlur(dst, feather)
+	}
+}
+
+// addSpan accumulates the coverage of the [x0, x1) horizontal span into the cover buffer.
+func addSpan(cover []float64, x0, x1, weight float64) {
+	width := float64(len(cover))
+	x0, x1 = clamp(x0, 0, width), clamp(x1, 0, width)
+	if x1 <= x0 {
+		return
+	}
+	i0, i1 := int(math.Floor(x0)), int(math.Floor(x1))
+	if i0 == i1 {
+		cover[i0] += (x1 - x0) * weight
+		return
+	}
+	cover[i0] += (float64(i0+1) - x0) * weight
+	for i := i0 + 1; i < i1; i++ {
+		cover[i] += weight
+	}
+	if i1 < len(cover) {
+		cover[i1] += (x1 - float64(i1)) * weight
+	}
+}
+
+// boxBlur applies a separable box blur with the provided radius over the alpha mask.
+func boxBlur(img *image.Alpha, radius int) {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w == 0 || h == 0 {
+		return
+	}
+	tmp := make([]uint8, w*h)
+	size := 2*radius + 1
+
+	// Horizontal pass.
+	for y := 0; y < h; y++ {
+		row := img.Pix[y*img.Stride : y*img.Stride+w]
+		sum := 0
+		for x := -radius; x <= radius; x++ {
+			sum += int(row[clampInt(x, 0, w-1)])
+		}
+		for x := 0; x < w; x++ {
+			tmp[y*w+x] = uint8(sum / size)
+			sum += int(row[clampInt(x+radius+1, 0, w-1)]) - int(row[clampInt(x-radius, 0, w-1)])
+		}
+	}
+	// Vertical pass.
+	for x := 0; x < w; x++ {
+		sum := 0
+		for y := -radius; y <= radius; y++ {
+			sum += int(tmp[clampInt(y, 0, h-1)*w+x])
+		}
+		for y := 0; y < h; y++ {
+			img.Pix[y*img.Stride+x] = uint8(sum / size)
+			sum += int(tmp[clampInt(y+radius+1, 0, h-1)*w+x]) - int(tmp[clampInt(y-radius, 0, h-1)*w+x])
+		}
+	}
+}
+
+// clampInt restricts the integer value between the min and max limits.
+func clampInt(v, min, max int) int {
+	if v < min {
+		return min
+	}
+	if v > max {
+		return max
+	}
+	return v
+}
@@ -5,7 +5,9 @@ import (
 	"math"
 	"syscall/js"
 
+	"github.com/esimov/pigo-wasm-demos/asset"
 	"github.com/esimov/pigo-wasm-demos/detector"
+	"github.com/esimov/pigo-wasm-demos/overlay"
 	"github.com/esimov/pigo-wasm-demos/pixels"
 )
 
@@ -31,6 +33,10 @@ type Canvas struct {
 	navigator js.Value
 	video     js.Value
 
+	// masks holds the mask templates, the eye and the mouth masks being cycled through separately.
+	masks  *overlay.Library
+	assets *asset.Loader
+
 	showPupil     bool
 	showFaceRect  bool
 	showEyeMask   bool
@@ -39,31 +45,12 @@ type Canvas struct {
 	drawCircle    bool
 }
 
-type point struct {
-	x, y int
-}
+const (
+	// manifest lists the mask templates loaded on start.
+	manifest = "/images/masquerade.json"
 
-var (
-	eyemasks   = make([]js.Value, 6)
-	mouthmasks = make([]js.Value, 2)
-	sunglasses = []string{
-		"/images/sunglass-yellow.png",
-		"/images/sunglass-red.png",
-		"/images/sunglass-green.png",
-		"/images/sunglass-disco.png",
-		"/images/carnival.png",
-		"/images/carnival2.png",
-	}
-	masks = []string{
-		"/images/surgical-mask.png",
-		"/images/surgical-mask-mustache.png",
-	}
-	eyeMaskWidth    int
-	eyeMaskHeight   int
-	mouthMaskWidth  int
-	mouthMaskHeight int
-	eyeMaskIdx      int
-	mouthMaskIdx    int
+	eyeMasks   = "eyes"
+	mouthMasks = "mouth"
 )
 
 var det *detector.Detector
@@ -91,6 +78,10 @@ func NewCanvas() *Canvas {
 	c.showMouthMask = true
 	c.drawCircle = false
 
+	c.assets = asset.NewLoader()
+	c.masks = overlay.NewLibrary(c.assets)
+	c.masks.Expose("masks")
+
 	det = detector.NewDetector()
 	return &c
 }
@@ -99,31 +90,13 @@ func NewCanvas() *Canvas {
 func (c *Canvas) Render() {
 	width, height := c.windowSize.width, c.windowSize.height
 	var data = make([]byte, width*height*4)
+	var gray = make([]byte, width*height)
 	c.done = make(chan struct{})
 
-	for i, file := range sunglasses {
-		img, err := pixels.LoadImage(file)
-		if err != nil {
-			c.Alert(err)
-			return
-		}
-		eyemasks[i] = js.Global().Call("eval", "new Image()")
-		eyemasks[i].Set("src", "data:image/png;base64,"+img)
-	}
-	eyeMaskWidth = js.ValueOf(eyemasks[0].Get("naturalWidth")).Int()
-	eyeMaskHeight = js.ValueOf(eyemasks[0].Get("naturalHeight")).Int()
-
-	for i, file := range masks {
-		img, err := pixels.LoadImage(file)
-		if err != nil {
-			c.Alert(err)
-			return
-		}
-		mouthmasks[i] = js.Global().Call("eval", "new Image()")
-		mouthmasks[i].Set("src", "data:image/png;base64,"+img)
+	if err := c.masks.Load(manifest); err != nil {
+		c.Alert(fmt.Sprintf("failed loading the masks: %v", err))
+		return
 	}
-	mouthMaskWidth = js.ValueOf(mouthmasks[0].Get("naturalWidth")).Int()
-	mouthMaskHeight = js.ValueOf(mouthmasks[0].Get("naturalHeight")).Int()
 
 	if err := det.UnpackCascades(); err == nil {
 		c.renderer = js.FuncOf(func(this js.Value, args []js.Value) interface{} {
@@ -140,14 +113,9 @@ func (c *Canvas) Render() {
 				uint8Arr := js.Global().Get("Uint8Array").New(rgba)
 				js.CopyBytesToGo(data, uint8Arr)
 
-				pixels := pixels.RgbaToGrayscale(data, width, height)
+				gray = pixels.Grayscale(gray, data, pixels.BT709)
 
-				// Reset the data slice to its default values to avoid unnecessary memory allocation.
-				// Otherwise, the GC won't clean up the memory address allocated by this slice
-				// and the memory will keep up increasing by each iteration.
-				data = make([]byte, len(data))
-
-				res := det.DetectFaces(pixels, height, width)
+				res := det.DetectFaces(gray, height, width)
 				c.drawDetection(res)
 
 				c.window.Get("stats").Call("end")
@@ -229,9 +197,6 @@ func (c *Canvas) StartWebcam() (*Canvas, error) {
 
 // drawDetection draws the detected faces and eyes.
 func (c *Canvas) drawDetection(dets [][]int) {
-	var p1, p2 point
-	var imgScale float64
-
 	for i := 0; i < len(dets); i++ {
 		if dets[i][3] > 50 {
 			row, col, scale := dets[i][1], dets[i][0], dets[i][2]
@@ -258,77 +223,34 @@ func (c *Canvas) drawDetection(dets [][]int) {
 
 			if c.showPupil {
 				leftPupil := det.DetectLeftPupil(dets[i])
-				if leftPupil != nil {
-					if !c.showEyeMask {
-						col, row, scale := leftPupil.Col, leftPupil.Row, leftPupil.Scale/8
-						c.ctx.Call("moveTo", col+int(scale), row)
-						c.ctx.Call("arc", col, row, scale, 0, 2*math.Pi, true)
-					}
-					p1 = point{x: leftPupil.Row, y: leftPupil.Col}
+				if leftPupil != nil && !c.showEyeMask {
+					col, row, scale := leftPupil.Col, leftPupil.Row, leftPupil.Scale/8
+					c.ctx.Call("moveTo", col+int(scale), row)
+					c.ctx.Call("arc", col, row, scale, 0, 2*math.Pi, true)
 				}
 
 				rightPupil := det.DetectRightPupil(dets[i])
-				if rightPupil != nil {
-					if !c.showEyeMask {
-						col, row, scale := rightPupil.Col, rightPupil.Row, rightPupil.Scale/8
-						c.ctx.Call("moveTo", col+int(scale), row)
-						c.ctx.Call("arc", col, row, scale, 0, 2*math.Pi, true)
-					}
-					p2 = point{x: rightPupil.Row, y: rightPupil.Col}
+				if rightPupil != nil && !c.showEyeMask {
+					col, row, scale := rightPupil.Col, rightPupil.Row, rightPupil.Scale/8
+					c.ctx.Call("moveTo", col+int(scale), row)
+					c.ctx.Call("arc", col, row, scale, 0, 2*math.Pi, true)
 				}
 				c.ctx.Call("stroke")
 
-				// Show mouth mask
-				if c.showMouthMask && (p1.x != 0 && p2.y != 0) {
-					points := det.DetectMouthPoints(leftPupil, rightPupil)
-					p1, p2 := points[0], points[1]
-
-					// Calculate the lean angle between the two mouth points.
-					angle := 1 - (math.Atan2(float64(p2[0]-p1[0]), float64(p2[1]-p1[1])) * 180 / math.Pi / 90)
-					if scale < mouthMaskWidth || scale < mouthMaskHeight {
-						if mouthMaskHeight > mouthMaskWidth {
-							imgScale = float64(scale) / float64(mouthMaskHeight)
-						} else {
-							imgScale = float64(scale) / float64(mouthMaskWidth)
-						}
-					}
-					width, height := float64(mouthMaskWidth)*imgScale*0.75, float64(mouthMaskHeight)*imgScale*0.75
-					tx := row - int(width/2)
-					ty := p1[1] + (p1[1]-p2[1])/2 - int(height*0.5)
-
-					c.ctx.Call("save")
-					c.ctx.Call("translate", js.ValueOf(tx).Int(), js.ValueOf(ty).Int())
-					c.ctx.Call("rotate", js.ValueOf(angle).Float())
-					c.ctx.Call("drawImage", mouthmasks[mouthMaskIdx],
-						js.ValueOf(0).Int(), js.ValueOf(0).Int(),
-						js.ValueOf(width).Int(), js.ValueOf(height).Int(),
-					)
-					c.ctx.Call("restore")
+				if leftPupil == nil || rightPupil == nil {
+					continue
 				}
-				// Show eye mask
-				if c.showEyeMask && (p1.x != 0 && p2.y != 0) {
-					// Calculate the lean angle between the pupils.
-					angle := 1 - (math.Atan2(float64(p2.y-p1.y), float64(p2.x-p1.x)) * 180 / math.Pi / 90)
-					if scale < eyeMaskWidth || scale < eyeMaskHeight {
-						if eyeMaskHeight > eyeMaskWidth {
-							imgScale = float64(scale) / float64(eyeMaskHeight)
-						} else {
-							imgScale = float64(scale) / float64(eyeMaskWidth)
-						}
-					}
+				mouth := det.DetectMouthPoints(leftPupil, rightPupil)
+				features := overlay.NewFeatures(leftPupil, rightPupil, mouth)
 
-					width, height := float64(eyeMaskWidth)*imgScale, float64(eyeMaskHeight)*imgScale
-					tx := row - int(width/2)
-					ty := leftPupil.Row + (leftPupil.Row-rightPupil.Row)/2 - int(height/2)
-
-					c.ctx.Call("save")
-					c.ctx.Call("translate", js.ValueOf(tx).Int(), js.ValueOf(ty).Int())
-					c.ctx.Call("rotate", js.ValueOf(angle).Float())
-					c.ctx.Call("drawImage", eyemasks[eyeMaskIdx],
-						js.ValueOf(0).Int(), js.ValueOf(0).Int(),
-						js.ValueOf(width).Int(), js.ValueOf(height).Int(),
-					)
-					c.ctx.Call("restore")
+				// The masks are drawn in their z-order, each of them being placed over its anchors.
+				for _, m := range c.masks.Selection() {
+					if (m.Group == eyeMasks && !c.showEyeMask) || (m.Group == mouthMasks && !c.showMouthMask) {
+						continue
+					}
+					if p, ok := m.Place(features, float64(scale)); ok {
+						m.Draw(c.ctx, p)
+					}
 				}
 			}
 		}
@@ -353,33 +275,13 @@ func (c *Canvas) detectKeyPress() {
 		case keyCode.String() == "s":
 			c.showMouthMask = !c.showMouthMask
 		case keyCode.String() == "e":
-			eyeMaskIdx++
-			if eyeMaskIdx > len(eyemasks)-1 {
-				eyeMaskIdx = 0
-			}
-			eyeMaskWidth = js.ValueOf(eyemasks[eyeMaskIdx].Get("naturalWidth")).Int()
-			eyeMaskHeight = js.ValueOf(eyemasks[eyeMaskIdx].Get("naturalHeight")).Int()
+			c.masks.Cycle(eyeMasks, 1)
 		case keyCode.String() == "d":
-			eyeMaskIdx--
-			if eyeMaskIdx < 0 {
-				eyeMaskIdx = len(eyemasks) - 1
-			}
-			eyeMaskWidth = js.ValueOf(eyemasks[eyeMaskIdx].Get("naturalWidth")).Int()
-			eyeMaskHeight = js.ValueOf(eyemasks[eyeMaskIdx].Get("naturalHeight")).Int()
+			c.masks.Cycle(eyeMasks, -1)
 		case keyCode.String() == "r":
-			mouthMaskIdx++
-			if mouthMaskIdx > len(mouthmasks)-1 {
-				mouthMaskIdx = 0
-			}
-			mouthMaskWidth = js.ValueOf(mouthmasks[mouthMaskIdx].Get("naturalWidth")).Int()
-			mouthMaskHeight = js.ValueOf(mouthmasks[mouthMaskIdx].Get("naturalHeight")).Int()
+			c.masks.Cycle(mouthMasks, 1)
 		case keyCode.String() == "f":
-			mouthMaskIdx--
-			if mouthMaskIdx < 0 {
-				mouthMaskIdx = len(mouthmasks) - 1
-			}
-			mouthMaskWidth = js.ValueOf(mouthmasks[mouthMaskIdx].Get("naturalWidth")).Int()
-			mouthMaskHeight = js.ValueOf(mouthmasks[mouthMaskIdx].Get("naturalHeight")).Int()
+			c.masks.Cycle(mouthMasks, -1)
 		}
 		return nil
 	})
@@ -0,0 +1,115 @@
+package mesh
+
+import (
+	"math"
+	"sync"
+
+	"github.com/esimov/pigo-wasm-demos/mask"
+)
+
+// Cache keeps the mesh of each tracked face between the frames, so that the triangulation does not
+// change from one frame to the next. The mesh points are stored in the coordinate system of the face
+// and placed into the image by the face transform of the current frame, while the triangle colors are
+// sampled again on each frame. The meshes are periodically rebuilt, adapting to the face changes.
+type Cache struct {
+	// RebuildFrames is the number of frames after which the mesh of a face is built again from scratch.
+	RebuildFrames int
+	// MaxScaleChange is the relative change of the face scale since the mesh was built, above which it's rebuilt.
+	MaxScaleChange float64
+	// Smoothing is the weight of the previous face transform in the running average of the transform,
+	// which damps the jitter of the detected pupils.
+	Smoothing float64
+
+	mu      sync.Mutex
+	entries map[int]*cacheEntry
+}
+
+// cacheEntry is the mesh of a tracked face.
+type cacheEntry struct {
+	points    []mask.Point // mesh points in face coordinates
+	triangles [][3]int
+	anchors   int
+	transform Transform // smoothed transform of the face
+	scale     float64   // face scale at the time the mesh was built
+	age       int       // number of frames since the mesh was built
+}
+
+// NewCache creates a new mesh cache, rebuilding the meshes after the provided number of frames.
+func NewCache(rebuildFrames int) *Cache {
+	return &Cache{
+		RebuildFrames:  rebuildFrames,
+		MaxScaleChange: 0.25,
+		Smoothing:      0.3,
+		entries:        make(map[int]*cacheEntry),
+	}
+}
+
+// Mesh returns the mesh of the face with the provided identifier, placed by the face transform of the
+// current frame. If the face has no cached mesh, or its mesh is due for a rebuild, the build function
+// is called to triangulate the face from scratch. The built mesh must use the same coordinates as the transform.
+func (c *Cache) Mesh(id int, t Transform, build func() *Mesh) *Mesh {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[id]
+	if ok {
+		e.age++
+		e.transform = t.Lerp(e.transform, c.Smoothing)
+		if e.age >= c.RebuildFrames || math.Abs(t.Scale/e.scale-1) > c.MaxScaleChange {
+			ok = false
+		}
+	}
+	if !ok || t.Scale <= 0 {
+		m := build()
+		if m == nil || t.Scale <= 0 {
+			delete(c.entries, id)
+			return m
+		}
+		e = &cacheEntry{
+			points:    make([]mask.Point, len(m.Points)),
+			triangles: m.Triangles,
+			anchors:   m.Anchors,
+			transform: t,
+			scale:     t.Scale,
+		}
+		for i, p := range m.Points {
+			e.points[i] = t.Invert(p)
+		}
+		c.entries[id] = e
+		return m
+	}
+
+	m := &Mesh{
+		Points:    make([]mask.Point, len(e.points)),
+		Triangles: e.triangles,
+		Anchors:   e.anchors,
+	}
+	for i, p := range e.points {
+		m.Points[i] = e.transform.Apply(p)
+	}
+	return m
+}
+
+// Retain drops the meshes of the faces not having their identifier in the list.
+func (c *Cache) Retain(ids []int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	keep := make(map[int]struct{}, len(ids))
+	for _, id := range ids {
+		keep[id] = struct{}{}
+	}
+	for id := range c.entries {
+		if _, ok := keep[id]; !ok {
+			delete(c.entries, id)
+		}
+	}
+}
+
+// Reset drops all the cached meshes, so that every face is triangulated from scratch on the next frame.
+func (c *Cache) Reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries = make(map[int]*cacheEntry)
+}
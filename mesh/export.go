@@ -0,0 +1,248 @@
+package mesh
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/esimov/pigo-wasm-demos/mask"
+)
+
+// Format defines the file format of the exported mesh.
+type Format int
+
+const (
+	// SVG exports the triangles as filled vector polygons.
+	SVG Format = iota
+	// JSON exports the vertices, the triangles and their fill colors.
+	JSON
+	// OBJ exports the mesh extruded into a solid, as a Wavefront OBJ model.
+	OBJ
+	// STL exports the mesh extruded into a solid, as a binary STL model ready for 3D printing.
+	STL
+
+	// Formats is the number of the export formats.
+	Formats = iota
+)
+
+// String returns the file extension of the format.
+func (f Format) String() string {
+	switch f {
+	case JSON:
+		return "json"
+	case OBJ:
+		return "obj"
+	case STL:
+		return "stl"
+	default:
+		return "svg"
+	}
+}
+
+// MimeType returns the media type of the format.
+func (f Format) MimeType() string {
+	switch f {
+	case JSON:
+		return "application/json"
+	case OBJ:
+		return "model/obj"
+	case STL:
+		return "model/stl"
+	default:
+		return "image/svg+xml"
+	}
+}
+
+// Export writes the mesh into the writer in the provided format. The OBJ and STL models are
+// extruded to the provided depth, which is measured in the same units as the mesh points.
+func (m *Mesh) Export(w io.Writer, f Format, depth float64) error {
+	switch f {
+	case JSON:
+		return m.WriteJSON(w)
+	case OBJ:
+		return m.WriteOBJ(w, depth)
+	case STL:
+		return m.WriteSTL(w, depth)
+	default:
+		return m.WriteSVG(w)
+	}
+}
+
+// WriteSVG writes the mesh as an SVG image, sized to the bounding box of the points.
+// Each triangle is stroked with its own fill color, which hides the seams between the neighboring triangles.
+func (m *Mesh) WriteSVG(w io.Writer) error {
+	min, max := m.bounds()
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "<svg xmlns=\"http://www.w3.org/2000/svg\" viewBox=\"%.2f %.2f %.2f %.2f\" width=\"%.0f\" height=\"%.0f\">\n",
+		min.X, min.Y, max.X-min.X, max.Y-min.Y, math.Ceil(max.X-min.X), math.Ceil(max.Y-min.Y))
+	for i, t := range m.Triangles {
+		p0, p1, p2 := m.Points[t[0]], m.Points[t[1]], m.Points[t[2]]
+		fill := m.hexColor(i)
+		fmt.Fprintf(bw, "<polygon points=\"%.2f,%.2f %.2f,%.2f %.2f,%.2f\" fill=\"%s\" stroke=\"%s\" stroke-width=\"0.5\" stroke-linejoin=\"round\"/>\n",
+			p0.X, p0.Y, p1.X, p1.Y, p2.X, p2.Y, fill, fill)
+	}
+	fmt.Fprintln(bw, "</svg>")
+	return bw.Flush()
+}
+
+// WriteJSON writes the vertices, the triangles as vertex index triplets, and the fill colors of the triangles.
+func (m *Mesh) WriteJSON(w io.Writer) error {
+	type export struct {
+		Vertices  [][2]float64 `json:"vertices"`
+		Triangles [][3]int     `json:"triangles"`
+		Colors    []string     `json:"colors"`
+	}
+	e := export{
+		Vertices:  make([][2]float64, len(m.Points)),
+		Triangles: m.Triangles,
+		Colors:    make([]string, len(m.Triangles)),
+	}
+	for i, p := range m.Points {
+		e.Vertices[i] = [2]float64{math.Round(p.X*100) / 100, math.Round(p.Y*100) / 100}
+	}
+	for i := range m.Triangles {
+		e.Colors[i] = m.hexColor(i)
+	}
+	return json.NewEncoder(w).Encode(e)
+}
+
+// WriteOBJ writes the mesh extruded to the provided depth as a Wavefront OBJ model.
+func (m *Mesh) WriteOBJ(w io.Writer, depth float64) error {
+	verts, faces := m.solid(depth)
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "# %d vertices, %d faces\n", len(verts), len(faces))
+	for _, v := range verts {
+		fmt.Fprintf(bw, "v %.3f %.3f %.3f\n", v[0], v[1], v[2])
+	}
+	// The OBJ indices are starting from one.
+	for _, f := range faces {
+		fmt.Fprintf(bw, "f %d %d %d\n", f[0]+1, f[1]+1, f[2]+1)
+	}
+	return bw.Flush()
+}
+
+// WriteSTL writes the mesh extruded to the provided depth as a binary STL model.
+func (m *Mesh) WriteSTL(w io.Writer, depth float64) error {
+	verts, faces := m.solid(depth)
+	bw := bufio.NewWriter(w)
+
+	var header [80]byte
+	copy(header[:], "triangulated face mask")
+	if _, err := bw.Write(header[:]); err != nil {
+		return err
+	}
+	if err := binary.Write(bw, binary.LittleEndian, uint32(len(faces))); err != nil {
+		return err
+	}
+	for _, f := range faces {
+		a, b, c := verts[f[0]], verts[f[1]], verts[f[2]]
+		// Each facet is stored as its unit normal, followed by its vertices and an unused attribute.
+		var facet [12]float32
+		n := normal(a, b, c)
+		for i := 0; i < 3; i++ {
+			facet[i] = float32(n[i])
+			facet[3+i] = float32(a[i])
+			facet[6+i] = float32(b[i])
+			facet[9+i] = float32(c[i])
+		}
+		if err := binary.Write(bw, binary.LittleEndian, facet); err != nil {
+			return err
+		}
+		if err := binary.Write(bw, binary.LittleEndian, uint16(0)); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// solid extrudes the mesh into a closed solid of the provided depth. The y axis is flipped, since the
+// image y axis points downward. The top and bottom faces are copies of the mesh, joined by side walls
+// along the boundary edges. All the faces are wound counterclockwise, seen from the outside.
+func (m *Mesh) solid(depth float64) (verts [][3]float64, faces [][3]int) {
+	_, max := m.bounds()
+	n := len(m.Points)
+	verts = make([][3]float64, 0, n*2)
+	for _, p := range m.Points {
+		verts = append(verts, [3]float64{p.X, max.Y - p.Y, depth})
+	}
+	for _, p := range m.Points {
+		verts = append(verts, [3]float64{p.X, max.Y - p.Y, 0})
+	}
+
+	// Orient the triangles counterclockwise in the flipped coordinates, then count the edge uses.
+	// The edges used by a single triangle are on the boundary of the mesh.
+	top := make([][3]int, len(m.Triangles))
+	uses := make(map[[2]int]int, len(m.Triangles)*2)
+	for i, t := range m.Triangles {
+		a, b, c := verts[t[0]], verts[t[1]], verts[t[2]]
+		if (b[0]-a[0])*(c[1]-a[1])-(b[1]-a[1])*(c[0]-a[0]) < 0 {
+			t[1], t[2] = t[2], t[1]
+		}
+		top[i] = t
+		for j := 0; j < 3; j++ {
+			e := [2]int{t[j], t[(j+1)%3]}
+			if e[0] > e[1] {
+				e[0], e[1] = e[1], e[0]
+			}
+			uses[e]++
+		}
+	}
+
+	faces = make([][3]int, 0, len(top)*2+len(uses))
+	for _, t := range top {
+		faces = append(faces, t, [3]int{t[0] + n, t[2] + n, t[1] + n})
+	}
+	for _, t := range top {
+		for j := 0; j < 3; j++ {
+			a, b := t[j], t[(j+1)%3]
+			e := [2]int{a, b}
+			if e[0] > e[1] {
+				e[0], e[1] = e[1], e[0]
+			}
+			if uses[e] != 1 {
+				continue
+			}
+			// The interior of the counterclockwise triangle is on the left side of the a->b edge,
+			// so the wall facing to the right points outward.
+			faces = append(faces, [3]int{a + n, b + n, b}, [3]int{a + n, b, a})
+		}
+	}
+	return verts, faces
+}
+
+// bounds returns the bounding box of the mesh points.
+func (m *Mesh) bounds() (min, max mask.Point) {
+	if len(m.Points) == 0 {
+		return min, max
+	}
+	min, max = m.Points[0], m.Points[0]
+	for _, p := range m.Points[1:] {
+		min.X, max.X = math.Min(min.X, p.X), math.Max(max.X, p.X)
+		min.Y, max.Y = math.Min(min.Y, p.Y), math.Max(max.Y, p.Y)
+	}
+	return min, max
+}
+
+// hexColor returns the fill color of the triangle as a CSS hex color. The triangles without color are black.
+func (m *Mesh) hexColor(i int) string {
+	if i >= len(m.Colors) {
+		return "#000000"
+	}
+	c := m.Colors[i]
+	return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+}
+
+// normal returns the unit normal of the counterclockwise triangle.
+func normal(a, b, c [3]float64) [3]float64 {
+	u := [3]float64{b[0] - a[0], b[1] - a[1], b[2] - a[2]}
+	v := [3]float64{c[0] - a[0], c[1] - a[1], c[2] - a[2]}
+	n := [3]float64{u[1]*v[2] - u[2]*v[1], u[2]*v[0] - u[0]*v[2], u[0]*v[1] - u[1]*v[0]}
+	l := math.Sqrt(n[0]*n[0] + n[1]*n[1] + n[2]*n[2])
+	if l == 0 {
+		return n
+	}
+	return [3]float64{n[0] / l, n[1] / l, n[2] / l}
+}
@@ -0,0 +1,390 @@
+package mesh
+
+import (
+	"image"
+	"image/color"
+	"math"
+
+	"github.com/esimov/pigo-wasm-demos/mask"
+	triangle "github.com/esimov/triangle/v2"
+)
+
+// Config holds the parameters of the face point set.
+type Config struct {
+	// GridPoints is the approximate number of grid points inside the face contour.
+	GridPoints int
+	// MinDistance is the minimum distance between two points of the set, measured in grid steps.
+	// The grid points closer than that to a facial feature are dropped, avoiding the sliver triangles.
+	MinDistance float64
+	// OutlineStep is the distance between the points sampled along the face contour, measured in grid steps.
+	OutlineStep float64
+}
+
+// DefaultConfig returns the default parameters of the face point set.
+func DefaultConfig() Config {
+	return Config{
+		GridPoints:  45,
+		MinDistance: 0.5,
+		OutlineStep: 1,
+	}
+}
+
+// Mesh is a triangulated face. The triangles are stored as triplets of indices into the points.
+type Mesh struct {
+	Points    []mask.Point
+	Triangles [][3]int
+	// Anchors is the number of leading points anchored to the facial features, i.e. the pupils and the landmarks.
+	Anchors int
+	// Colors holds the fill colors of the triangles, as drawn by the last Render call.
+	Colors []color.NRGBA
+}
+
+// RenderOptions defines how the mesh is drawn.
+type RenderOptions struct {
+	// Grayscale fills the triangles with the luminance of their color.
+	Grayscale bool
+	// StrokeWidth is the width of the triangle edges. No edges are drawn if it's zero.
+	StrokeWidth float64
+	// StrokeColor is the color of the triangle edges.
+	StrokeColor color.NRGBA
+}
+
+// Points returns the point set of the face: the pupils and the landmark points first, followed by the
+// points sampled along the face contour and by a regular grid laid out inside the contour. The grid is
+// expressed in the coordinate system of the eyes, so it follows the face movements instead of the
+// image content, and the resulting mesh keeps its structure from one frame to the next.
+// It also returns the number of anchor points, i.e. the pupils and the landmark points.
+func (cfg Config) Points(face *mask.Face) (points []mask.Point, anchors int) {
+	ux, uy := face.RightPupil.X-face.LeftPupil.X, face.RightPupil.Y-face.LeftPupil.Y
+	dist := math.Hypot(ux, uy)
+	contour := face.Contour()
+	if dist == 0 || len(contour) < 3 || cfg.GridPoints < 1 {
+		return nil, 0
+	}
+	ux, uy = ux/dist, uy/dist
+	nx, ny := -uy, ux
+	cx, cy := (face.LeftPupil.X+face.RightPupil.X)/2, (face.LeftPupil.Y+face.RightPupil.Y)/2
+
+	step := math.Sqrt(polygonArea(contour) / float64(cfg.GridPoints))
+	minDist := step * cfg.MinDistance
+
+	points = make([]mask.Point, 0, 2+len(face.Eyes)+len(face.Mouth)+cfg.GridPoints*2)
+	points = append(points, face.LeftPupil, face.RightPupil)
+	points = append(points, face.Eyes...)
+	points = append(points, face.Mouth...)
+	anchors = len(points)
+
+	add := func(p mask.Point) {
+		for _, q := range points {
+			if math.Hypot(p.X-q.X, p.Y-q.Y) < minDist {
+				return
+			}
+		}
+		points = append(points, p)
+	}
+
+	// Sample the contour at regular intervals, so that the face outline is made of mesh edges.
+	var walked float64
+	for i, p := range contour {
+		q := contour[(i+1)%len(contour)]
+		if walked <= 0 {
+			add(p)
+			walked = step * cfg.OutlineStep
+		}
+		walked -= math.Hypot(q.X-p.X, q.Y-p.Y)
+	}
+
+	// Lay out the grid around the middle point between the pupils, keeping only the points inside the contour.
+	min, max := polygonBounds(contour, cx, cy, ux, uy, nx, ny)
+	for gy := math.Floor(min.Y/step) * step; gy <= max.Y; gy += step {
+		for gx := math.Floor(min.X/step) * step; gx <= max.X; gx += step {
+			p := mask.Point{
+				X: cx + gx*ux + gy*nx,
+				Y: cy + gx*uy + gy*ny,
+			}
+			if insidePolygon(contour, p) {
+				add(p)
+			}
+		}
+	}
+	return points, anchors
+}
+
+// Triangulate builds the Delaunay triangulation of the points over the rectangle of the provided size.
+// The points outside of the rectangle are discarded. The corners of the rectangle are appended to
+// the points, so that the triangles cover the whole rectangle.
+func Triangulate(points []mask.Point, anchors, width, height int) *Mesh {
+	m := &Mesh{
+		Points: make([]mask.Point, 0, len(points)+4),
+	}
+	index := make(map[triangle.Node]int, len(points)+4)
+	input := make([]triangle.Point, 0, len(points))
+
+	for i, p := range points {
+		if p.X <= 0 || p.Y <= 0 || p.X >= float64(width) || p.Y >= float64(height) {
+			continue
+		}
+		// Coincident points would produce degenerate triangles.
+		node := triangle.Node{X: p.X, Y: p.Y}
+		if _, ok := index[node]; ok {
+			continue
+		}
+		index[node] = len(m.Points)
+		m.Points = append(m.Points, p)
+		input = append(input, triangle.Point{X: p.X, Y: p.Y})
+		if i < anchors {
+			m.Anchors++
+		}
+	}
+
+	delaunay := &triangle.Delaunay{}
+	for _, t := range delaunay.Init(width, height).Insert(input).GetTriangles() {
+		var tri [3]int
+		for i, node := range t.Nodes {
+			idx, ok := index[node]
+			if !ok {
+				// The corners of the rectangle are the only nodes which were not inserted.
+				idx = len(m.Points)
+				index[node] = idx
+				m.Points = append(m.Points, mask.Point{X: node.X, Y: node.Y})
+			}
+			tri[i] = idx
+		}
+		m.Triangles = append(m.Triangles, tri)
+	}
+	return m
+}
+
+// FromTriangles creates a mesh from the triangles generated by the triangle processor,
+// taking the fill colors from the image drawn by the processor at the triangle centroids.
+func FromTriangles(triangles []triangle.Triangle, img image.Image) *Mesh {
+	m := &Mesh{
+		Triangles: make([][3]int, 0, len(triangles)),
+		Colors:    make([]color.NRGBA, 0, len(triangles)),
+	}
+	index := make(map[triangle.Node]int, len(triangles))
+	b := img.Bounds()
+	for _, t := range triangles {
+		var tri [3]int
+		var cx, cy float64
+		for i, node := range t.Nodes {
+			idx, ok := index[node]
+			if !ok {
+				idx = len(m.Points)
+				index[node] = idx
+				m.Points = append(m.Points, mask.Point{X: node.X, Y: node.Y})
+			}
+			tri[i] = idx
+			cx, cy = cx+node.X/3, cy+node.Y/3
+		}
+		m.Triangles = append(m.Triangles, tri)
+		x, y := clampInt(int(cx), b.Min.X, b.Max.X-1), clampInt(int(cy), b.Min.Y, b.Max.Y-1)
+		m.Colors = append(m.Colors, color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA))
+	}
+	return m
+}
+
+// Subset returns a new mesh made of the triangles for which the keep function returns true.
+// The points not used by the kept triangles are removed, so the subset has no anchor points.
+func (m *Mesh) Subset(keep func(t [3]int) bool) *Mesh {
+	sub := &Mesh{}
+	index := make(map[int]int)
+	for i, t := range m.Triangles {
+		if !keep(t) {
+			continue
+		}
+		var tri [3]int
+		for j, p := range t {
+			idx, ok := index[p]
+			if !ok {
+				idx = len(sub.Points)
+				index[p] = idx
+				sub.Points = append(sub.Points, m.Points[p])
+			}
+			tri[j] = idx
+		}
+		sub.Triangles = append(sub.Triangles, tri)
+		if i < len(m.Colors) {
+			sub.Colors = append(sub.Colors, m.Colors[i])
+		}
+	}
+	return sub
+}
+
+// FromTrianglePoints converts the points picked by the triangle processor.
+func FromTrianglePoints(points []triangle.Point) []mask.Point {
+	res := make([]mask.Point, len(points))
+	for i, p := range points {
+		res[i] = mask.Point{X: p.X, Y: p.Y}
+	}
+	return res
+}
+
+// Render draws the triangles into the dst image, filling each of them with the average color
+// of the source image sampled at the centroid and halfway between the centroid and the vertices.
+// The dst image must have the same bounds as the source image.
+func (m *Mesh) Render(dst, src *image.NRGBA, opts RenderOptions) {
+	m.Colors = m.Colors[:0]
+	for _, t := range m.Triangles {
+		c := m.Color(src, t)
+		if opts.Grayscale {
+			y := uint8(0.299*float64(c.R) + 0.587*float64(c.G) + 0.114*float64(c.B) + 0.5)
+			c = color.NRGBA{R: y, G: y, B: y, A: c.A}
+		}
+		m.Colors = append(m.Colors, c)
+		fillTriangle(dst, m.Points[t[0]], m.Points[t[1]], m.Points[t[2]], c)
+	}
+	if opts.StrokeWidth <= 0 {
+		return
+	}
+	for _, e := range m.Edges() {
+		strokeLine(dst, m.Points[e[0]], m.Points[e[1]], opts.StrokeWidth, opts.StrokeColor)
+	}
+}
+
+// Edges returns the edges of the mesh as pairs of point indices, each edge listed only once.
+func (m *Mesh) Edges() [][2]int {
+	seen := make(map[[2]int]struct{}, len(m.Triangles)*2)
+	edges := make([][2]int, 0, len(m.Triangles)*2)
+	for _, t := range m.Triangles {
+		for i := 0; i < 3; i++ {
+			e := [2]int{t[i], t[(i+1)%3]}
+			if e[0] > e[1] {
+				e[0], e[1] = e[1], e[0]
+			}
+			if _, ok := seen[e]; !ok {
+				seen[e] = struct{}{}
+				edges = append(edges, e)
+			}
+		}
+	}
+	return edges
+}
+
+// Color returns the average color of the source image over the triangle.
+func (m *Mesh) Color(src *image.NRGBA, t [3]int) color.NRGBA {
+	p0, p1, p2 := m.Points[t[0]], m.Points[t[1]], m.Points[t[2]]
+	cx, cy := (p0.X+p1.X+p2.X)/3, (p0.Y+p1.Y+p2.Y)/3
+
+	samples := [4]mask.Point{
+		{X: cx, Y: cy},
+		{X: (cx + p0.X) / 2, Y: (cy + p0.Y) / 2},
+		{X: (cx + p1.X) / 2, Y: (cy + p1.Y) / 2},
+		{X: (cx + p2.X) / 2, Y: (cy + p2.Y) / 2},
+	}
+	b := src.Bounds()
+	var r, g, bl, a int
+	for _, s := range samples {
+		x := clampInt(int(s.X), b.Min.X, b.Max.X-1)
+		y := clampInt(int(s.Y), b.Min.Y, b.Max.Y-1)
+		c := src.NRGBAAt(x, y)
+		r, g, bl, a = r+int(c.R), g+int(c.G), bl+int(c.B), a+int(c.A)
+	}
+	n := len(samples)
+	return color.NRGBA{R: uint8(r / n), G: uint8(g / n), B: uint8(bl / n), A: uint8(a / n)}
+}
+
+// fillTriangle fills the pixels having their center inside the triangle with the provided color.
+func fillTriangle(dst *image.NRGBA, p0, p1, p2 mask.Point, c color.NRGBA) {
+	// Orient the triangle clockwise in image coordinates, so that all the edge functions are positive inside.
+	if edge(p0, p1, p2) < 0 {
+		p1, p2 = p2, p1
+	}
+	b := dst.Bounds()
+	x0 := clampInt(int(math.Floor(math.Min(p0.X, math.Min(p1.X, p2.X)))), b.Min.X, b.Max.X)
+	x1 := clampInt(int(math.Ceil(math.Max(p0.X, math.Max(p1.X, p2.X)))), b.Min.X, b.Max.X)
+	y0 := clampInt(int(math.Floor(math.Min(p0.Y, math.Min(p1.Y, p2.Y)))), b.Min.Y, b.Max.Y)
+	y1 := clampInt(int(math.Ceil(math.Max(p0.Y, math.Max(p1.Y, p2.Y)))), b.Min.Y, b.Max.Y)
+
+	for y := y0; y < y1; y++ {
+		for x := x0; x < x1; x++ {
+			p := mask.Point{X: float64(x) + 0.5, Y: float64(y) + 0.5}
+			if edge(p0, p1, p) >= 0 && edge(p1, p2, p) >= 0 && edge(p2, p0, p) >= 0 {
+				i := dst.PixOffset(x, y)
+				dst.Pix[i], dst.Pix[i+1], dst.Pix[i+2], dst.Pix[i+3] = c.R, c.G, c.B, c.A
+			}
+		}
+	}
+}
+
+// strokeLine draws a line of the provided width by stamping a square brush along it,
+// blending the color over the destination pixels.
+func strokeLine(dst *image.NRGBA, p0, p1 mask.Point, width float64, c color.NRGBA) {
+	b := dst.Bounds()
+	half := width / 2
+	length := math.Hypot(p1.X-p0.X, p1.Y-p0.Y)
+	steps := int(math.Ceil(length)) + 1
+
+	// The stamps overlap, so the pixels are marked first and blended only once.
+	touched := make(map[int]struct{}, steps*int(math.Ceil(width)+1))
+	for s := 0; s <= steps; s++ {
+		t := float64(s) / float64(steps)
+		x, y := p0.X+(p1.X-p0.X)*t, p0.Y+(p1.Y-p0.Y)*t
+		for py := int(math.Floor(y - half)); py < int(math.Ceil(y+half)); py++ {
+			for px := int(math.Floor(x - half)); px < int(math.Ceil(x+half)); px++ {
+				if px < b.Min.X || py < b.Min.Y || px >= b.Max.X || py >= b.Max.Y {
+					continue
+				}
+				touched[dst.PixOffset(px, py)] = struct{}{}
+			}
+		}
+	}
+	alpha := float64(c.A) / 255
+	for i := range touched {
+		dst.Pix[i] = uint8(float64(dst.Pix[i])*(1-alpha) + float64(c.R)*alpha + 0.5)
+		dst.Pix[i+1] = uint8(float64(dst.Pix[i+1])*(1-alpha) + float64(c.G)*alpha + 0.5)
+		dst.Pix[i+2] = uint8(float64(dst.Pix[i+2])*(1-alpha) + float64(c.B)*alpha + 0.5)
+	}
+}
+
+// edge returns the doubled signed area of the triangle defined by the a, b and p points.
+func edge(a, b, p mask.Point) float64 {
+	return (b.X-a.X)*(p.Y-a.Y) - (b.Y-a.Y)*(p.X-a.X)
+}
+
+// polygonArea returns the area enclosed by the polygon.
+func polygonArea(poly []mask.Point) float64 {
+	var area float64
+	for i, p := range poly {
+		q := poly[(i+1)%len(poly)]
+		area += p.X*q.Y - q.X*p.Y
+	}
+	return math.Abs(area) / 2
+}
+
+// polygonBounds returns the bounding box of the polygon in the coordinate system
+// having the origin in the center and the axes along the u and n unit vectors.
+func polygonBounds(poly []mask.Point, cx, cy, ux, uy, nx, ny float64) (min, max mask.Point) {
+	min = mask.Point{X: math.Inf(1), Y: math.Inf(1)}
+	max = mask.Point{X: math.Inf(-1), Y: math.Inf(-1)}
+	for _, p := range poly {
+		dx, dy := p.X-cx, p.Y-cy
+		x, y := dx*ux+dy*uy, dx*nx+dy*ny
+		min.X, max.X = math.Min(min.X, x), math.Max(max.X, x)
+		min.Y, max.Y = math.Min(min.Y, y), math.Max(max.Y, y)
+	}
+	return min, max
+}
+
+// insidePolygon reports whether the point lies inside the polygon, using the even-odd rule.
+func insidePolygon(poly []mask.Point, p mask.Point) bool {
+	var inside bool
+	for i, a := range poly {
+		b := poly[(i+1)%len(poly)]
+		if (a.Y <= p.Y) != (b.Y <= p.Y) && p.X < a.X+(p.Y-a.Y)*(b.X-a.X)/(b.Y-a.Y) {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+// clampInt restricts the integer value between the min and max limits.
+func clampInt(v, min, max int) int {
+	if v < min {
+		return min
+	}
+	if v > max {
+		return max
+	}
+	return v
+}
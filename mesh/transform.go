@@ -0,0 +1,60 @@
+package mesh
+
+import (
+	"math"
+
+	"github.com/esimov/pigo-wasm-demos/mask"
+)
+
+// Transform is a similarity transform mapping the coordinate system of a face into the image.
+type Transform struct {
+	// X and Y is the position of the face coordinate system origin in the image.
+	X, Y float64
+	// Scale is the length of the face coordinate system unit in image pixels.
+	Scale float64
+	// Angle is the rotation of the face coordinate system in radians.
+	Angle float64
+}
+
+// PupilTransform returns the transform of the face coordinate system defined by the pupils:
+// the origin is the middle point between the pupils, the x axis points to the right pupil
+// and the unit is the distance between the pupils.
+func PupilTransform(leftPupil, rightPupil mask.Point) Transform {
+	dx, dy := rightPupil.X-leftPupil.X, rightPupil.Y-leftPupil.Y
+	return Transform{
+		X:     (leftPupil.X + rightPupil.X) / 2,
+		Y:     (leftPupil.Y + rightPupil.Y) / 2,
+		Scale: math.Hypot(dx, dy),
+		Angle: math.Atan2(dy, dx),
+	}
+}
+
+// Apply maps the point from the face coordinates into the image coordinates.
+func (t Transform) Apply(p mask.Point) mask.Point {
+	sin, cos := math.Sincos(t.Angle)
+	return mask.Point{
+		X: t.X + (p.X*cos-p.Y*sin)*t.Scale,
+		Y: t.Y + (p.X*sin+p.Y*cos)*t.Scale,
+	}
+}
+
+// Invert maps the point from the image coordinates into the face coordinates.
+func (t Transform) Invert(p mask.Point) mask.Point {
+	sin, cos := math.Sincos(t.Angle)
+	dx, dy := (p.X-t.X)/t.Scale, (p.Y-t.Y)/t.Scale
+	return mask.Point{
+		X: dx*cos + dy*sin,
+		Y: -dx*sin + dy*cos,
+	}
+}
+
+// Lerp interpolates between the two transforms, taking the shortest way around for the rotation.
+func (t Transform) Lerp(u Transform, w float64) Transform {
+	da := math.Remainder(u.Angle-t.Angle, 2*math.Pi)
+	return Transform{
+		X:     t.X + (u.X-t.X)*w,
+		Y:     t.Y + (u.Y-t.Y)*w,
+		Scale: t.Scale + (u.Scale-t.Scale)*w,
+		Angle: t.Angle + da*w,
+	}
+}
@@ -0,0 +1,215 @@
+package noise
+
+import (
+	"image"
+	"math"
+)
+
+// Mode defines the type of the generated noise.
+type Mode int
+
+const (
+	// Mono adds the same uniformly distributed noise to all color channels.
+	Mono Mode = iota
+	// Chroma adds independent uniformly distributed noise to each color channel.
+	Chroma
+	// Gaussian adds the same normally distributed noise to all color channels.
+	Gaussian
+	// FilmGrain adds smooth, normally distributed noise, which is the strongest in the mid tones.
+	FilmGrain
+)
+
+// grainSize is the distance in pixels between the random samples interpolated by the film grain.
+const grainSize = 2
+
+// Generator is a deterministic noise generator. The noise of each pixel is derived from a hash
+// of the seed, the frame number and the pixel position, so the same seed always gives the same
+// noise, independently of the order in which the pixels are processed.
+type Generator struct {
+	Mode Mode
+	// Temporal changes the noise pattern on each frame, otherwise the noise is static.
+	Temporal bool
+
+	seed  uint64
+	frame uint64
+}
+
+// String returns the name of the noise mode.
+func (m Mode) String() string {
+	switch m {
+	case Chroma:
+		return "chroma"
+	case Gaussian:
+		return "gaussian"
+	case FilmGrain:
+		return "film grain"
+	default:
+		return "mono"
+	}
+}
+
+// NewGenerator creates a new noise generator with the provided seed and mode.
+func NewGenerator(seed int64, mode Mode) *Generator {
+	return &Generator{
+		Mode:     mode,
+		Temporal: true,
+		seed:     uint64(seed),
+	}
+}
+
+// Seed resets the generator with a new seed.
+func (g *Generator) Seed(seed int64) {
+	g.seed = uint64(seed)
+	g.frame = 0
+}
+
+// NextFrame advances the generator to the next frame.
+// If the temporal variation is disabled, the noise pattern remains the same.
+func (g *Generator) NextFrame() {
+	if g.Temporal {
+		g.frame++
+	}
+}
+
+// ApplyNRGBA64 adds the noise to the image. The amount is expressed in 8-bit color levels.
+func (g *Generator) ApplyNRGBA64(img *image.NRGBA64, amount float64) {
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			p := img.Pix[img.PixOffset(x, y):]
+			r := float64(uint16(p[0])<<8 | uint16(p[1]))
+			gr := float64(uint16(p[2])<<8 | uint16(p[3]))
+			bl := float64(uint16(p[4])<<8 | uint16(p[5]))
+
+			dr, dg, db := g.Sample(x, y, (0.2126*r+0.7152*gr+0.0722*bl)/0xffff)
+			scale := amount * 0x101
+			put16(p[0:2], r+dr*scale)
+			put16(p[2:4], gr+dg*scale)
+			put16(p[4:6], bl+db*scale)
+		}
+	}
+}
+
+// ApplyNRGBA adds the noise to the image. The amount is expressed in 8-bit color levels.
+func (g *Generator) ApplyNRGBA(img *image.NRGBA, amount float64) {
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			p := img.Pix[img.PixOffset(x, y):]
+			g.apply8(p, x, y, amount)
+		}
+	}
+}
+
+// ApplyPix adds the noise to the RGBA pixel buffer of the provided width.
+// The amount is expressed in 8-bit color levels.
+func (g *Generator) ApplyPix(pix []uint8, width int, amount float64) {
+	for i := 0; i+4 <= len(pix); i += 4 {
+		g.apply8(pix[i:i+4], (i/4)%width, (i/4)/width, amount)
+	}
+}
+
+// apply8 adds the noise to a single 8-bit RGBA pixel.
+func (g *Generator) apply8(p []uint8, x, y int, amount float64) {
+	r, gr, bl := float64(p[0]), float64(p[1]), float64(p[2])
+	dr, dg, db := g.Sample(x, y, (0.2126*r+0.7152*gr+0.0722*bl)/0xff)
+	p[0] = clamp8(r + dr*amount)
+	p[1] = clamp8(gr + dg*amount)
+	p[2] = clamp8(bl + db*amount)
+}
+
+// Sample returns the noise of the color channels at the (x, y) position, scaled to about the [-1, 1] range.
+// The luma is the brightness of the pixel in the [0, 1] range, used for modulating the film grain.
+func (g *Generator) Sample(x, y int, luma float64) (r, gr, b float64) {
+	switch g.Mode {
+	case Chroma:
+		return g.uniform(x, y, 0), g.uniform(x, y, 1), g.uniform(x, y, 2)
+	case Gaussian:
+		n := g.gaussian(x, y, 0) / 2
+		return n, n, n
+	case FilmGrain:
+		n := g.grain(x, y) * 4 * luma * (1 - luma)
+		return n, n, n
+	default:
+		n := g.uniform(x, y, 0)
+		return n, n, n
+	}
+}
+
+// uniform returns a uniformly distributed random value in the [-1, 1) range.
+func (g *Generator) uniform(x, y, ch int) float64 {
+	return float64(g.hash(x, y, ch)>>11)/(1<<52) - 1
+}
+
+// gaussian returns a normally distributed random value with zero mean and unit deviation.
+func (g *Generator) gaussian(x, y, ch int) float64 {
+	// Box-Muller transform of two uniform random values.
+	u1 := (float64(g.hash(x, y, 2*ch)>>11) + 1) / (1 << 53)
+	u2 := float64(g.hash(x, y, 2*ch+1)>>11) / (1 << 53)
+	return math.Sqrt(-2*math.Log(u1)) * math.Cos(2*math.Pi*u2)
+}
+
+// grain bilinearly interpolates the normally distributed random values of a coarser lattice.
+func (g *Generator) grain(x, y int) float64 {
+	gx, gy := floorDiv(x, grainSize), floorDiv(y, grainSize)
+	fx := float64(x-gx*grainSize) / grainSize
+	fy := float64(y-gy*grainSize) / grainSize
+
+	n00 := g.gaussian(gx, gy, 0)
+	n10 := g.gaussian(gx+1, gy, 0)
+	n01 := g.gaussian(gx, gy+1, 0)
+	n11 := g.gaussian(gx+1, gy+1, 0)
+	top := n00 + (n10-n00)*fx
+	bottom := n01 + (n11-n01)*fx
+	return (top + (bottom-top)*fy) / 2
+}
+
+// hash mixes the seed, the frame number, the pixel position and the channel into a random value.
+func (g *Generator) hash(x, y, ch int) uint64 {
+	h := g.seed ^ g.frame*0x9e3779b97f4a7c15
+	h ^= uint64(uint32(x)) | uint64(uint32(y))<<32
+	h = splitmix(h)
+	return splitmix(h ^ uint64(ch))
+}
+
+// splitmix is the finalizer of the SplitMix64 random number generator.
+func splitmix(h uint64) uint64 {
+	h += 0x9e3779b97f4a7c15
+	h = (h ^ h>>30) * 0xbf58476d1ce4e5b9
+	h = (h ^ h>>27) * 0x94d049bb133111eb
+	return h ^ h>>31
+}
+
+// floorDiv returns the quotient rounded towards negative infinity.
+func floorDiv(a, b int) int {
+	q := a / b
+	if a%b != 0 && a < 0 {
+		q--
+	}
+	return q
+}
+
+// put16 stores the value clamped to the 16-bit range in big endian order.
+func put16(p []uint8, v float64) {
+	var c uint16
+	switch {
+	case v <= 0:
+		c = 0
+	case v >= 0xffff:
+		c = 0xffff
+	default:
+		c = uint16(v + 0.5)
+	}
+	p[0], p[1] = uint8(c>>8), uint8(c)
+}
+
+// clamp8 rounds the value and restricts it to the 8-bit range.
+func clamp8(v float64) uint8 {
+	if v <= 0 {
+		return 0
+	}
+	if v >= 0xff {
+		return 0xff
+	}
+	return uint8(v + 0.5)
+}
@@ -0,0 +1,77 @@
+//go:build js && wasm
+
+package overlay
+
+import "syscall/js"
+
+// Expose registers the library as a global Javascript object with the provided name, with the following methods:
+//
+//	load(path)      loads the manifest located at the path along with its mask images; returns a Promise
+//	upload(files)   loads the manifest and the mask images from the File objects, e.g. the files of an
+//	                <input type="file" multiple> element, selecting the uploaded masks; returns a Promise
+//	masks()         returns the masks as {name, group, z, selected} objects
+//	select(name)    selects the mask with the provided name in its group
+func (l *Library) Expose(name string) {
+	api := js.Global().Get("Object").New()
+
+	api.Set("load", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		if len(args) == 0 {
+			return nil
+		}
+		file := args[0].String()
+		return promise(func() error {
+			return l.Load(file)
+		})
+	}))
+	api.Set("upload", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		if len(args) == 0 {
+			return nil
+		}
+		files := make([]js.Value, args[0].Length())
+		for i := range files {
+			files[i] = args[0].Index(i)
+		}
+		return promise(func() error {
+			return l.Upload(files)
+		})
+	}))
+	api.Set("masks", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		masks := l.Masks()
+		arr := make([]interface{}, len(masks))
+		for i, m := range masks {
+			arr[i] = map[string]interface{}{
+				"name":     m.Name,
+				"group":    m.Group,
+				"z":        m.Z,
+				"selected": l.Selected(m.Group) == m,
+			}
+		}
+		return arr
+	}))
+	api.Set("select", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		if len(args) > 0 {
+			return l.Select(args[0].String())
+		}
+		return false
+	}))
+	js.Global().Set(name, api)
+}
+
+// promise runs the function in a new goroutine, since the event handlers can't block,
+// and returns a Javascript Promise settled with the outcome of the function.
+func promise(fn func() error) js.Value {
+	executor := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		resolve, reject := args[0], args[1]
+		go func() {
+			if err := fn(); err != nil {
+				reject.Invoke(js.Global().Get("Error").New(err.Error()))
+				return
+			}
+			resolve.Invoke()
+		}()
+		return nil
+	})
+	defer executor.Release()
+
+	return js.Global().Get("Promise").New(executor)
+}
@@ -0,0 +1,249 @@
+//go:build js && wasm
+
+package overlay
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"syscall/js"
+
+	"github.com/esimov/pigo-wasm-demos/asset"
+)
+
+// Mask is a mask template along with its image.
+type Mask struct {
+	*Template
+	// Source is the decoded mask image.
+	Source image.Image
+	// Element is the HTML image element drawn over the canvas.
+	Element js.Value
+	// Width and Height is the size of the mask image.
+	Width, Height int
+}
+
+// Place returns the placement of the mask over the facial features of the face having the provided size.
+func (m *Mask) Place(f Features, faceSize float64) (Placement, bool) {
+	return m.Template.Place(f, faceSize, m.Width)
+}
+
+// Draw draws the mask into the canvas context with the provided placement.
+func (m *Mask) Draw(ctx js.Value, p Placement) {
+	ctx.Call("save")
+	ctx.Call("translate", p.X, p.Y)
+	ctx.Call("rotate", p.Angle)
+	ctx.Call("drawImage", m.Element, 0, 0, float64(m.Width)*p.Scale, float64(m.Height)*p.Scale)
+	ctx.Call("restore")
+}
+
+// Library holds the loaded masks, along with the selected mask of each group.
+// The masks can be loaded from a manifest served along with the page, or uploaded at runtime,
+// while being accessed concurrently by the render loop.
+type Library struct {
+	mu       sync.Mutex
+	assets   *asset.Loader
+	masks    []*Mask
+	selected map[string]*Mask
+}
+
+// NewLibrary creates a new, empty mask library, loading the mask images through the asset loader.
+func NewLibrary(assets *asset.Loader) *Library {
+	return &Library{
+		assets:   assets,
+		selected: make(map[string]*Mask),
+	}
+}
+
+// Load loads the manifest located at the path, along with the mask images listed in it.
+// The image paths are relative to the manifest, unless they are absolute.
+func (l *Library) Load(file string) error {
+	// The manifest is not cached, so a reload picks up its changes.
+	data, err := asset.Fetch(file)
+	if err != nil {
+		return err
+	}
+	manifest, err := ParseManifest(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	masks := make([]*Mask, 0, len(manifest.Masks))
+	for _, t := range manifest.Masks {
+		src := t.Image
+		if !strings.HasPrefix(src, "/") {
+			src = path.Join(path.Dir(file), src)
+		}
+		img, err := l.assets.Image(src)
+		if err != nil {
+			return fmt.Errorf("%s: %w", t.Name, err)
+		}
+		masks = append(masks, newMask(t, img))
+	}
+	l.add(masks)
+	return nil
+}
+
+// Upload loads the masks from the Javascript File objects, as selected by a file input or dropped over the page.
+// The files must contain a single JSON manifest, along with the mask images, which are matched by their name.
+// The uploaded masks get selected in their groups.
+func (l *Library) Upload(files []js.Value) error {
+	var manifest *Manifest
+	images := make(map[string]js.Value)
+	for _, file := range files {
+		name := file.Get("name").String()
+		if strings.EqualFold(path.Ext(name), ".json") {
+			data, err := asset.ReadBlob(file)
+			if err != nil {
+				return fmt.Errorf("failed reading %s: %w", name, err)
+			}
+			if manifest, err = ParseManifest(bytes.NewReader(data)); err != nil {
+				return err
+			}
+			continue
+		}
+		images[name] = file
+	}
+	if manifest == nil {
+		return fmt.Errorf("missing mask manifest")
+	}
+
+	masks := make([]*Mask, 0, len(manifest.Masks))
+	for _, t := range manifest.Masks {
+		file, ok := images[path.Base(t.Image)]
+		if !ok {
+			return fmt.Errorf("%s: missing image %s", t.Name, t.Image)
+		}
+		data, err := asset.ReadBlob(file)
+		if err != nil {
+			return fmt.Errorf("%s: failed reading %s: %w", t.Name, t.Image, err)
+		}
+		img, err := asset.NewImage(data)
+		if err != nil {
+			return fmt.Errorf("%s: failed loading %s: %w", t.Name, t.Image, err)
+		}
+		masks = append(masks, newMask(t, img))
+	}
+	l.add(masks)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, m := range masks {
+		l.selected[m.Group] = m
+	}
+	return nil
+}
+
+// newMask creates the mask from the template and its loaded image.
+func newMask(t *Template, img *asset.Image) *Mask {
+	return &Mask{
+		Template: t,
+		Source:   img.Source,
+		Element:  img.Element,
+		Width:    img.Width,
+		Height:   img.Height,
+	}
+}
+
+// add adds the masks to the library, replacing the masks having the same name.
+// The first mask of each new group gets selected.
+func (l *Library) add(masks []*Mask) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, m := range masks {
+		replaced := false
+		for i, old := range l.masks {
+			if old.Name == m.Name {
+				l.masks[i] = m
+				if l.selected[old.Group] == old {
+					delete(l.selected, old.Group)
+				}
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			l.masks = append(l.masks, m)
+		}
+		if _, ok := l.selected[m.Group]; !ok {
+			l.selected[m.Group] = m
+		}
+	}
+	// The masks are kept in drawing order.
+	sort.SliceStable(l.masks, func(i, j int) bool {
+		return l.masks[i].Z < l.masks[j].Z
+	})
+}
+
+// Masks returns all the masks of the library in drawing order.
+func (l *Library) Masks() []*Mask {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return append([]*Mask(nil), l.masks...)
+}
+
+// Selection returns the selected mask of each group in drawing order.
+func (l *Library) Selection() []*Mask {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	masks := make([]*Mask, 0, len(l.selected))
+	for _, m := range l.masks {
+		if l.selected[m.Group] == m {
+			masks = append(masks, m)
+		}
+	}
+	return masks
+}
+
+// Selected returns the selected mask of the group, or nil if the group has no masks.
+func (l *Library) Selected(group string) *Mask {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.selected[group]
+}
+
+// Select selects the mask with the provided name in its group. It reports false if the mask is not found.
+func (l *Library) Select(name string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, m := range l.masks {
+		if m.Name == name {
+			l.selected[m.Group] = m
+			return true
+		}
+	}
+	return false
+}
+
+// Cycle selects the mask found at the provided distance from the selected one in its group,
+// wrapping around at the ends of the group. It returns the newly selected mask.
+func (l *Library) Cycle(group string, step int) *Mask {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var masks []*Mask
+	idx := 0
+	for _, m := range l.masks {
+		if m.Group != group {
+			continue
+		}
+		if l.selected[group] == m {
+			idx = len(masks)
+		}
+		masks = append(masks, m)
+	}
+	if len(masks) == 0 {
+		return nil
+	}
+	idx = ((idx+step)%len(masks) + len(masks)) % len(masks)
+	l.selected[group] = masks[idx]
+	return masks[idx]
+}
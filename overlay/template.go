@@ -0,0 +1,308 @@
+package overlay
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"io"
+	"math"
+	"sort"
+
+	"github.com/esimov/pigo-wasm-demos/mask"
+	"github.com/esimov/pigo-wasm-demos/pixels"
+	pigo "github.com/esimov/pigo/core"
+)
+
+// Anchor names a facial feature the mask templates can be attached to.
+type Anchor string
+
+// The left and the right anchors are meant as seen on the image.
+const (
+	LeftPupil  Anchor = "leftPupil"
+	RightPupil Anchor = "rightPupil"
+	LeftMouth  Anchor = "leftMouth"  // left mouth corner
+	RightMouth Anchor = "rightMouth" // right mouth corner
+	Nose       Anchor = "nose"       // nose tip
+)
+
+// anchors lists the known anchors.
+var anchors = []Anchor{LeftPupil, RightPupil, LeftMouth, RightMouth, Nose}
+
+// Reference defines the length the mask templates are scaled to.
+type Reference string
+
+const (
+	// AnchorsReference scales the mask so that its anchors are fitted over the facial features.
+	AnchorsReference Reference = "anchors"
+	// FaceReference scales the mask width relative to the size of the detected face.
+	FaceReference Reference = "face"
+)
+
+// noseRatio is the position of the nose tip between the eyes and the mouth, measured from the eyes.
+const noseRatio = 0.6
+
+// Features maps the anchors to the positions of the facial features detected on a face.
+type Features map[Anchor]mask.Point
+
+// NewFeatures creates the facial features from the detected pupils and mouth corners.
+// The mouth corners are expected in the format returned by the detector, i.e. [col, row, scale].
+// The nose tip is not detected, it's estimated from the position of the eyes and the mouth.
+// Any of the pupils can be nil, in which case the features are missing the related anchors.
+func NewFeatures(leftPupil, rightPupil *pigo.Puploc, mouth [][]int) Features {
+	f := make(Features)
+	if leftPupil != nil {
+		f[LeftPupil] = mask.Point{X: float64(leftPupil.Col), Y: float64(leftPupil.Row)}
+	}
+	if rightPupil != nil {
+		f[RightPupil] = mask.Point{X: float64(rightPupil.Col), Y: float64(rightPupil.Row)}
+	}
+
+	var corners []mask.Point
+	for _, p := range mouth {
+		if len(p) >= 2 && p[0] > 0 && p[1] > 0 {
+			corners = append(corners, mask.Point{X: float64(p[0]), Y: float64(p[1])})
+		}
+	}
+	if len(corners) != 2 {
+		return f
+	}
+	// The anchor names are relative to the image, like the pupils.
+	if corners[0].X > corners[1].X {
+		corners[0], corners[1] = corners[1], corners[0]
+	}
+	f[LeftMouth], f[RightMouth] = corners[0], corners[1]
+
+	if leftPupil != nil && rightPupil != nil {
+		eyes := midpoint(f[LeftPupil], f[RightPupil])
+		mouth := midpoint(corners[0], corners[1])
+		f[Nose] = mask.Point{
+			X: eyes.X + (mouth.X-eyes.X)*noseRatio,
+			Y: eyes.Y + (mouth.Y-eyes.Y)*noseRatio,
+		}
+	}
+	return f
+}
+
+// Template describes how a mask image is placed over the face.
+type Template struct {
+	// Name identifies the template.
+	Name string `json:"name"`
+	// Group is the set of templates replacing each other, like the eye or the mouth masks.
+	Group string `json:"group"`
+	// Image is the path of the PNG image, relative to the manifest.
+	Image string `json:"image"`
+	// Anchors are the positions of the facial features over the mask image, in image pixels.
+	Anchors map[Anchor]mask.Point `json:"anchors"`
+	// Scale defines the length the mask is scaled to.
+	Scale Scale `json:"scale"`
+	// Z is the drawing order of the mask, the masks with higher order being drawn over the others.
+	Z int `json:"z"`
+}
+
+// Scale defines the length the mask template is scaled to.
+type Scale struct {
+	// Reference is either "anchors" (default) or "face".
+	Reference Reference `json:"reference"`
+	// Factor multiplies the scale fitted over the anchors, or it's the mask width
+	// relative to the face size if the mask is scaled to the face.
+	Factor float64 `json:"factor"`
+}
+
+// Placement is the transform placing the mask image over the face: the image is scaled,
+// then rotated around its top left corner, which is moved to the provided position.
+type Placement struct {
+	X, Y  float64
+	Scale float64
+	Angle float64
+}
+
+// Manifest lists the mask templates.
+type Manifest struct {
+	Masks []*Template `json:"masks"`
+}
+
+// ParseManifest decodes the JSON manifest of the mask templates and validates it.
+func ParseManifest(r io.Reader) (*Manifest, error) {
+	var m Manifest
+	if err := json.NewDecoder(r).Decode(&m); err != nil {
+		return nil, fmt.Errorf("invalid mask manifest: %w", err)
+	}
+	for i, t := range m.Masks {
+		if err := t.validate(); err != nil {
+			return nil, fmt.Errorf("invalid mask template #%d: %w", i, err)
+		}
+	}
+	// The templates are kept in drawing order.
+	sort.SliceStable(m.Masks, func(i, j int) bool {
+		return m.Masks[i].Z < m.Masks[j].Z
+	})
+	return &m, nil
+}
+
+// validate checks the template fields, filling out the missing ones with their defaults.
+func (t *Template) validate() error {
+	if t == nil {
+		return fmt.Errorf("empty template")
+	}
+	if t.Name == "" {
+		return fmt.Errorf("missing name")
+	}
+	if t.Image == "" {
+		return fmt.Errorf("%s: missing image", t.Name)
+	}
+	if t.Group == "" {
+		t.Group = t.Name
+	}
+	for a := range t.Anchors {
+		if !knownAnchor(a) {
+			return fmt.Errorf("%s: unknown anchor %q", t.Name, a)
+		}
+	}
+	switch t.Scale.Reference {
+	case "":
+		t.Scale.Reference = AnchorsReference
+		fallthrough
+	case AnchorsReference:
+		if len(t.Anchors) < 2 {
+			return fmt.Errorf("%s: at least two anchors are needed for scaling over the anchors", t.Name)
+		}
+	case FaceReference:
+		if len(t.Anchors) < 1 {
+			return fmt.Errorf("%s: missing anchors", t.Name)
+		}
+	default:
+		return fmt.Errorf("%s: unknown scale reference %q", t.Name, t.Scale.Reference)
+	}
+	if t.Scale.Factor < 0 {
+		return fmt.Errorf("%s: negative scale factor", t.Name)
+	}
+	if t.Scale.Factor == 0 {
+		t.Scale.Factor = 1
+	}
+	return nil
+}
+
+// Place fits the anchors of the mask image having the provided width over the facial features, returning
+// the placement of the mask. The rotation and the position are the least squares fit of the anchors found
+// among the features, while the scale follows the scale reference. A single anchor takes the rotation of
+// the pupils. It reports false if the anchors can't be fitted, e.g. none of them is found among the features.
+func (t *Template) Place(f Features, faceSize float64, width int) (Placement, bool) {
+	var src, dst []mask.Point
+	for _, a := range anchors {
+		p, ok := t.Anchors[a]
+		q, found := f[a]
+		if ok && found {
+			src = append(src, p)
+			dst = append(dst, q)
+		}
+	}
+	if len(src) == 0 {
+		return Placement{}, false
+	}
+
+	cs, cd := centroid(src), centroid(dst)
+	var dot, cross, norm float64
+	for i := range src {
+		u := mask.Point{X: src[i].X - cs.X, Y: src[i].Y - cs.Y}
+		v := mask.Point{X: dst[i].X - cd.X, Y: dst[i].Y - cd.Y}
+		dot += u.X*v.X + u.Y*v.Y
+		cross += u.X*v.Y - u.Y*v.X
+		norm += u.X*u.X + u.Y*u.Y
+	}
+
+	var angle float64
+	if norm > 0 {
+		angle = math.Atan2(cross, dot)
+	} else {
+		lp, ok1 := f[LeftPupil]
+		rp, ok2 := f[RightPupil]
+		if ok1 && ok2 {
+			angle = math.Atan2(rp.Y-lp.Y, rp.X-lp.X)
+		}
+	}
+
+	var scale float64
+	switch t.Scale.Reference {
+	case FaceReference:
+		if width <= 0 {
+			return Placement{}, false
+		}
+		scale = t.Scale.Factor * faceSize / float64(width)
+	default:
+		if norm == 0 {
+			return Placement{}, false
+		}
+		scale = t.Scale.Factor * math.Hypot(dot, cross) / norm
+	}
+
+	// The centroid of the anchors is moved over the centroid of the features.
+	sin, cos := math.Sincos(angle)
+	return Placement{
+		X:     cd.X - (cs.X*cos-cs.Y*sin)*scale,
+		Y:     cd.Y - (cs.X*sin+cs.Y*cos)*scale,
+		Scale: scale,
+		Angle: angle,
+	}, true
+}
+
+// Render draws the mask image with the placement in Go, the same way it's drawn over the canvas.
+// The bounds of the returned image are expressed in the coordinate system of the placement,
+// so the pixel found at a face position can be read directly.
+func Render(src image.Image, p Placement) *image.NRGBA {
+	b := src.Bounds()
+	w := int(math.Round(float64(b.Dx()) * p.Scale))
+	h := int(math.Round(float64(b.Dy()) * p.Scale))
+	if w <= 0 || h <= 0 {
+		return image.NewNRGBA(image.Rectangle{})
+	}
+
+	// The mask is scaled first by sampling the nearest pixels, then it's rotated around its top left corner.
+	scaled := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		sy := b.Min.Y + int((float64(y)+0.5)/p.Scale)
+		if sy >= b.Max.Y {
+			sy = b.Max.Y - 1
+		}
+		for x := 0; x < w; x++ {
+			sx := b.Min.X + int((float64(x)+0.5)/p.Scale)
+			if sx >= b.Max.X {
+				sx = b.Max.X - 1
+			}
+			scaled.Set(x, y, src.At(sx, sy))
+		}
+	}
+	// The canvas rotates clockwise, while the image rotation is counterclockwise.
+	dst := pixels.Rotate(nil, scaled, -p.Angle*180/math.Pi, pixels.RotateOptions{
+		Interpolation: pixels.Bilinear,
+		Pivot:         &image.Point{},
+		Expand:        true,
+	})
+	dst.Rect = dst.Rect.Add(image.Pt(int(math.Round(p.X)), int(math.Round(p.Y))))
+	return dst
+}
+
+// knownAnchor reports whether the anchor is one of the known facial features.
+func knownAnchor(a Anchor) bool {
+	for _, k := range anchors {
+		if a == k {
+			return true
+		}
+	}
+	return false
+}
+
+// centroid returns the mean of the points.
+func centroid(points []mask.Point) mask.Point {
+	var c mask.Point
+	for _, p := range points {
+		c.X += p.X
+		c.Y += p.Y
+	}
+	n := float64(len(points))
+	return mask.Point{X: c.X / n, Y: c.Y / n}
+}
+
+// midpoint returns the middle point between the two points.
+func midpoint(p1, p2 mask.Point) mask.Point {
+	return mask.Point{X: (p1.X + p2.X) / 2, Y: (p1.Y + p2.Y) / 2}
+}
@@ -8,7 +8,12 @@ import (
 	"syscall/js"
 
 	"github.com/esimov/pigo-wasm-demos/detector"
+	"github.com/esimov/pigo-wasm-demos/mask"
+	"github.com/esimov/pigo-wasm-demos/noise"
 	"github.com/esimov/pigo-wasm-demos/pixels"
+	"github.com/esimov/pigo-wasm-demos/privacy"
+	"github.com/esimov/pigo-wasm-demos/selection"
+	"github.com/esimov/pigo-wasm-demos/tracker"
 )
 
 // Canvas struct holds the Javascript objects needed for the Canvas creation
@@ -40,13 +45,30 @@ type Canvas struct {
 	// Canvas interaction related variables
 	showPupil bool
 	showFrame bool
+	maskKind  mask.Kind
 
 	// Quantizer related variables
 	numOfColors int
 	cellSize    int
 	noiseLevel  int
+	noise       *noise.Generator
+	quantIdx    int
+	dither      Dither
+	retro       bool
+	shape       Shape
+	adaptive    bool
+
+	// Privacy mode related variables
+	privacy  bool
+	redactor *privacy.Redactor
+	failSafe bool
+	policy   *privacy.Engine
+
+	// selection holds the faces exempted from, or targeted by the effect.
+	selection *selection.Selection
 
 	frame *image.NRGBA
+	pool  *pixels.FramePool
 }
 
 const (
@@ -59,10 +81,20 @@ const (
 	noiseLevel    = 0
 )
 
-var (
-	pigo  *detector.Detector
-	quant *Quant
-)
+var pigo *detector.Detector
+
+// quantizers holds the available color quantization methods, selectable from the keyboard.
+var quantizers = []struct {
+	name  string
+	quant Quantizer
+}{
+	{"median cut", NewQuantizer()},
+	{"octree", NewOctree()},
+	{"k-means", NewKMeans(4)},
+	{"Game Boy palette", NewPalette(GameBoy)},
+	{"CGA palette", NewPalette(CGA)},
+	{"PICO-8 palette", NewPalette(PICO8)},
+}
 
 // NewCanvas creates and initializes the new Canvas element
 func NewCanvas() *Canvas {
@@ -95,12 +127,18 @@ func NewCanvas() *Canvas {
 
 	c.showPupil = false
 	c.showFrame = false
+	c.maskKind = mask.Ellipse
 
 	c.numOfColors = 8
 	c.cellSize = 10
+	c.pool = pixels.NewFramePool()
+	c.noise = noise.NewGenerator(1, noise.Mono)
+	c.redactor = privacy.NewRedactor(privacy.DefaultConfig())
+	c.policy = privacy.NewEngine(privacy.DefaultPolicy())
+	c.selection = selection.New()
+	c.selection.Expose("faceSelection")
 
 	pigo = detector.NewDetector()
-	quant = NewQuantizer()
 
 	return &c
 }
@@ -109,6 +147,7 @@ func NewCanvas() *Canvas {
 func (c *Canvas) Render() error {
 	width, height := c.windowSize.width, c.windowSize.height
 	var data = make([]byte, width*height*4)
+	var gray = make([]byte, width*height)
 	c.done = make(chan struct{})
 
 	err := pigo.UnpackCascades()
@@ -128,15 +167,38 @@ func (c *Canvas) Render() error {
 			// be able to transfer it from Javascript to Go via the js.CopyBytesToGo function.
 			uint8Arr := js.Global().Get("Uint8Array").New(rgba)
 			js.CopyBytesToGo(data, uint8Arr)
-			gray := pixels.RgbaToGrayscale(data, width, height)
-
-			// Reset the data slice to its default values to avoid unnecessary memory allocation.
-			// Otherwise, the GC won't clean up the memory address allocated by this slice
-			// and the memory will keep up increasing by each iteration.
-			data = make([]byte, len(data))
+			gray = pixels.Grayscale(gray, data, pixels.BT709)
 
 			res := pigo.DetectFaces(gray, height, width)
-			c.drawDetection(data, res)
+			c.noise.NextFrame()
+			tracks := c.redactor.Track(res)
+			c.selection.Update(tracks)
+			var decision privacy.Decision
+			if c.failSafe {
+				decision = c.policy.Evaluate(res, tracks)
+			}
+
+			switch {
+			case decision.Action == privacy.RedactFrame:
+				c.redactor.RedactFrame(data, width)
+				privacy.PutFrame(c.ctx, data, width, height)
+			case c.privacy:
+				c.redactor.RedactTracks(data, width, c.selection.Filter(tracks))
+				c.redactor.RedactRegions(data, width, decision.Regions)
+				privacy.PutFrame(c.ctx, data, width, height)
+				if c.showFrame {
+					privacy.DrawTracks(c.ctx, tracks)
+				}
+				c.selection.Draw(c.ctx, tracks)
+			default:
+				// Redact the faces which could not be confirmed, then apply the effect over the detected ones.
+				if decision.Action == privacy.RedactRegions {
+					c.redactor.RedactRegions(data, width, decision.Regions)
+					privacy.PutFrame(c.ctx, data, width, height)
+				}
+				c.drawDetection(data, c.selection.Dets(tracks))
+				c.selection.Draw(c.ctx, tracks)
+			}
 
 			c.window.Get("stats").Call("end")
 		}()
@@ -147,6 +209,9 @@ func (c *Canvas) Render() error {
 
 	c.window.Call("requestAnimationFrame", c.renderer)
 	c.detectKeyPress()
+	c.selection.ListenClicks(c.canvas, func(tr *tracker.Track) {
+		c.Log(fmt.Sprintf("Face #%d marked: %t, selection mode: %s", tr.ID, c.selection.IsMarked(tr), c.selection.Mode()))
+	})
 	<-c.done
 
 	return nil
@@ -216,19 +281,33 @@ func (c *Canvas) StartWebcam() (*Canvas, error) {
 	}
 }
 
-// pixelate pixelates the detected face region
-func (c *Canvas) pixelate(data []uint8, rect image.Rectangle, noiseLevel int) []uint8 {
-	// Converts the array buffer to an image
-	img := pixels.PixToImage(data, rect)
+// pixelate pixelates the detected face region.
+// The result is written back into the source buffer.
+// The cells are smaller around the landmark points, if there are any.
+func (c *Canvas) pixelate(data []uint8, rect image.Rectangle, noiseLevel int, landmarks []image.Point) []uint8 {
+	// Wrap the array buffer into an image without copying it.
+	img := pixels.NewNRGBAView(data, rect)
 
 	// Quantize the substracted image in order to reduce the number of colors.
 	// This will create a new pixelated subtype image.
-	cell := quant.Draw(img, c.numOfColors, c.cellSize, noiseLevel)
+	cell := Draw(quantizers[c.quantIdx].quant, img, Options{
+		NumOfColors: c.numOfColors,
+		CellSize:    c.cellSize,
+		NoiseLevel:  noiseLevel,
+		Noise:       c.noise,
+		Dither:      c.dither,
+		Retro:       c.retro,
+		Shape:       c.shape,
+		Landmarks:   landmarks,
+	})
 
-	dst := image.NewNRGBA(cell.Bounds())
-	draw.Draw(dst, cell.Bounds(), cell, image.Point{}, draw.Over)
+	// Reuse the destination image between the frames if the face region size has not changed.
+	if c.frame == nil || c.frame.Rect != cell.Bounds() {
+		c.frame = image.NewNRGBA(cell.Bounds())
+	}
+	draw.Draw(c.frame, cell.Bounds(), cell, image.Point{}, draw.Src)
 
-	return pixels.ImgToPix(dst)
+	return pixels.ImgToPixInto(data, c.frame)
 }
 
 // drawDetection draws the detected faces and eyes.
@@ -248,12 +327,24 @@ func (c *Canvas) drawDetection(data []uint8, dets [][]int) {
 			row, col, scale := det[1], det[0], int(float64(det[2])*1.1)
 
 			// Substract the image under the detected face region.
-			imgData := make([]byte, scale*scale*4)
+			imgData := c.pool.Get(scale * scale * 4)
 			subimg := c.ctx.Call("getImageData", row-scale/2, col-scale/2, scale, scale).Get("data")
 			uint8Arr := js.Global().Get("Uint8Array").New(subimg)
 			js.CopyBytesToGo(imgData, uint8Arr)
 
-			{ // Draw the ellipse mask.
+			var flps [][]int
+			if leftPupil != nil && rightPupil != nil && (c.maskKind == mask.Contour || c.adaptive) {
+				flps = pigo.DetectLandmarkPoints(leftPupil, rightPupil)
+			}
+
+			// The face contour requires both of the pupils, otherwise fall back to the ellipse mask.
+			useContour := c.maskKind == mask.Contour && leftPupil != nil && rightPupil != nil
+			if useContour {
+				face := mask.NewFace(leftPupil, rightPupil, flps)
+				c.ctxMask.Call("setTransform", 1, 0, 0, 1, 0, 0)
+				c.ctxMask.Call("clearRect", 0, 0, c.windowSize.width, c.windowSize.height)
+				c.ctxMask.Call("putImageData", mask.ToImageData(face, row-scale/2, col-scale/2, scale), 0, 0)
+			} else { // Draw the ellipse mask.
 				scx, scy := int(float64(scale)*0.8/1.5), int(float64(scale)*0.8/2.1)
 				rx, ry := scx/2, scy/2
 
@@ -281,11 +372,26 @@ func (c *Canvas) drawDetection(data []uint8, dets [][]int) {
 			}
 
 			{ // Draw the pixelated image into the ellipse gradient using composite operation.
+				// Translate the landmark points into the face region coordinates.
+				var landmarks []image.Point
+				if c.adaptive && leftPupil != nil && rightPupil != nil {
+					origin := image.Pt(row-scale/2, col-scale/2)
+					landmarks = append(landmarks,
+						image.Pt(leftPupil.Col, leftPupil.Row).Sub(origin),
+						image.Pt(rightPupil.Col, rightPupil.Row).Sub(origin),
+					)
+					for _, flp := range flps {
+						if len(flp) > 0 {
+							landmarks = append(landmarks, image.Pt(flp[0], flp[1]).Sub(origin))
+						}
+					}
+				}
 				rect := image.Rect(0, 0, scale, scale)
-				buffer := c.pixelate(imgData, rect, c.noiseLevel)
+				buffer := c.pixelate(imgData, rect, c.noiseLevel, landmarks)
 
 				uint8Arr = js.Global().Get("Uint8Array").New(scale * scale * 4)
 				js.CopyBytesToJS(uint8Arr, buffer)
+				c.pool.Put(buffer)
 
 				uint8Clamped := js.Global().Get("Uint8ClampedArray").New(uint8Arr)
 				rawData := js.Global().Get("ImageData").New(uint8Clamped, scale)
@@ -295,13 +401,16 @@ func (c *Canvas) drawDetection(data []uint8, dets [][]int) {
 				// Replace the underlying face region with the blurred image.
 				c.ctxOffscr.Call("putImageData", rawData, 0, 0)
 
-				// Calculate the lean angle between the pupils.
-				angle := 1 - (math.Atan2(float64(rightPupil.Col-leftPupil.Col), float64(rightPupil.Row-leftPupil.Row)) * 180 / math.Pi / 90)
-
 				c.ctxOffscr.Call("save")
-				c.ctxOffscr.Call("translate", scale/2, scale/2)
-				c.ctxOffscr.Call("rotate", js.ValueOf(angle).Float())
-				c.ctxOffscr.Call("translate", -scale/2, -scale/2)
+				// The face contour is already fitted over the facial landmarks, so it needs no rotation.
+				if !useContour && leftPupil != nil && rightPupil != nil {
+					// Calculate the lean angle between the pupils.
+					angle := 1 - (math.Atan2(float64(rightPupil.Col-leftPupil.Col), float64(rightPupil.Row-leftPupil.Row)) * 180 / math.Pi / 90)
+
+					c.ctxOffscr.Call("translate", scale/2, scale/2)
+					c.ctxOffscr.Call("rotate", js.ValueOf(angle).Float())
+					c.ctxOffscr.Call("translate", -scale/2, -scale/2)
+				}
 
 				// Apply the ellipse mask over the source image by using composite operation.
 				c.ctxOffscr.Set("globalCompositeOperation", "destination-atop")
@@ -345,6 +454,12 @@ func (c *Canvas) detectKeyPress() {
 			c.showPupil = !c.showPupil
 		case keyCode.String() == "f":
 			c.showFrame = !c.showFrame
+		case keyCode.String() == "m":
+			if c.maskKind == mask.Ellipse {
+				c.maskKind = mask.Contour
+			} else {
+				c.maskKind = mask.Ellipse
+			}
 		case keyCode.String() == "'":
 			if c.noiseLevel <= maxNoiseLevel {
 				c.noiseLevel += 2
@@ -361,6 +476,42 @@ func (c *Canvas) detectKeyPress() {
 			if c.numOfColors > minColors {
 				c.numOfColors--
 			}
+		case keyCode.String() == "q":
+			c.quantIdx = (c.quantIdx + 1) % len(quantizers)
+			c.Log("Color quantizer: " + quantizers[c.quantIdx].name)
+		case keyCode.String() == "d":
+			c.dither = (c.dither + 1) % (Atkinson + 1)
+			c.Log("Dithering: " + c.dither.String())
+		case keyCode.String() == "r":
+			c.retro = !c.retro
+		case keyCode.String() == "n":
+			c.noise.Mode = (c.noise.Mode + 1) % (noise.FilmGrain + 1)
+			c.Log("Noise mode: " + c.noise.Mode.String())
+		case keyCode.String() == "t":
+			c.noise.Temporal = !c.noise.Temporal
+		case keyCode.String() == "c":
+			c.shape = (c.shape + 1) % (Voronoi + 1)
+			c.Log("Cell shape: " + c.shape.String())
+		case keyCode.String() == "a":
+			c.adaptive = !c.adaptive
+		case keyCode.String() == "p":
+			c.privacy = !c.privacy
+		case keyCode.String() == "o":
+			if c.redactor.Fill == privacy.Blocks {
+				c.redactor.Fill = privacy.Solid
+			} else {
+				c.redactor.Fill = privacy.Blocks
+			}
+		case keyCode.String() == "e":
+			c.failSafe = !c.failSafe
+			c.policy.Reset()
+		case keyCode.String() == "i":
+			c.Log(c.redactor.Summary())
+		case keyCode.String() == "x":
+			c.selection.SetMode((c.selection.Mode() + 1) % selection.Modes)
+			c.Log("Selection mode: " + c.selection.Mode().String())
+		case keyCode.String() == "u":
+			c.selection.Clear()
 		case keyCode.String() == "]":
 			if c.cellSize <= maxCellSize {
 				c.cellSize++
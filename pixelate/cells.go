@@ -0,0 +1,280 @@
+package pixelate
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+)
+
+// Shape defines the shape of the pixelated cells.
+type Shape int
+
+const (
+	// Square splits the image into square cells.
+	Square Shape = iota
+	// Hexagon splits the image into pointy top hexagonal cells.
+	Hexagon
+	// Triangle splits the image into alternating equilateral triangles.
+	Triangle
+	// Halftone draws a dot in each square cell, sized by the darkness of the cell color.
+	Halftone
+	// Voronoi splits the image into the Voronoi regions of a jittered grid of points.
+	Voronoi
+)
+
+const (
+	// focusRadius is the radius of the area around a landmark point, relative to the image size,
+	// where the cells are halved when the adaptive cell size is used.
+	focusRadius = 0.12
+	// minAdaptiveCellSize is the smallest cell size which can be obtained by halving the cells.
+	minAdaptiveCellSize = 3
+)
+
+// String returns the name of the cell shape.
+func (s Shape) String() string {
+	switch s {
+	case Hexagon:
+		return "hexagon"
+	case Triangle:
+		return "triangle"
+	case Halftone:
+		return "halftone"
+	case Voronoi:
+		return "Voronoi"
+	default:
+		return "square"
+	}
+}
+
+// cellGrid assigns the pixels to the cells of a regular tiling of the plane.
+type cellGrid struct {
+	shape Shape
+	size  int
+	cols  int // number of columns, including the border ones
+	rows  int // number of rows, including the border ones
+}
+
+// newCellGrid creates a new grid of cells covering the w x h area.
+func newCellGrid(shape Shape, size, w, h int) cellGrid {
+	g := cellGrid{shape: shape, size: size}
+	switch shape {
+	case Hexagon:
+		radius := float64(size) / math.Sqrt(3)
+		g.cols = w/size + 3
+		g.rows = int(float64(h)/(1.5*radius)) + 3
+	case Triangle:
+		g.cols = 2*w/size + 3
+		g.rows = int(float64(h)/(float64(size)*math.Sqrt(3)/2)) + 2
+	default:
+		g.cols = w/size + 3
+		g.rows = h/size + 3
+	}
+	return g
+}
+
+// len returns the number of cells of the grid.
+func (g cellGrid) len() int {
+	return g.cols * g.rows
+}
+
+// index returns the index of the cell containing the (x, y) pixel.
+func (g cellGrid) index(x, y int) int {
+	fx, fy := float64(x)+0.5, float64(y)+0.5
+	s := float64(g.size)
+
+	switch g.shape {
+	case Hexagon:
+		// Convert the pixel position to axial hexagon coordinates, then round it to the closest hexagon.
+		radius := s / math.Sqrt(3)
+		q := (math.Sqrt(3)/3*fx - fy/3) / radius
+		r := (2.0 / 3 * fy) / radius
+		cq, cr := hexRound(q, r)
+		// Convert the axial coordinates to offset coordinates.
+		col := cq + (cr-(cr&1))/2
+		return g.cellIndex(col+1, cr+1)
+	case Triangle:
+		height := s * math.Sqrt(3) / 2
+		row := int(fy / height)
+		ty := fy/height - float64(row)
+		// Each row is split into half width strips, each of them crossed by a diagonal
+		// which separates the two triangles sharing the strip.
+		hx := fx / (s / 2)
+		k := int(hx)
+		tx := hx - float64(k)
+		if (k+row)%2 == 0 {
+			if tx > ty {
+				k++
+			}
+		} else if tx > 1-ty {
+			k++
+		}
+		return g.cellIndex(k, row)
+	case Voronoi:
+		// The closest site is always located in the neighboring cells of the jittered grid.
+		cx, cy := int(fx/s), int(fy/s)
+		best, minDist := 0, math.MaxFloat64
+		for j := cy - 1; j <= cy+1; j++ {
+			for i := cx - 1; i <= cx+1; i++ {
+				sx, sy := voronoiSite(i, j)
+				dx, dy := fx-(float64(i)+sx)*s, fy-(float64(j)+sy)*s
+				if d := dx*dx + dy*dy; d < minDist {
+					best, minDist = g.cellIndex(i+1, j+1), d
+				}
+			}
+		}
+		return best
+	default:
+		return g.cellIndex(x/g.size+1, y/g.size+1)
+	}
+}
+
+// cellIndex returns the index of the cell located in the provided column and row.
+func (g cellGrid) cellIndex(col, row int) int {
+	return clampInt(row, 0, g.rows-1)*g.cols + clampInt(col, 0, g.cols-1)
+}
+
+// hexRound rounds the fractional axial coordinates to the closest hexagon.
+func hexRound(q, r float64) (int, int) {
+	x, z := q, r
+	y := -x - z
+	rx, ry, rz := math.Round(x), math.Round(y), math.Round(z)
+	dx, dy, dz := math.Abs(rx-x), math.Abs(ry-y), math.Abs(rz-z)
+	if dx > dy && dx > dz {
+		rx = -ry - rz
+	} else if dy <= dz {
+		rz = -rx - ry
+	}
+	return int(rx), int(rz)
+}
+
+// voronoiSite returns the position of the Voronoi site inside the (i, j) grid cell.
+// The position is derived from a hash of the cell coordinates, so it's stable between frames.
+func voronoiSite(i, j int) (float64, float64) {
+	h := uint32(i)*0x8da6b343 ^ uint32(j)*0xd8163841
+	h ^= h >> 13
+	h *= 0x5bd1e995
+	h ^= h >> 15
+	return 0.15 + 0.7*float64(h&0xffff)/0xffff, 0.15 + 0.7*float64(h>>16)/0xffff
+}
+
+// cellStats accumulates the color and the position of the pixels belonging to a cell.
+type cellStats struct {
+	r, g, b, x, y, n int
+}
+
+// drawShapedCells fills in the cells of the provided shape with the average color of the quantized image.
+// If landmark points are provided, the cells around them are halved in order to preserve more details.
+func drawShapedCells(dst *image.NRGBA64, qimg *image.Paletted, cellSize int, shape Shape, landmarks []image.Point) {
+	b := qimg.Bounds()
+	w, h := b.Dx(), b.Dy()
+
+	coarse := newCellGrid(shape, cellSize, w, h)
+	fine := newCellGrid(shape, cellSize, w, h)
+	adaptive := len(landmarks) > 0 && cellSize/2 >= minAdaptiveCellSize
+	if adaptive {
+		fine = newCellGrid(shape, cellSize/2, w, h)
+	}
+	radius := focusRadius * float64(max(w, h))
+
+	// The indices of the fine grid cells are following the coarse grid ones.
+	labels := make([]int32, w*h)
+	stats := make([]cellStats, coarse.len()+fine.len())
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			idx := coarse.index(x, y)
+			if adaptive && inFocus(x, y, landmarks, radius) {
+				idx = coarse.len() + fine.index(x, y)
+			}
+			labels[y*w+x] = int32(idx)
+
+			r, g, bl, _ := qimg.Palette[qimg.Pix[y*qimg.Stride+x]].RGBA()
+			s := &stats[idx]
+			s.r += int(r >> 8)
+			s.g += int(g >> 8)
+			s.b += int(bl >> 8)
+			s.x += x
+			s.y += y
+			s.n++
+		}
+	}
+
+	colors := make([]color.NRGBA, len(stats))
+	for i, s := range stats {
+		if s.n > 0 {
+			colors[i] = color.NRGBA{R: uint8(s.r / s.n), G: uint8(s.g / s.n), B: uint8(s.b / s.n), A: 0xff}
+		}
+	}
+
+	if shape == Halftone {
+		drawHalftone(dst, qimg, labels, stats, colors, coarse.size, fine.size, coarse.len())
+		return
+	}
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			dst.Set(b.Min.X+x, b.Min.Y+y, colors[labels[y*w+x]])
+		}
+	}
+}
+
+// drawHalftone draws a dot into each cell, centered on the cell centroid. The dot radius grows
+// with the darkness of the cell color, the remaining area is filled with the lightest palette color.
+func drawHalftone(dst *image.NRGBA64, qimg *image.Paletted, labels []int32, stats []cellStats, colors []color.NRGBA, coarseSize, fineSize, fineOffset int) {
+	var bg color.Color = color.White
+	lightest := -1
+	for _, c := range qimg.Palette {
+		r, g, b, _ := c.RGBA()
+		if l := int(r + g + b); l > lightest {
+			bg, lightest = c, l
+		}
+	}
+	draw.Draw(dst, dst.Bounds(), &image.Uniform{C: bg}, image.Point{}, draw.Src)
+
+	b := qimg.Bounds()
+	w := b.Dx()
+	radii := make([]float64, len(stats))
+	for i, s := range stats {
+		if s.n == 0 {
+			continue
+		}
+		size := coarseSize
+		if i >= fineOffset {
+			size = fineSize
+		}
+		c := colors[i]
+		luma := (0.2126*float64(c.R) + 0.7152*float64(c.G) + 0.0722*float64(c.B)) / 255
+		// The dot area is proportional to the darkness, and the largest dot slightly overlaps the cell.
+		radii[i] = float64(size) * 0.6 * math.Sqrt(1-luma)
+	}
+	for i, l := range labels {
+		s := stats[l]
+		x, y := i%w, i/w
+		dx := float64(x) - float64(s.x)/float64(s.n)
+		dy := float64(y) - float64(s.y)/float64(s.n)
+		if dx*dx+dy*dy <= radii[l]*radii[l] {
+			dst.Set(b.Min.X+x, b.Min.Y+y, colors[l])
+		}
+	}
+}
+
+// inFocus reports whether the pixel is located close to any of the landmark points.
+func inFocus(x, y int, landmarks []image.Point, radius float64) bool {
+	for _, p := range landmarks {
+		dx, dy := float64(x-p.X), float64(y-p.Y)
+		if dx*dx+dy*dy <= radius*radius {
+			return true
+		}
+	}
+	return false
+}
+
+// clampInt restricts the integer value between the min and max limits.
+func clampInt(v, min, max int) int {
+	if v < min {
+		return min
+	}
+	if v > max {
+		return max
+	}
+	return v
+}
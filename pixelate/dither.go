@@ -0,0 +1,161 @@
+package pixelate
+
+import (
+	"image"
+	"math"
+	"sync"
+)
+
+// Dither defines the dithering method used when the pixels are mapped to the palette colors.
+type Dither int
+
+const (
+	// NoDither maps each pixel to the closest palette color.
+	NoDither Dither = iota
+	// Bayer applies the ordered dithering using a 4x4 Bayer threshold matrix.
+	Bayer
+	// FloydSteinberg diffuses the quantization error over the neighboring pixels.
+	FloydSteinberg
+	// Atkinson diffuses only three quarters of the quantization error, giving a higher contrast.
+	Atkinson
+)
+
+// bayer4 is the 4x4 Bayer threshold matrix.
+var bayer4 = [4][4]float32{
+	{0, 8, 2, 10},
+	{12, 4, 14, 6},
+	{3, 11, 1, 9},
+	{15, 7, 13, 5},
+}
+
+// diffusion defines the fraction of the quantization error propagated to a neighboring pixel.
+type diffusion struct {
+	dx, dy int
+	weight float32
+}
+
+var (
+	floydSteinberg = []diffusion{
+		{1, 0, 7.0 / 16}, {-1, 1, 3.0 / 16}, {0, 1, 5.0 / 16}, {1, 1, 1.0 / 16},
+	}
+	atkinson = []diffusion{
+		{1, 0, 1.0 / 8}, {2, 0, 1.0 / 8}, {-1, 1, 1.0 / 8}, {0, 1, 1.0 / 8}, {1, 1, 1.0 / 8}, {0, 2, 1.0 / 8},
+	}
+)
+
+// errPool holds the reusable error buffers of the error diffusion.
+var errPool sync.Pool
+
+// String returns the name of the dithering method.
+func (d Dither) String() string {
+	switch d {
+	case Bayer:
+		return "Bayer"
+	case FloydSteinberg:
+		return "Floyd-Steinberg"
+	case Atkinson:
+		return "Atkinson"
+	default:
+		return "none"
+	}
+}
+
+// ditherImage maps the source pixels to the palette colors of the destination image
+// using the provided dithering method. Both images should have the same size.
+func ditherImage(dst *image.Paletted, src *image.NRGBA, d Dither) {
+	pal := make([][3]int32, len(dst.Palette))
+	for i, c := range dst.Palette {
+		r, g, b, _ := c.RGBA()
+		pal[i] = [3]int32{int32(r >> 8), int32(g >> 8), int32(b >> 8)}
+	}
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+
+	switch d {
+	case Bayer:
+		// The threshold spread is adjusted to the average distance between the palette colors.
+		spread := 255 / float32(math.Cbrt(float64(len(pal))))
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				s := src.Pix[y*src.Stride+x*4:]
+				t := (bayer4[y%4][x%4]+0.5)/16 - 0.5
+				r := clampChannel(float32(s[0]) + t*spread)
+				g := clampChannel(float32(s[1]) + t*spread)
+				b := clampChannel(float32(s[2]) + t*spread)
+				dst.Pix[y*dst.Stride+x] = uint8(nearest(pal, r, g, b))
+			}
+		}
+	case FloydSteinberg, Atkinson:
+		kernel := floydSteinberg
+		if d == Atkinson {
+			kernel = atkinson
+		}
+		diffuseError(dst, src, pal, kernel)
+	default:
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				s := src.Pix[y*src.Stride+x*4:]
+				dst.Pix[y*dst.Stride+x] = uint8(nearest(pal, int32(s[0]), int32(s[1]), int32(s[2])))
+			}
+		}
+	}
+}
+
+// diffuseError maps the source pixels to the closest palette colors in raster order,
+// distributing the quantization error of each pixel over its unprocessed neighbors.
+func diffuseError(dst *image.Paletted, src *image.NRGBA, pal [][3]int32, kernel []diffusion) {
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+
+	// The error buffer holds three rows, which covers the reach of both kernels.
+	const rows = 3
+	size := rows * w * 3
+	var errs []float32
+	if buf, ok := errPool.Get().(*[]float32); ok && cap(*buf) >= size {
+		errs = (*buf)[:size]
+	} else {
+		errs = make([]float32, size)
+	}
+	for i := range errs {
+		errs[i] = 0
+	}
+	defer errPool.Put(&errs)
+
+	for y := 0; y < h; y++ {
+		row := errs[(y%rows)*w*3:]
+		for x := 0; x < w; x++ {
+			s := src.Pix[y*src.Stride+x*4:]
+			e := row[x*3 : x*3+3]
+			r := clampChannel(float32(s[0]) + e[0])
+			g := clampChannel(float32(s[1]) + e[1])
+			b := clampChannel(float32(s[2]) + e[2])
+			e[0], e[1], e[2] = 0, 0, 0
+
+			idx := nearest(pal, r, g, b)
+			dst.Pix[y*dst.Stride+x] = uint8(idx)
+
+			er := float32(r - pal[idx][0])
+			eg := float32(g - pal[idx][1])
+			eb := float32(b - pal[idx][2])
+			for _, k := range kernel {
+				nx, ny := x+k.dx, y+k.dy
+				if nx < 0 || nx >= w || ny >= h {
+					continue
+				}
+				ne := errs[(ny%rows)*w*3+nx*3:]
+				ne[0] += er * k.weight
+				ne[1] += eg * k.weight
+				ne[2] += eb * k.weight
+			}
+		}
+	}
+}
+
+// clampChannel rounds the color channel value and restricts it to the [0, 255] range.
+func clampChannel(v float32) int32 {
+	if v <= 0 {
+		return 0
+	}
+	if v >= 255 {
+		return 255
+	}
+	return int32(v + 0.5)
+}
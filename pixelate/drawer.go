@@ -3,10 +3,30 @@ package pixelate
 import (
 	"image"
 	"image/color"
+	"image/draw"
+
+	"github.com/esimov/pigo-wasm-demos/noise"
 )
 
+// Options holds the parameters of the pixelation.
+type Options struct {
+	NumOfColors int
+	CellSize    int
+	// NoiseLevel is the amount of noise added by the Noise generator, expressed in 8-bit color levels.
+	NoiseLevel int
+	Noise      *noise.Generator
+	Dither     Dither
+	// Retro maps the pixels to the quantized colors at full resolution, without splitting the image into cells.
+	Retro bool
+	// Shape is the shape of the cells.
+	Shape Shape
+	// Landmarks are the facial landmark points in image coordinates.
+	// If it's not empty, the cells are smaller around these points.
+	Landmarks []image.Point
+}
+
 // Draw creates uniform cells with the quantified cell color of the source image.
-func (quant *Quant) Draw(src image.Image, numOfColors int, cellSize int, noiseLevel int) image.Image {
+func Draw(quant Quantizer, src image.Image, opts Options) image.Image {
 	dx, dy := src.Bounds().Dx(), src.Bounds().Dy()
 	dst := image.NewNRGBA64(src.Bounds())
 
@@ -14,45 +34,116 @@ func (quant *Quant) Draw(src image.Image, numOfColors int, cellSize int, noiseLe
 	imgRatio := func(w, h int) float64 {
 		var ratio float64
 		if w > h {
-			ratio = float64((w / h) * w)
+			ratio = float64(w) / float64(h) * float64(w)
 		} else {
-			ratio = float64((h / w) * h)
+			ratio = float64(h) / float64(w) * float64(h)
 		}
 		return ratio
 	}
 
+	cellSize := opts.CellSize
 	if cellSize == 0 {
-		cellSize = int(imgRatio(dx, dy) * 0.015)
-	} else {
-		cellSize = cellSize
+		cellSize = max(1, int(imgRatio(dx, dy)*0.015))
 	}
+	squareCells := opts.Shape == Square && len(opts.Landmarks) == 0
 
-	qimg := quant.Quantize(src, numOfColors)
+	qimg := quant.Quantize(src, opts.NumOfColors).(*image.Paletted)
 
-	for x := 0; x < dx; x += cellSize {
-		for y := 0; y < dy; y += cellSize {
-			rect := image.Rect(x, y, x+cellSize, y+cellSize)
-			rect = rect.Intersect(qimg.Bounds())
-			if rect.Empty() {
-				rect = image.ZR
-			}
-			subImg := qimg.(*image.Paletted).SubImage(rect).(*image.Paletted)
-			cellColor := getAvgColor(subImg)
+	switch {
+	case opts.Retro:
+		drawRetro(dst, src, qimg, opts.Dither)
+	case !squareCells:
+		if opts.Dither != NoDither {
+			qimg = ditherQuantized(src, qimg, opts.Dither)
+		}
+		drawShapedCells(dst, qimg, cellSize, opts.Shape, opts.Landmarks)
+	case opts.Dither != NoDither:
+		drawDitheredCells(dst, src, qimg, cellSize, opts.Dither)
+	default:
+		for x := 0; x < dx; x += cellSize {
+			for y := 0; y < dy; y += cellSize {
+				rect := image.Rect(x, y, x+cellSize, y+cellSize)
+				rect = rect.Intersect(qimg.Bounds())
+				if rect.Empty() {
+					rect = image.ZR
+				}
+				subImg := qimg.SubImage(rect).(*image.Paletted)
+				cellColor := getAvgColor(subImg)
 
-			// Fill in the cell with the quantified color.
-			for xx := x; xx < x+cellSize; xx++ {
-				for yy := y; yy < y+cellSize; yy++ {
-					dst.Set(xx, yy, cellColor)
+				// Fill in the cell with the quantified color.
+				for xx := x; xx < x+cellSize; xx++ {
+					for yy := y; yy < y+cellSize; yy++ {
+						dst.Set(xx, yy, cellColor)
+					}
 				}
 			}
 		}
 	}
-	if noiseLevel > 0 {
-		addNoise(dst, noiseLevel)
+	if opts.NoiseLevel > 0 && opts.Noise != nil {
+		opts.Noise.ApplyNRGBA64(dst, float64(opts.NoiseLevel))
 	}
 	return dst
 }
 
+// drawRetro draws the source image at full resolution using only the palette colors of the quantized image.
+func drawRetro(dst *image.NRGBA64, src image.Image, qimg *image.Paletted, d Dither) {
+	if d != NoDither {
+		qimg = ditherQuantized(src, qimg, d)
+	}
+	draw.Draw(dst, dst.Bounds(), qimg, qimg.Bounds().Min, draw.Src)
+}
+
+// ditherQuantized maps the source image to the palette of the quantized image using the dithering method.
+func ditherQuantized(src image.Image, qimg *image.Paletted, d Dither) *image.Paletted {
+	var s source
+	dithered := image.NewPaletted(qimg.Bounds(), qimg.Palette)
+	ditherImage(dithered, s.nrgba(src), d)
+	return dithered
+}
+
+// drawDitheredCells averages the source image colors over each cell,
+// then dithers the cells against the palette of the quantized image.
+func drawDitheredCells(dst *image.NRGBA64, src image.Image, qimg *image.Paletted, cellSize int, d Dither) {
+	var s source
+	img := s.nrgba(src)
+	bounds := img.Bounds()
+	cols, rows := (bounds.Dx()+cellSize-1)/cellSize, (bounds.Dy()+cellSize-1)/cellSize
+
+	// Each pixel of the cells image holds the average color of a cell.
+	cells := image.NewNRGBA(image.Rect(0, 0, cols, rows))
+	for cy := 0; cy < rows; cy++ {
+		for cx := 0; cx < cols; cx++ {
+			rect := image.Rect(cx*cellSize, cy*cellSize, (cx+1)*cellSize, (cy+1)*cellSize).Add(bounds.Min).Intersect(bounds)
+
+			var r, g, b, n int
+			for y := rect.Min.Y; y < rect.Max.Y; y++ {
+				for x := rect.Min.X; x < rect.Max.X; x++ {
+					p := img.Pix[img.PixOffset(x, y):]
+					r += int(p[0])
+					g += int(p[1])
+					b += int(p[2])
+					n++
+				}
+			}
+			if n == 0 {
+				continue
+			}
+			cells.SetNRGBA(cx, cy, color.NRGBA{R: uint8(r / n), G: uint8(g / n), B: uint8(b / n), A: 0xff})
+		}
+	}
+	dithered := image.NewPaletted(cells.Bounds(), qimg.Palette)
+	ditherImage(dithered, cells, d)
+
+	// Fill in the cells with the dithered palette colors.
+	for cy := 0; cy < rows; cy++ {
+		for cx := 0; cx < cols; cx++ {
+			rect := image.Rect(cx*cellSize, cy*cellSize, (cx+1)*cellSize, (cy+1)*cellSize).Add(dst.Rect.Min)
+			cellColor := dithered.Palette[dithered.ColorIndexAt(cx, cy)]
+			draw.Draw(dst, rect, &image.Uniform{C: cellColor}, image.Point{}, draw.Src)
+		}
+	}
+}
+
 // getAvgColor get the average color of a cell
 func getAvgColor(img *image.Paletted) color.NRGBA64 {
 	var (
@@ -69,10 +160,11 @@ func getAvgColor(img *image.Paletted) color.NRGBA64 {
 		}
 	}
 
+	n := bounds.Dx() * bounds.Dy()
 	return color.NRGBA64{
-		R: max(0, min(65535, uint16(r/(bounds.Dx()*bounds.Dy())))),
-		G: max(0, min(65535, uint16(g/(bounds.Dx()*bounds.Dy())))),
-		B: max(0, min(65535, uint16(b/(bounds.Dx()*bounds.Dy())))),
-		A: 255,
+		R: uint16(r / n),
+		G: uint16(g / n),
+		B: uint16(b / n),
+		A: 0xffff,
 	}
 }
@@ -0,0 +1,88 @@
+package pixelate
+
+import (
+	"image"
+	"image/color"
+)
+
+// kmeansSampleStep defines the ratio of the pixels considered by the k-means iterations.
+const kmeansSampleStep = 4
+
+// KMeans is a quantizer which refines the median cut palette with k-means clustering.
+// Each iteration assigns the pixels to their closest palette color,
+// then moves the palette colors to the mean of their assigned pixels.
+// The iterations are run over a subset of the pixels to keep it fast enough for real time.
+type KMeans struct {
+	source
+	Iterations int
+
+	seed      *Quant
+	centroids [][3]int32
+	sums      [][4]int64
+	pi        *image.Paletted
+}
+
+// NewKMeans initializes a new k-means quantizer running the provided number of iterations.
+func NewKMeans(iterations int) *KMeans {
+	return &KMeans{
+		Iterations: iterations,
+		seed:       NewQuantizer(),
+	}
+}
+
+// Quantize returns a paletted image.
+// The returned image is reused by the next Quantize call.
+func (k *KMeans) Quantize(img image.Image, nq int) image.Image {
+	src := k.nrgba(img)
+	seed := k.seed.Quantize(src, nq).(*image.Paletted)
+
+	n := len(seed.Palette)
+	k.centroids = k.centroids[:0]
+	for _, c := range seed.Palette {
+		r, g, b, _ := c.RGBA()
+		k.centroids = append(k.centroids, [3]int32{int32(r >> 8), int32(g >> 8), int32(b >> 8)})
+	}
+	if cap(k.sums) < n {
+		k.sums = make([][4]int64, n)
+	}
+	k.sums = k.sums[:n]
+
+	pix := src.Pix
+	const step = 4 * kmeansSampleStep
+	for it := 0; it < k.Iterations; it++ {
+		for i := range k.sums {
+			k.sums[i] = [4]int64{}
+		}
+		for i := 0; i < len(pix); i += step {
+			s := &k.sums[nearest(k.centroids, int32(pix[i]), int32(pix[i+1]), int32(pix[i+2]))]
+			s[0] += int64(pix[i])
+			s[1] += int64(pix[i+1])
+			s[2] += int64(pix[i+2])
+			s[3]++
+		}
+		changed := false
+		for i, s := range k.sums {
+			// Keep the palette color of the clusters which lost all of their pixels.
+			if s[3] == 0 {
+				continue
+			}
+			c := [3]int32{int32(s[0] / s[3]), int32(s[1] / s[3]), int32(s[2] / s[3])}
+			if c != k.centroids[i] {
+				k.centroids[i] = c
+				changed = true
+			}
+		}
+		if !changed {
+			break
+		}
+	}
+
+	k.pi = reusePaletted(k.pi, src.Bounds(), n)
+	for i, c := range k.centroids {
+		k.pi.Palette[i] = color.NRGBA{R: uint8(c[0]), G: uint8(c[1]), B: uint8(c[2]), A: 0xff}
+	}
+	for i := 0; i < len(pix); i += 4 {
+		k.pi.Pix[i/4] = uint8(nearest(k.centroids, int32(pix[i]), int32(pix[i+1]), int32(pix[i+2])))
+	}
+	return k.pi
+}
@@ -0,0 +1,195 @@
+package pixelate
+
+import (
+	"image"
+	"image/color"
+)
+
+// octreeDepth is the number of tree levels, one for each bit of the color channels.
+const octreeDepth = 8
+
+// Octree is a quantizer which inserts the image colors into an octree,
+// then repeatedly merges the deepest nodes until the number of leaves
+// does not exceed the requested number of colors.
+type Octree struct {
+	source
+	nodes  []octreeNode
+	levels [octreeDepth][]int32 // reducible nodes grouped by tree level, except the root
+	leaves int
+	pi     *image.Paletted
+}
+
+type octreeNode struct {
+	r, g, b  uint64   // sum of the color values falling into the node
+	count    uint64   // number of the pixels falling into the node
+	children [8]int32 // indices of the child nodes, zero if it's missing
+	leaf     bool
+	indexed  bool  // the palette index is already assigned
+	index    uint8 // palette index of the leaf node
+}
+
+// NewOctree initializes a new octree quantizer.
+func NewOctree() *Octree {
+	return &Octree{}
+}
+
+// Quantize returns a paletted image.
+// The returned image is reused by the next Quantize call.
+func (o *Octree) Quantize(img image.Image, nq int) image.Image {
+	src := o.nrgba(img)
+	o.reset()
+
+	pix := src.Pix
+	for i := 0; i < len(pix); i += 4 {
+		o.insert(pix[i], pix[i+1], pix[i+2])
+		for o.leaves > nq {
+			o.reduce()
+		}
+	}
+
+	o.pi = reusePaletted(o.pi, src.Bounds(), o.leaves)
+	o.buildPalette(0, 0)
+	for i := 0; i < len(pix); i += 4 {
+		o.pi.Pix[i/4] = o.lookup(pix[i], pix[i+1], pix[i+2])
+	}
+	return o.pi
+}
+
+// reset clears the tree, keeping only the root node.
+func (o *Octree) reset() {
+	if cap(o.nodes) == 0 {
+		o.nodes = make([]octreeNode, 0, 1024)
+	}
+	o.nodes = append(o.nodes[:0], octreeNode{})
+	for l := range o.levels {
+		o.levels[l] = o.levels[l][:0]
+	}
+	o.leaves = 0
+}
+
+// childIndex returns the index of the child node selected by the color bits corresponding to the tree level.
+func childIndex(r, g, b uint8, level int) int {
+	shift := 7 - level
+	return int(r>>shift&1)<<2 | int(g>>shift&1)<<1 | int(b>>shift&1)
+}
+
+// insert adds the color to the leaf node corresponding to it, creating the missing nodes.
+func (o *Octree) insert(r, g, b uint8) {
+	node := int32(0)
+	for level := 0; level < octreeDepth && !o.nodes[node].leaf; level++ {
+		idx := childIndex(r, g, b, level)
+		child := o.nodes[node].children[idx]
+		if child == 0 {
+			child = int32(len(o.nodes))
+			o.nodes = append(o.nodes, octreeNode{leaf: level+1 == octreeDepth})
+			o.nodes[node].children[idx] = child
+			if level+1 == octreeDepth {
+				o.leaves++
+			} else {
+				o.levels[level+1] = append(o.levels[level+1], child)
+			}
+		}
+		node = child
+	}
+	n := &o.nodes[node]
+	n.r += uint64(r)
+	n.g += uint64(g)
+	n.b += uint64(b)
+	n.count++
+}
+
+// reduce merges the children of a node from the deepest level having reducible nodes.
+func (o *Octree) reduce() {
+	level := octreeDepth - 1
+	for level > 1 && len(o.levels[level]) == 0 {
+		level--
+	}
+	list := o.levels[level]
+	if len(list) == 0 {
+		o.mergeLeaves()
+		return
+	}
+	node := &o.nodes[list[len(list)-1]]
+	o.levels[level] = list[:len(list)-1]
+
+	for i, child := range node.children {
+		if child == 0 {
+			continue
+		}
+		c := o.nodes[child]
+		node.r += c.r
+		node.g += c.g
+		node.b += c.b
+		node.count += c.count
+		node.children[i] = 0
+		o.leaves--
+	}
+	node.leaf = true
+	o.leaves++
+}
+
+// mergeLeaves is used when only the root node is left for reduction. Instead of collapsing
+// all the colors into a single one, it merges the least populated child of the root into
+// the second least populated one. Both child slots will point to the merged node.
+func (o *Octree) mergeLeaves() {
+	root := &o.nodes[0]
+	src, dst := int32(0), int32(0)
+	for _, child := range root.children {
+		if child == 0 || child == src || child == dst {
+			continue
+		}
+		switch {
+		case src == 0 || o.nodes[child].count < o.nodes[src].count:
+			src, dst = child, src
+		case dst == 0 || o.nodes[child].count < o.nodes[dst].count:
+			dst = child
+		}
+	}
+	if src == 0 || dst == 0 {
+		return
+	}
+	s, d := &o.nodes[src], &o.nodes[dst]
+	d.r += s.r
+	d.g += s.g
+	d.b += s.b
+	d.count += s.count
+	for i, child := range root.children {
+		if child == src {
+			root.children[i] = dst
+		}
+	}
+	o.leaves--
+}
+
+// buildPalette assigns the palette indices to the leaf nodes and returns the next free index.
+func (o *Octree) buildPalette(node int32, index int) int {
+	n := &o.nodes[node]
+	if n.leaf {
+		if n.indexed {
+			return index
+		}
+		n.index, n.indexed = uint8(index), true
+		o.pi.Palette[index] = color.NRGBA{
+			R: uint8(n.r / n.count),
+			G: uint8(n.g / n.count),
+			B: uint8(n.b / n.count),
+			A: 0xff,
+		}
+		return index + 1
+	}
+	for _, child := range n.children {
+		if child != 0 {
+			index = o.buildPalette(child, index)
+		}
+	}
+	return index
+}
+
+// lookup returns the palette index of the leaf node corresponding to the color.
+func (o *Octree) lookup(r, g, b uint8) uint8 {
+	node := int32(0)
+	for level := 0; !o.nodes[node].leaf; level++ {
+		node = o.nodes[node].children[childIndex(r, g, b, level)]
+	}
+	return o.nodes[node].index
+}
@@ -0,0 +1,60 @@
+package pixelate
+
+import (
+	"image"
+	"image/color"
+)
+
+// Predefined retro palettes.
+var (
+	// GameBoy is the four shades of green palette of the original Game Boy.
+	GameBoy = []color.NRGBA{
+		{0x0f, 0x38, 0x0f, 0xff}, {0x30, 0x62, 0x30, 0xff},
+		{0x8b, 0xac, 0x0f, 0xff}, {0x9b, 0xbc, 0x0f, 0xff},
+	}
+	// CGA is the high intensity cyan, magenta and white palette of the CGA graphics mode.
+	CGA = []color.NRGBA{
+		{0x00, 0x00, 0x00, 0xff}, {0x55, 0xff, 0xff, 0xff},
+		{0xff, 0x55, 0xff, 0xff}, {0xff, 0xff, 0xff, 0xff},
+	}
+	// PICO8 is the sixteen colors palette of the PICO-8 fantasy console.
+	PICO8 = []color.NRGBA{
+		{0x00, 0x00, 0x00, 0xff}, {0x1d, 0x2b, 0x53, 0xff}, {0x7e, 0x25, 0x53, 0xff}, {0x00, 0x87, 0x51, 0xff},
+		{0xab, 0x52, 0x36, 0xff}, {0x5f, 0x57, 0x4f, 0xff}, {0xc2, 0xc3, 0xc7, 0xff}, {0xff, 0xf1, 0xe8, 0xff},
+		{0xff, 0x00, 0x4d, 0xff}, {0xff, 0xa3, 0x00, 0xff}, {0xff, 0xec, 0x27, 0xff}, {0x00, 0xe4, 0x36, 0xff},
+		{0x29, 0xad, 0xff, 0xff}, {0x83, 0x76, 0x9c, 0xff}, {0xff, 0x77, 0xa8, 0xff}, {0xff, 0xcc, 0xaa, 0xff},
+	}
+)
+
+// Palette is a quantizer which maps each pixel to the closest color of a fixed palette.
+type Palette struct {
+	source
+	colors [][3]int32
+	pi     *image.Paletted
+}
+
+// NewPalette initializes a new fixed palette quantizer.
+func NewPalette(colors []color.NRGBA) *Palette {
+	p := &Palette{colors: make([][3]int32, len(colors))}
+	for i, c := range colors {
+		p.colors[i] = [3]int32{int32(c.R), int32(c.G), int32(c.B)}
+	}
+	return p
+}
+
+// Quantize returns a paletted image. The number of colors is defined by the palette,
+// so the requested number of colors is ignored.
+// The returned image is reused by the next Quantize call.
+func (p *Palette) Quantize(img image.Image, _ int) image.Image {
+	src := p.nrgba(img)
+	p.pi = reusePaletted(p.pi, src.Bounds(), len(p.colors))
+	for i, c := range p.colors {
+		p.pi.Palette[i] = color.NRGBA{R: uint8(c[0]), G: uint8(c[1]), B: uint8(c[2]), A: 0xff}
+	}
+
+	pix := src.Pix
+	for i := 0; i < len(pix); i += 4 {
+		p.pi.Pix[i/4] = uint8(nearest(p.colors, int32(pix[i]), int32(pix[i+1]), int32(pix[i+2])))
+	}
+	return p.pi
+}
@@ -5,8 +5,6 @@ import (
 	"image"
 	"image/color"
 	"image/draw"
-	"math"
-	"sort"
 )
 
 // SubImager is a wrapper implementing the SubImage method from the image package.
@@ -14,31 +12,37 @@ type SubImager interface {
 	SubImage(r image.Rectangle) image.Image
 }
 
-// Interface which implements the Quantize method.
+// Quantizer reduces the number of colors of an image. The Quantize method
+// returns a paletted image having at most the requested number of colors.
 type Quantizer interface {
-	Quantize(image.Image, draw.Image, int, bool, bool) image.Image
+	Quantize(image.Image, int) image.Image
+}
+
+// source holds the reusable copy of the images, which are not NRGBA images with contiguous pixels.
+type source struct {
+	buf *image.NRGBA
 }
 
 // A workspace with members that can be accessed by methods.
+// The buffers are kept between the Quantize calls, so that consecutive
+// frames of the same size are quantized without new memory allocations.
 type Quant struct {
-	img image.Image // original image
-	cs  []cluster   // len is the desired number of colors
-	px  []point     // list of all points in the image
-	ch  chValues    // buffer for computing median
-	eq  []point     // additional buffer used when splitting cluster
+	source
+	img *image.NRGBA    // source image with pixels stored contiguously
+	pi  *image.Paletted // generated paletted image
+	cs  []cluster       // len is the desired number of colors
+	px  []int32         // list of all pixel indices in the image
+	eq  []int32         // additional buffer used when splitting cluster
+	pq  queue           // priority queue of the clusters to split
 }
 
 type cluster struct {
-	px       []point // list of points in the cluster
+	px       []int32 // list of pixel indices in the cluster
 	widestCh int     // rx, gx, bx const for channel with widest value range
 	chRange  uint32  // value range (vmax-vmin) of widest channel
 }
 
-type (
-	point    struct{ x, y int }
-	chValues []uint32
-	queue    []*cluster
-)
+type queue []*cluster
 
 const (
 	rx = iota
@@ -52,35 +56,38 @@ func NewQuantizer() *Quant {
 }
 
 // Quantize returns a paletted image.
-// We need to use type assertion to match the interface returning type.
-func (q Quant) Quantize(img image.Image, nq int) image.Image {
-	qz := newQuantizer(img, nq)        // set up a work space
-	qz.cluster()                       // cluster pixels by color
-	return qz.Paletted().(image.Image) // generate paletted image from clusters
+// The alpha channel is ignored, the source image is considered fully opaque.
+// The returned image is reused by the next Quantize call.
+func (qz *Quant) Quantize(img image.Image, nq int) image.Image {
+	qz.init(img, nq)     // set up a work space
+	qz.cluster()         // cluster pixels by color
+	return qz.Paletted() // generate paletted image from clusters
 }
 
-func newQuantizer(img image.Image, nq int) *Quant {
+// init prepares the workspace for the new image, reusing the buffers allocated for the previous one.
+func (qz *Quant) init(img image.Image, nq int) {
 	b := img.Bounds()
-	npx := (b.Max.X - b.Min.X) * (b.Max.Y - b.Min.Y)
-	// Create work space.
-	qz := &Quant{
-		img: img,
-		ch:  make(chValues, npx),
-		cs:  make([]cluster, nq),
+	qz.img = qz.nrgba(img)
+
+	npx := b.Dx() * b.Dy()
+	if cap(qz.px) < npx {
+		qz.px = make([]int32, npx)
 	}
-	// Populate initial cluster with all pixels from image.
-	c := &qz.cs[0]
-	px := make([]point, npx)
-	c.px = px
-	i := 0
-	for y := b.Min.Y; y < b.Max.Y; y++ {
-		for x := b.Min.X; x < b.Max.X; x++ {
-			px[i].x = x
-			px[i].y = y
-			i++
-		}
+	qz.px = qz.px[:npx]
+	for i := range qz.px {
+		qz.px[i] = int32(i)
 	}
-	return qz
+
+	if cap(qz.cs) < nq {
+		qz.cs = make([]cluster, nq)
+	}
+	qz.cs = qz.cs[:nq]
+	for i := range qz.cs {
+		qz.cs[i] = cluster{}
+	}
+	// Populate initial cluster with all pixels from image.
+	qz.cs[0].px = qz.px
+	qz.pq = qz.pq[:0]
 }
 
 func (qz *Quant) cluster() {
@@ -89,7 +96,7 @@ func (qz *Quant) cluster() {
 	// The rule will be to spilt the cluster with the most pixels.
 	// Terminate when the desired number of clusters has been populated
 	// or when clusters cannot be further split.
-	pq := new(queue)
+	pq := &qz.pq
 	// Initial cluster.  populated at this point, but not analyzed.
 	c := &qz.cs[0]
 	for i := 1; ; {
@@ -121,14 +128,14 @@ func (qz *Quant) cluster() {
 	}
 }
 
-func (q *Quant) setColorRange(c *cluster) {
+func (qz *Quant) setColorRange(c *cluster) {
 	// Find extents of color values in each channel.
-	var maxR, maxG, maxB uint32
-	minR := uint32(math.MaxUint32)
-	minG := uint32(math.MaxUint32)
-	minB := uint32(math.MaxUint32)
+	var maxR, maxG, maxB uint8
+	minR, minG, minB := uint8(255), uint8(255), uint8(255)
+	pix := qz.img.Pix
 	for _, p := range c.px {
-		r, g, b, _ := q.img.At(p.x, p.y).RGBA()
+		s := pix[p*4 : p*4+3 : p*4+3]
+		r, g, b := s[0], s[1], s[2]
 		if r < minR {
 			minR = r
 		}
@@ -163,55 +170,51 @@ func (q *Quant) setColorRange(c *cluster) {
 		max = maxB
 	}
 	c.widestCh = s
-	c.chRange = max - min // also store the range of that channel
+	// Store the range of that channel expanded to 16 bits, like the color.Color values.
+	c.chRange = uint32(max-min) * 0x101
 }
 
-func (q *Quant) Median(c *cluster) uint32 {
-	px := c.px
-	ch := q.ch[:len(px)]
-	// Copy values from appropriate channel to buffer for computing median.
-	switch c.widestCh {
-	case rx:
-		for i, p := range c.px {
-			ch[i], _, _, _ = q.img.At(p.x, p.y).RGBA()
-		}
-	case gx:
-		for i, p := range c.px {
-			_, ch[i], _, _ = q.img.At(p.x, p.y).RGBA()
-		}
-	case bx:
-		for i, p := range c.px {
-			_, _, ch[i], _ = q.img.At(p.x, p.y).RGBA()
-		}
+// Median returns the median value of the cluster's widest channel expanded to 16 bits.
+// Instead of sorting the channel values, it's looked up in the histogram of the channel.
+func (qz *Quant) Median(c *cluster) uint32 {
+	var hist [256]int
+	pix := qz.img.Pix
+	for _, p := range c.px {
+		hist[pix[int(p)*4+c.widestCh]]++
 	}
+
 	// Median algorithm.
-	sort.Sort(ch)
-	half := len(ch) / 2
-	m := ch[half]
-	if len(ch)%2 == 0 {
-		m = (m + ch[half-1]) / 2
+	half := len(c.px) / 2
+	m := uint32(valueAt(&hist, half)) * 0x101
+	if len(c.px)%2 == 0 {
+		m = (m + uint32(valueAt(&hist, half-1))*0x101) / 2
 	}
 	return m
 }
 
-func (q *Quant) Split(s, c *cluster, m uint32) {
+// valueAt returns the n-th (zero based) value in the sorted order of the values counted by the histogram.
+func valueAt(hist *[256]int, n int) uint8 {
+	sum := 0
+	for v, count := range hist {
+		sum += count
+		if sum > n {
+			return uint8(v)
+		}
+	}
+	return 255
+}
+
+func (qz *Quant) Split(s, c *cluster, m uint32) {
 	px := s.px
-	var v uint32
+	pix := qz.img.Pix
+	ch := s.widestCh
 	i := 0
 	lt := 0
 	gt := len(px) - 1
-	eq := q.eq[:0] // reuse any existing buffer
+	eq := qz.eq[:0] // reuse any existing buffer
 	for i <= gt {
 		// Get pixel value of appropriate channel.
-		r, g, b, _ := q.img.At(px[i].x, px[i].y).RGBA()
-		switch s.widestCh {
-		case rx:
-			v = r
-		case gx:
-			v = g
-		case bx:
-			v = b
-		}
+		v := uint32(pix[int(px[i])*4+ch]) * 0x101
 		// Categorize each pixel as either <, >, or == median.
 		switch {
 		case v < m:
@@ -235,7 +238,7 @@ func (q *Quant) Split(s, c *cluster, m uint32) {
 		if len(px)-i < lt {
 			i = lt
 		}
-		q.eq = eq // squirrel away (possibly expanded) buffer for reuse
+		qz.eq = eq // squirrel away (possibly expanded) buffer for reuse
 	}
 	// Split the pixel list.
 	s.px = px[:i]
@@ -243,37 +246,75 @@ func (q *Quant) Split(s, c *cluster, m uint32) {
 }
 
 func (qz *Quant) Paletted() image.PalettedImage {
-	cp := make(color.Palette, len(qz.cs))
-	pi := image.NewPaletted(qz.img.Bounds(), cp)
+	qz.pi = reusePaletted(qz.pi, qz.img.Bounds(), len(qz.cs))
+	pi := qz.pi
+
+	pix := qz.img.Pix
 	for i := range qz.cs {
 		px := qz.cs[i].px
 		// Average values in cluster to get palette color.
 		var rsum, gsum, bsum int64
 		for _, p := range px {
-			r, g, b, _ := qz.img.At(p.x, p.y).RGBA()
-			rsum += int64(r)
-			gsum += int64(g)
-			bsum += int64(b)
+			s := pix[p*4 : p*4+3 : p*4+3]
+			rsum += int64(s[0])
+			gsum += int64(s[1])
+			bsum += int64(s[2])
 		}
 		n64 := int64(len(px))
-		cp[i] = color.NRGBA64{
-			uint16(rsum / n64),
-			uint16(gsum / n64),
-			uint16(bsum / n64),
+		pi.Palette[i] = color.NRGBA64{
+			uint16(rsum * 0x101 / n64),
+			uint16(gsum * 0x101 / n64),
+			uint16(bsum * 0x101 / n64),
 			0xffff,
 		}
 		// set image pixels
 		for _, p := range px {
-			pi.SetColorIndex(p.x, p.y, uint8(i))
+			pi.Pix[p] = uint8(i)
 		}
 	}
 	return pi
 }
 
-// Implement sort.Interface for sort in median algorithm.
-func (c chValues) Len() int           { return len(c) }
-func (c chValues) Less(i, j int) bool { return c[i] < c[j] }
-func (c chValues) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+// nrgba returns the image as an NRGBA image with contiguous pixels, i.e. its pixel buffer holds
+// exactly the pixels of its bounds, so the pixels can be traversed without considering the stride.
+// The image is converted only if it's needed, reusing the buffer of the previous conversion.
+func (s *source) nrgba(img image.Image) *image.NRGBA {
+	b := img.Bounds()
+	// The sub images are sharing the pixel buffer of their parent, which continues past their bounds.
+	if src, ok := img.(*image.NRGBA); ok && src.Stride == 4*b.Dx() && len(src.Pix) == 4*b.Dx()*b.Dy() {
+		return src
+	}
+	if s.buf == nil || s.buf.Rect != b {
+		s.buf = image.NewNRGBA(b)
+	}
+	draw.Draw(s.buf, b, img, b.Min, draw.Src)
+	return s.buf
+}
+
+// reusePaletted returns a paletted image with the provided bounds and number of palette entries,
+// reusing the image allocated for the previous frame if the bounds are matching.
+func reusePaletted(pi *image.Paletted, b image.Rectangle, n int) *image.Paletted {
+	if pi == nil || pi.Rect != b {
+		pi = image.NewPaletted(b, nil)
+	}
+	if cap(pi.Palette) < n {
+		pi.Palette = make(color.Palette, n)
+	}
+	pi.Palette = pi.Palette[:n]
+	return pi
+}
+
+// nearest returns the index of the palette color closest to the (r, g, b) color.
+func nearest(pal [][3]int32, r, g, b int32) int {
+	best, minDist := 0, int32(1<<31-1)
+	for i, c := range pal {
+		dr, dg, db := r-c[0], g-c[1], b-c[2]
+		if dist := dr*dr + dg*dg + db*db; dist < minDist {
+			best, minDist = i, dist
+		}
+	}
+	return best
+}
 
 // Implement heap.Interface for priority queue of clusters.
 func (q queue) Len() int { return len(q) }
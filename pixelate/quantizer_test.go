@@ -0,0 +1,309 @@
+package pixelate
+
+import (
+	"container/heap"
+	"image"
+	"image/color"
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+// testImage returns a deterministic opaque image with smooth gradients and noise,
+// resembling the pixelated webcam frames.
+func testImage(w, h int, seed int64) *image.NRGBA {
+	rnd := rand.New(rand.NewSource(seed))
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			i := img.PixOffset(x, y)
+			img.Pix[i+0] = uint8(x*255/w + rnd.Intn(16))
+			img.Pix[i+1] = uint8(y*255/h + rnd.Intn(16))
+			img.Pix[i+2] = uint8((x+y)*127/(w+h) + rnd.Intn(64))
+			img.Pix[i+3] = 255
+		}
+	}
+	return img
+}
+
+func TestQuantizeMatchesLegacyPalette(t *testing.T) {
+	cases := []struct {
+		w, h, nq int
+	}{
+		{1, 1, 4},
+		{7, 5, 2},
+		{64, 48, 8},
+		{160, 120, 16},
+		{97, 131, 64},
+	}
+
+	qz := NewQuantizer()
+	for i, tc := range cases {
+		src := testImage(tc.w, tc.h, int64(i))
+		// The quantizer is reused, like in the render loop.
+		got := qz.Quantize(src, tc.nq).(*image.Paletted)
+		want := legacyQuantize(src, tc.nq).(*image.Paletted)
+
+		if len(got.Palette) != len(want.Palette) {
+			t.Fatalf("%dx%d/%d: palette size %d, want %d", tc.w, tc.h, tc.nq, len(got.Palette), len(want.Palette))
+		}
+		for j := range want.Palette {
+			r1, g1, b1, a1 := got.Palette[j].RGBA()
+			r2, g2, b2, a2 := want.Palette[j].RGBA()
+			if r1 != r2 || g1 != g2 || b1 != b2 || a1 != a2 {
+				t.Errorf("%dx%d/%d: palette color #%d is %v, want %v", tc.w, tc.h, tc.nq, j, got.Palette[j], want.Palette[j])
+			}
+		}
+		for j := range want.Pix {
+			if got.Pix[j] != want.Pix[j] {
+				t.Fatalf("%dx%d/%d: pixel #%d has index %d, want %d", tc.w, tc.h, tc.nq, j, got.Pix[j], want.Pix[j])
+			}
+		}
+	}
+}
+
+func TestQuantizeConvertsNonNRGBAImages(t *testing.T) {
+	src := testImage(40, 30, 1)
+	rgba := image.NewRGBA(src.Rect)
+	copy(rgba.Pix, src.Pix) // the source is opaque, so the premultiplied values are the same
+
+	got := NewQuantizer().Quantize(rgba, 8).(*image.Paletted)
+	want := legacyQuantize(rgba, 8).(*image.Paletted)
+	for j := range want.Pix {
+		if got.Palette[got.Pix[j]] != want.Palette[want.Pix[j]] {
+			t.Fatalf("pixel #%d is %v, want %v", j, got.Palette[got.Pix[j]], want.Palette[want.Pix[j]])
+		}
+	}
+}
+
+func TestQuantizeSubImage(t *testing.T) {
+	parent := testImage(64, 48, 2)
+	// The sub image spans the whole width, so its stride matches its width, but its pixel buffer continues past its bounds.
+	src := parent.SubImage(image.Rect(0, 10, 64, 20)).(*image.NRGBA)
+	pal := []color.NRGBA{{R: 255, A: 255}, {G: 255, A: 255}, {B: 255, A: 255}}
+
+	quantizers := map[string]Quantizer{
+		"median cut": NewQuantizer(),
+		"octree":     NewOctree(),
+		"k-means":    NewKMeans(4),
+		"palette":    NewPalette(pal),
+	}
+	for name, qz := range quantizers {
+		pi := qz.Quantize(src, 8).(*image.Paletted)
+		if pi.Bounds() != src.Bounds() {
+			t.Fatalf("%s: bounds %v, want %v", name, pi.Bounds(), src.Bounds())
+		}
+		if len(pi.Pix) != src.Bounds().Dx()*src.Bounds().Dy() {
+			t.Fatalf("%s: got %d pixels, want %d", name, len(pi.Pix), src.Bounds().Dx()*src.Bounds().Dy())
+		}
+	}
+}
+
+func BenchmarkQuantize(b *testing.B) {
+	src := testImage(320, 240, 1)
+
+	b.Run("MedianCut", func(b *testing.B) {
+		qz := NewQuantizer()
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			qz.Quantize(src, 16)
+		}
+	})
+	b.Run("Legacy", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			legacyQuantize(src, 16)
+		}
+	})
+}
+
+// The median cut quantizer as it was implemented before working over the raw pixel buffers,
+// reading the pixels through the image.Image interface and sorting the channel values.
+// It's kept as the reference of the palettes generated by the current implementation.
+
+type legacyQuant struct {
+	img image.Image
+	cs  []legacyCluster
+	ch  legacyValues
+	eq  []legacyPoint
+}
+
+type legacyCluster struct {
+	px       []legacyPoint
+	widestCh int
+	chRange  uint32
+}
+
+type (
+	legacyPoint  struct{ x, y int }
+	legacyValues []uint32
+	legacyQueue  []*legacyCluster
+)
+
+func legacyQuantize(img image.Image, nq int) image.Image {
+	b := img.Bounds()
+	npx := b.Dx() * b.Dy()
+	qz := &legacyQuant{
+		img: img,
+		ch:  make(legacyValues, npx),
+		cs:  make([]legacyCluster, nq),
+	}
+	px := make([]legacyPoint, 0, npx)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			px = append(px, legacyPoint{x, y})
+		}
+	}
+	qz.cs[0].px = px
+	qz.cluster()
+	return qz.paletted()
+}
+
+func (qz *legacyQuant) cluster() {
+	pq := new(legacyQueue)
+	c := &qz.cs[0]
+	for i := 1; ; {
+		qz.setColorRange(c)
+		if c.chRange > 0 {
+			heap.Push(pq, c)
+		}
+		if len(*pq) == 0 {
+			qz.cs = qz.cs[:i]
+			break
+		}
+		s := heap.Pop(pq).(*legacyCluster)
+		c = &qz.cs[i]
+		i++
+		qz.split(s, c, qz.median(s))
+		if i == len(qz.cs) {
+			break
+		}
+		qz.setColorRange(s)
+		if s.chRange > 0 {
+			heap.Push(pq, s)
+		}
+	}
+}
+
+func (qz *legacyQuant) setColorRange(c *legacyCluster) {
+	var maxR, maxG, maxB uint32
+	minR, minG, minB := uint32(math.MaxUint32), uint32(math.MaxUint32), uint32(math.MaxUint32)
+	for _, p := range c.px {
+		r, g, b, _ := qz.img.At(p.x, p.y).RGBA()
+		minR, maxR = legacyMin(minR, r), legacyMax(maxR, r)
+		minG, maxG = legacyMin(minG, g), legacyMax(maxG, g)
+		minB, maxB = legacyMin(minB, b), legacyMax(maxB, b)
+	}
+	s, min, max := gx, minG, maxG
+	if maxR-minR > max-min {
+		s, min, max = rx, minR, maxR
+	}
+	if maxB-minB > max-min {
+		s, min, max = bx, minB, maxB
+	}
+	c.widestCh = s
+	c.chRange = max - min
+}
+
+func (qz *legacyQuant) channel(p legacyPoint, ch int) uint32 {
+	r, g, b, _ := qz.img.At(p.x, p.y).RGBA()
+	return [3]uint32{r, g, b}[ch]
+}
+
+func (qz *legacyQuant) median(c *legacyCluster) uint32 {
+	ch := qz.ch[:len(c.px)]
+	for i, p := range c.px {
+		ch[i] = qz.channel(p, c.widestCh)
+	}
+	sort.Sort(ch)
+	half := len(ch) / 2
+	m := ch[half]
+	if len(ch)%2 == 0 {
+		m = (m + ch[half-1]) / 2
+	}
+	return m
+}
+
+func (qz *legacyQuant) split(s, c *legacyCluster, m uint32) {
+	px := s.px
+	i, lt, gt := 0, 0, len(px)-1
+	eq := qz.eq[:0]
+	for i <= gt {
+		v := qz.channel(px[i], s.widestCh)
+		switch {
+		case v < m:
+			px[lt] = px[i]
+			lt++
+			i++
+		case v > m:
+			px[gt], px[i] = px[i], px[gt]
+			gt--
+		default:
+			eq = append(eq, px[i])
+			i++
+		}
+	}
+	if len(eq) > 0 {
+		copy(px[lt:], eq)
+		if len(px)-i < lt {
+			i = lt
+		}
+		qz.eq = eq
+	}
+	s.px = px[:i]
+	c.px = px[i:]
+}
+
+func (qz *legacyQuant) paletted() image.PalettedImage {
+	cp := make(color.Palette, len(qz.cs))
+	pi := image.NewPaletted(qz.img.Bounds(), cp)
+	for i := range qz.cs {
+		px := qz.cs[i].px
+		var rsum, gsum, bsum int64
+		for _, p := range px {
+			r, g, b, _ := qz.img.At(p.x, p.y).RGBA()
+			rsum += int64(r)
+			gsum += int64(g)
+			bsum += int64(b)
+		}
+		n64 := int64(len(px))
+		cp[i] = color.NRGBA64{uint16(rsum / n64), uint16(gsum / n64), uint16(bsum / n64), 0xffff}
+		for _, p := range px {
+			pi.SetColorIndex(p.x, p.y, uint8(i))
+		}
+	}
+	return pi
+}
+
+func legacyMin(a, b uint32) uint32 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func legacyMax(a, b uint32) uint32 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func (c legacyValues) Len() int           { return len(c) }
+func (c legacyValues) Less(i, j int) bool { return c[i] < c[j] }
+func (c legacyValues) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+
+func (q legacyQueue) Len() int           { return len(q) }
+func (q legacyQueue) Less(i, j int) bool { return len(q[j].px) < len(q[i].px) }
+func (q legacyQueue) Swap(i, j int)      { q[i], q[j] = q[j], q[i] }
+
+func (q *legacyQueue) Push(x interface{}) { *q = append(*q, x.(*legacyCluster)) }
+
+func (q *legacyQueue) Pop() interface{} {
+	old := *q
+	n := len(old) - 1
+	c := old[n]
+	*q = old[:n]
+	return c
+}
@@ -0,0 +1,212 @@
+package pixels
+
+// Luma defines the standard used for weighting the color channels on grayscale conversion.
+type Luma int
+
+const (
+	// BT709 weights the channels by the ITU-R BT.709 (HDTV) coefficients:
+	// gray = 0.2126*red + 0.7152*green + 0.0722*blue
+	BT709 Luma = iota
+	// BT601 weights the channels by the ITU-R BT.601 (SDTV) coefficients:
+	// gray = 0.299*red + 0.587*green + 0.114*blue
+	BT601
+	// Average takes the arithmetic mean of the color channels:
+	// gray = (red + green + blue) / 3
+	Average
+)
+
+// Equalization defines the contrast enhancement applied over the grayscale image.
+type Equalization int
+
+const (
+	// NoEqualization keeps the grayscale values unchanged.
+	NoEqualization Equalization = iota
+	// HistEqualization spreads the grayscale values over the whole range using the global histogram.
+	HistEqualization
+	// CLAHEqualization applies the contrast limited adaptive histogram equalization.
+	CLAHEqualization
+)
+
+const (
+	// The luma coefficients are stored in 16.16 fixed point format, each triplet adding up to 1<<16.
+	fixedShift = 16
+	fixedHalf  = 1 << (fixedShift - 1)
+
+	// Default parameters of the contrast limited adaptive histogram equalization.
+	claheTiles     = 8
+	claheClipLimit = 2.0
+)
+
+var lumaCoeffs = map[Luma][3]uint32{
+	BT709:   {13933, 46871, 4732},
+	BT601:   {19595, 38470, 7471},
+	Average: {21845, 21846, 21845},
+}
+
+// String returns the name of the luma standard.
+func (l Luma) String() string {
+	switch l {
+	case BT601:
+		return "BT.601"
+	case Average:
+		return "average"
+	default:
+		return "BT.709"
+	}
+}
+
+// String returns the name of the equalization method.
+func (e Equalization) String() string {
+	switch e {
+	case HistEqualization:
+		return "histogram"
+	case CLAHEqualization:
+		return "CLAHE"
+	default:
+		return "none"
+	}
+}
+
+// Grayscale converts the RGBA pixel data to grayscale using integer fixed point arithmetic.
+// The result is written into the dst buffer, which is reused if it has enough capacity,
+// so that the source color frame is preserved. It returns the (possibly reallocated) buffer.
+func Grayscale(dst, src []uint8, luma Luma) []uint8 {
+	coeffs, ok := lumaCoeffs[luma]
+	if !ok {
+		coeffs = lumaCoeffs[BT709]
+	}
+	cr, cg, cb := coeffs[0], coeffs[1], coeffs[2]
+
+	dst = growBuffer(dst, len(src)/4)
+	for i := range dst {
+		p := src[i*4 : i*4+3 : i*4+3]
+		dst[i] = uint8((cr*uint32(p[0]) + cg*uint32(p[1]) + cb*uint32(p[2]) + fixedHalf) >> fixedShift)
+	}
+	return dst
+}
+
+// Equalize enhances the contrast of the grayscale image in place with the provided equalization method.
+func Equalize(gray []uint8, width, height int, eq Equalization) {
+	switch eq {
+	case HistEqualization:
+		EqualizeHist(gray)
+	case CLAHEqualization:
+		CLAHE(gray, width, height, claheTiles, claheClipLimit)
+	}
+}
+
+// EqualizeHist applies a global histogram equalization in place over the grayscale image.
+func EqualizeHist(gray []uint8) {
+	var hist [256]int
+	for _, v := range gray {
+		hist[v]++
+	}
+	lut := equalizeLUT(&hist, len(gray))
+	for i, v := range gray {
+		gray[i] = lut[v]
+	}
+}
+
+// CLAHE applies the contrast limited adaptive histogram equalization in place over the grayscale image.
+// The image is divided into tiles x tiles regions, each of them having its own equalization mapping
+// computed from the histogram clipped at clipLimit times the average bin count. The mappings of the
+// four closest regions are bilinearly interpolated in order to avoid the visible tile boundaries.
+func CLAHE(gray []uint8, width, height, tiles int, clipLimit float64) {
+	if tiles < 1 || width < tiles || height < tiles {
+		EqualizeHist(gray)
+		return
+	}
+	tileW, tileH := (width+tiles-1)/tiles, (height+tiles-1)/tiles
+	luts := make([][256]uint8, tiles*tiles)
+
+	for ty := 0; ty < tiles; ty++ {
+		for tx := 0; tx < tiles; tx++ {
+			x0, y0 := tx*tileW, ty*tileH
+			x1, y1 := ClampInt(x0+tileW, 0, width), ClampInt(y0+tileH, 0, height)
+
+			var hist [256]int
+			for y := y0; y < y1; y++ {
+				for _, v := range gray[y*width+x0 : y*width+x1] {
+					hist[v]++
+				}
+			}
+			count := (x1 - x0) * (y1 - y0)
+			if count <= 0 {
+				// Keep the values unchanged in the regions falling outside of the image.
+				for i := range luts[ty*tiles+tx] {
+					luts[ty*tiles+tx][i] = uint8(i)
+				}
+				continue
+			}
+			clipHist(&hist, int(clipLimit*float64(count)/256))
+			luts[ty*tiles+tx] = equalizeLUT(&hist, count)
+		}
+	}
+
+	for y := 0; y < height; y++ {
+		// Find the two closest tile centers on the vertical axis and the interpolation weight.
+		fy := (float64(y)+0.5)/float64(tileH) - 0.5
+		ty0 := ClampInt(int(fy), 0, tiles-1)
+		ty1 := ClampInt(ty0+1, 0, tiles-1)
+		wy := Clamp(fy-float64(ty0), 0, 1)
+
+		for x := 0; x < width; x++ {
+			fx := (float64(x)+0.5)/float64(tileW) - 0.5
+			tx0 := ClampInt(int(fx), 0, tiles-1)
+			tx1 := ClampInt(tx0+1, 0, tiles-1)
+			wx := Clamp(fx-float64(tx0), 0, 1)
+
+			v := gray[y*width+x]
+			top := (1-wx)*float64(luts[ty0*tiles+tx0][v]) + wx*float64(luts[ty0*tiles+tx1][v])
+			bottom := (1-wx)*float64(luts[ty1*tiles+tx0][v]) + wx*float64(luts[ty1*tiles+tx1][v])
+			gray[y*width+x] = uint8((1-wy)*top + wy*bottom + 0.5)
+		}
+	}
+}
+
+// clipHist clips the histogram bins at the limit and redistributes the excess uniformly.
+func clipHist(hist *[256]int, limit int) {
+	if limit < 1 {
+		limit = 1
+	}
+	excess := 0
+	for i, v := range hist {
+		if v > limit {
+			excess += v - limit
+			hist[i] = limit
+		}
+	}
+	inc, rest := excess/256, excess%256
+	for i := range hist {
+		hist[i] += inc
+		if i < rest {
+			hist[i]++
+		}
+	}
+}
+
+// equalizeLUT computes the lookup table mapping the grayscale values to the equalized values.
+func equalizeLUT(hist *[256]int, count int) [256]uint8 {
+	var (
+		lut     [256]uint8
+		cdf     int
+		cdfMin  int
+		hasMin  bool
+		divisor int
+	)
+	for _, v := range hist {
+		if v > 0 && !hasMin {
+			cdfMin, hasMin = v, true
+		}
+	}
+	divisor = count - cdfMin
+	for i, v := range hist {
+		cdf += v
+		if divisor <= 0 {
+			lut[i] = uint8(i)
+			continue
+		}
+		lut[i] = uint8(ClampInt((cdf-cdfMin)*255/divisor, 0, 255))
+	}
+	return lut
+}
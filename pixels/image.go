@@ -1,129 +1,98 @@
 package pixels
 
-import (
-	"encoding/base64"
-	"fmt"
-	"image"
-	"image/color"
-	"io/ioutil"
-	"math"
-	"net/http"
-	"net/url"
-	"syscall/js"
-	"time"
-)
+import "image"
 
 // ImgToPix converts an image to an 1D uint8 pixel array.
-// In order to preserve the color information per pixel we need to reconstruct the array to a specific format.
+// In order to preserve the color information per pixel the alpha channel is set to fully opaque.
 func ImgToPix(src *image.NRGBA) []uint8 {
-	size := src.Bounds().Size()
-	width, height := size.X, size.Y
-	pixels := make([][][3]uint8, height)
-
-	for y := 0; y < height; y++ {
-		row := make([][3]uint8, width)
-		for x := 0; x < width; x++ {
-			idx := (y*width + x) * 4
-			pix := src.Pix[idx : idx+4]
-			row[x] = [3]uint8{uint8(pix[0]), uint8(pix[1]), uint8(pix[2])}
-		}
-		pixels[y] = row
-	}
+	return ImgToPixInto(nil, src)
+}
 
-	// Flatten the 3d array to 1D.
-	flattened := []uint8{}
-	for x := 0; x < len(pixels); x++ {
-		for y := 0; y < len(pixels[x]); y++ {
-			r := pixels[x][y][0]
-			g := pixels[x][y][1]
-			b := pixels[x][y][2]
-			flattened = append(flattened, r, g, b, 255)
+// ImgToPixInto converts an image to an 1D uint8 pixel array, reusing the dst buffer
+// if it has enough capacity, and returns the (possibly reallocated) buffer.
+func ImgToPixInto(dst []uint8, src *image.NRGBA) []uint8 {
+	size := src.Bounds().Size()
+	rowLen := size.X * 4
+	dst = growBuffer(dst, rowLen*size.Y)
+
+	for y := 0; y < size.Y; y++ {
+		row := dst[y*rowLen : (y+1)*rowLen]
+		copy(row, src.Pix[y*src.Stride:y*src.Stride+rowLen])
+		for i := 3; i < rowLen; i += 4 {
+			row[i] = 255
 		}
 	}
-	return flattened
+	return dst
 }
 
 // PixToImage converts the pixel data to an image.
+// The pixel data is copied, so the returned image does not share the memory with the source.
 func PixToImage(pixels []uint8, rect image.Rectangle) image.Image {
-	img := image.NewNRGBA(rect)
-	bounds := img.Bounds()
-	dx, dy := bounds.Max.X, bounds.Max.Y
-	col := color.NRGBA{}
-
-	for y := bounds.Min.Y; y < dy; y++ {
-		for x := bounds.Min.X; x < dx*4; x += 4 {
-			col.R = pixels[x+y*dx*4]
-			col.G = pixels[x+y*dx*4+1]
-			col.B = pixels[x+y*dx*4+2]
-			col.A = pixels[x+y*dx*4+3]
+	return PixToNRGBA(nil, pixels, rect)
+}
 
-			img.SetNRGBA(int(x/4), y, col)
-		}
+// PixToNRGBA copies the pixel data into the dst image, reusing it if its bounds
+// are matching the provided rectangle, otherwise allocating a new image.
+func PixToNRGBA(dst *image.NRGBA, pixels []uint8, rect image.Rectangle) *image.NRGBA {
+	if dst == nil || dst.Rect != rect {
+		dst = image.NewNRGBA(rect)
 	}
-	return img
+	copy(dst.Pix, pixels)
+	return dst
 }
 
-// RotateImg rotates the image per pixel level to a certain degree and returns an image data.
-func RotateImg(img *image.NRGBA, angle float64) []uint8 {
-	bounds := img.Bounds()
-	dx, dy := bounds.Max.X, bounds.Max.Y
-	col := color.NRGBA{}
-
-	for x := bounds.Min.X; x < dx; x++ {
-		for y := bounds.Min.Y; y < dy; y++ {
-			x0, y0 := dx/2, dy/2
-			xoff, yoff := x-x0, y-y0
-			rad := angle * math.Pi / 180
-			newX := int(math.Cos(rad)*float64(xoff) + math.Sin(rad)*float64(yoff) + float64(x0))
-			newY := int(math.Cos(rad)*float64(yoff) - math.Sin(rad)*float64(xoff) + float64(y0))
-
-			pos := x + (y * dx)
-			col.R = img.Pix[pos*4]
-			col.G = img.Pix[pos*4+1]
-			col.B = img.Pix[pos*4+2]
-			col.A = img.Pix[pos*4+3]
-
-			img.SetNRGBA(newX, newY, col)
-		}
+// NewNRGBAView wraps the pixel data into an image without copying it.
+// The canvas image data is stored in non-premultiplied RGBA format, which means
+// that the buffer can be used directly as the backing store of an NRGBA image.
+// Any modification of the image is reflected in the source buffer and vice versa.
+func NewNRGBAView(pixels []uint8, rect image.Rectangle) *image.NRGBA {
+	return &image.NRGBA{
+		Pix:    pixels[:rect.Dx()*rect.Dy()*4],
+		Stride: rect.Dx() * 4,
+		Rect:   rect,
 	}
-	return ImgToPix(img)
 }
 
-// RgbaToGrayscale converts the pixel data to grayscale mode.
-func RgbaToGrayscale(data []uint8, dx, dy int) []uint8 {
-	for r := 0; r < dx; r++ {
-		for c := 0; c < dy; c++ {
-			// gray = 0.2*red + 0.7*green + 0.1*blue
-			data[r*dy+c] = uint8(math.Round(
-				0.2126*float64(data[r*4*dy+4*c+0]) +
-					0.7152*float64(data[r*4*dy+4*c+1]) +
-					0.0722*float64(data[r*4*dy+4*c+2])))
-		}
+// CropInto copies the rectangle of the RGBA frame buffer having the provided width into the dst buffer,
+// reusing it if it has enough capacity, and returns the (possibly reallocated) buffer.
+// The rectangle must lie within the frame.
+func CropInto(dst, pixels []uint8, width int, rect image.Rectangle) []uint8 {
+	rowLen := rect.Dx() * 4
+	dst = growBuffer(dst, rowLen*rect.Dy())
+
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		i := (y*width + rect.Min.X) * 4
+		copy(dst[(y-rect.Min.Y)*rowLen:], pixels[i:i+rowLen])
 	}
-	return data
+	return dst
 }
 
-// LoadImage load the source image and encodes it to base64 format.
-func LoadImage(path string) (string, error) {
-	href := js.Global().Get("location").Get("href")
-	u, err := url.Parse(href.String())
-	if err != nil {
-		return "", err
+// growBuffer returns a slice of the requested length, reusing the buffer if it has enough capacity.
+func growBuffer(buf []uint8, size int) []uint8 {
+	if cap(buf) < size {
+		return make([]uint8, size)
 	}
+	return buf[:size]
+}
 
-	u.Path = path
-	u.RawQuery = fmt.Sprint(time.Now().UnixNano())
+// AlphaToPix converts an alpha mask to an RGBA pixel array.
+// The mask values are stored in the alpha channel, while the color channels are left black.
+func AlphaToPix(src *image.Alpha) []uint8 {
+	return AlphaToPixInto(nil, src)
+}
 
-	resp, err := http.Get(u.String())
-	if err != nil {
-		return "", err
-	}
-	defer resp.Body.Close()
+// AlphaToPixInto converts an alpha mask to an RGBA pixel array, reusing the dst buffer
+// if it has enough capacity, and returns the (possibly reallocated) buffer.
+func AlphaToPixInto(dst []uint8, src *image.Alpha) []uint8 {
+	size := src.Bounds().Size()
+	dst = growBuffer(dst, size.X*size.Y*4)
 
-	b, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return "", err
+	for y := 0; y < size.Y; y++ {
+		row := src.Pix[y*src.Stride : y*src.Stride+size.X]
+		for x, a := range row {
+			i := (y*size.X + x) * 4
+			dst[i], dst[i+1], dst[i+2], dst[i+3] = 0, 0, 0, a
+		}
 	}
-
-	return base64.StdEncoding.EncodeToString(b), nil
+	return dst
 }
@@ -0,0 +1,116 @@
+package pixels
+
+import (
+	"image"
+	"testing"
+)
+
+const (
+	benchWidth  = 640
+	benchHeight = 480
+)
+
+// benchFrame returns a webcam sized RGBA frame filled with a gradient.
+func benchFrame() []uint8 {
+	data := make([]uint8, benchWidth*benchHeight*4)
+	for i := range data {
+		data[i] = uint8(i * 7)
+	}
+	return data
+}
+
+func TestImgToPixIntoReusesBuffer(t *testing.T) {
+	rect := image.Rect(0, 0, benchWidth, benchHeight)
+	src := PixToNRGBA(nil, benchFrame(), rect)
+	dst := make([]uint8, len(src.Pix))
+
+	out := ImgToPixInto(dst, src)
+	if &out[0] != &dst[0] {
+		t.Fatal("expected the destination buffer to be reused")
+	}
+	for i := 3; i < len(out); i += 4 {
+		if out[i] != 255 {
+			t.Fatalf("expected opaque alpha at %d, got %d", i, out[i])
+		}
+	}
+}
+
+func TestAlphaToPixIntoReusesBuffer(t *testing.T) {
+	src := image.NewAlpha(image.Rect(0, 0, benchWidth, benchHeight))
+	for i := range src.Pix {
+		src.Pix[i] = uint8(i)
+	}
+	// The reused buffer holds stale colors, which have to be cleared.
+	dst := benchFrame()
+
+	out := AlphaToPixInto(dst, src)
+	if &out[0] != &dst[0] {
+		t.Fatal("expected the destination buffer to be reused")
+	}
+	for i, a := range src.Pix {
+		if p := out[i*4 : i*4+4]; p[0] != 0 || p[1] != 0 || p[2] != 0 || p[3] != a {
+			t.Fatalf("expected black pixel with alpha %d at %d, got %v", a, i, p)
+		}
+	}
+}
+
+func TestFramePoolReusesBuffer(t *testing.T) {
+	fp := NewFramePool()
+	buf := fp.Get(1024)
+	fp.Put(buf)
+	if got := fp.Get(512); &got[0] != &buf[0] || len(got) != 512 {
+		t.Fatal("expected the pooled buffer to be reused")
+	}
+}
+
+func BenchmarkImgToPixInto(b *testing.B) {
+	rect := image.Rect(0, 0, benchWidth, benchHeight)
+	src := PixToNRGBA(nil, benchFrame(), rect)
+	dst := make([]uint8, len(src.Pix))
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(src.Pix)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		dst = ImgToPixInto(dst, src)
+	}
+}
+
+func BenchmarkPixToNRGBA(b *testing.B) {
+	rect := image.Rect(0, 0, benchWidth, benchHeight)
+	data := benchFrame()
+	dst := image.NewNRGBA(rect)
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		dst = PixToNRGBA(dst, data, rect)
+	}
+}
+
+func BenchmarkGrayscale(b *testing.B) {
+	data := benchFrame()
+	gray := make([]uint8, benchWidth*benchHeight)
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		gray = Grayscale(gray, data, BT709)
+	}
+}
+
+func BenchmarkFramePool(b *testing.B) {
+	fp := NewFramePool()
+	// The face regions are changing their size between the frames.
+	sizes := []int{180 * 180 * 4, 200 * 200 * 4, 160 * 160 * 4}
+	fp.Put(make([]uint8, 200*200*4))
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf := fp.Get(sizes[i%len(sizes)])
+		fp.Put(buf)
+	}
+}
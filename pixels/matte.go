@@ -0,0 +1,88 @@
+package pixels
+
+import (
+	"image"
+	"math"
+)
+
+// ScaledSize returns the size of the frame downscaled by the factor, including the partial blocks on the edges.
+func ScaledSize(width, height, factor int) (int, int) {
+	return (width + factor - 1) / factor, (height + factor - 1) / factor
+}
+
+// Downscale averages the RGB channels of the RGBA frame buffer of the provided size over the blocks
+// of factor x factor pixels. The dst slice holds the three averaged channels of each downscaled pixel,
+// its size being given by ScaledSize. The blocks on the edges are averaged over their pixels inside the frame.
+func Downscale(dst []float64, pix []uint8, width, height, factor int) {
+	w, h := ScaledSize(width, height, factor)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var r, g, b, n int
+			for sy := y * factor; sy < (y+1)*factor && sy < height; sy++ {
+				for sx := x * factor; sx < (x+1)*factor && sx < width; sx++ {
+					i := (sy*width + sx) * 4
+					r += int(pix[i])
+					g += int(pix[i+1])
+					b += int(pix[i+2])
+					n++
+				}
+			}
+			i := (y*w + x) * 3
+			dst[i], dst[i+1], dst[i+2] = float64(r)/float64(n), float64(g)/float64(n), float64(b)/float64(n)
+		}
+	}
+}
+
+// Interpolate bilinearly interpolates the values of the w x h grid at the point, which is clamped to the grid edges.
+func Interpolate(src []float64, w, h int, fx, fy float64) float64 {
+	x0, y0 := ClampInt(int(math.Floor(fx)), 0, w-1), ClampInt(int(math.Floor(fy)), 0, h-1)
+	x1, y1 := ClampInt(x0+1, 0, w-1), ClampInt(y0+1, 0, h-1)
+	tx, ty := Clamp(fx-float64(x0), 0, 1), Clamp(fy-float64(y0), 0, 1)
+
+	top := src[y0*w+x0]*(1-tx) + src[y0*w+x1]*tx
+	bottom := src[y1*w+x0]*(1-tx) + src[y1*w+x1]*tx
+	return top + (bottom-top)*ty
+}
+
+// UpscaleAlpha bilinearly interpolates the w x h matte downscaled by the factor, having
+// values between 0 and 1, into the full resolution alpha image.
+func UpscaleAlpha(dst *image.Alpha, src []float64, w, h, factor int) {
+	d := float64(factor)
+	width, height := dst.Rect.Dx(), dst.Rect.Dy()
+	for y := 0; y < height; y++ {
+		fy := (float64(y)+0.5)/d - 0.5
+		row := dst.Pix[y*dst.Stride:]
+		for x := 0; x < width; x++ {
+			fx := (float64(x)+0.5)/d - 0.5
+			row[x] = uint8(Clamp(Interpolate(src, w, h, fx, fy), 0, 1)*255 + 0.5)
+		}
+	}
+}
+
+// Smoothstep returns the smooth Hermite interpolation between 0 and 1 of the value between the two edges.
+func Smoothstep(edge0, edge1, v float64) float64 {
+	t := Clamp((v-edge0)/(edge1-edge0), 0, 1)
+	return t * t * (3 - 2*t)
+}
+
+// Clamp restricts the value between the min and max limits.
+func Clamp(v, min, max float64) float64 {
+	if v < min {
+		return min
+	}
+	if v > max {
+		return max
+	}
+	return v
+}
+
+// ClampInt restricts the integer value between the min and max limits.
+func ClampInt(v, min, max int) int {
+	if v < min {
+		return min
+	}
+	if v > max {
+		return max
+	}
+	return v
+}
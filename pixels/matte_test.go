@@ -0,0 +1,114 @@
+package pixels
+
+import (
+	"image"
+	"math"
+	"testing"
+)
+
+func TestDownscale(t *testing.T) {
+	cases := []struct {
+		width, height, factor int
+	}{
+		{8, 8, 4},
+		{10, 7, 4},
+		{5, 3, 1},
+		{3, 2, 8},
+	}
+	for _, tc := range cases {
+		pix := make([]uint8, tc.width*tc.height*4)
+		for y := 0; y < tc.height; y++ {
+			for x := 0; x < tc.width; x++ {
+				i := (y*tc.width + x) * 4
+				pix[i], pix[i+1], pix[i+2], pix[i+3] = uint8(x*10), uint8(y*10), 0x80, 0xff
+			}
+		}
+		w, h := ScaledSize(tc.width, tc.height, tc.factor)
+		dst := make([]float64, w*h*3)
+		Downscale(dst, pix, tc.width, tc.height, tc.factor)
+
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				// The blocks on the edges are averaged over their pixels inside the frame.
+				x0, x1 := x*tc.factor, ClampInt((x+1)*tc.factor, 0, tc.width)
+				y0, y1 := y*tc.factor, ClampInt((y+1)*tc.factor, 0, tc.height)
+				want := [3]float64{float64(x0+x1-1) * 5, float64(y0+y1-1) * 5, 0x80}
+				i := (y*w + x) * 3
+				if got := [3]float64{dst[i], dst[i+1], dst[i+2]}; got != want {
+					t.Fatalf("%dx%d/%d: block (%d, %d) is %v, want %v", tc.width, tc.height, tc.factor, x, y, got, want)
+				}
+			}
+		}
+	}
+}
+
+func TestInterpolate(t *testing.T) {
+	src := []float64{
+		0, 1,
+		2, 3,
+	}
+	cases := []struct {
+		fx, fy, want float64
+	}{
+		{0, 0, 0},
+		{1, 1, 3},
+		{0.5, 0, 0.5},
+		{0, 0.5, 1},
+		{0.5, 0.5, 1.5},
+		// The points outside the grid are clamped to its edges.
+		{-2, -2, 0},
+		{4, 0.5, 2},
+	}
+	for _, tc := range cases {
+		if got := Interpolate(src, 2, 2, tc.fx, tc.fy); math.Abs(got-tc.want) > 1e-9 {
+			t.Fatalf("Interpolate(%g, %g) = %g, want %g", tc.fx, tc.fy, got, tc.want)
+		}
+	}
+}
+
+func TestUpscaleAlpha(t *testing.T) {
+	src := []float64{
+		0, 1, 1.5,
+		-0.5, 0.5, 1,
+	}
+	// With the odd factor the middle pixels of the blocks are mapped exactly over the block centers.
+	dst := image.NewAlpha(image.Rect(0, 0, 9, 6))
+	UpscaleAlpha(dst, src, 3, 2, 3)
+
+	cases := []struct {
+		x, y int
+		want uint8
+	}{
+		// The values are clamped between 0 and 1.
+		{1, 1, 0},
+		{4, 1, 0xff},
+		{7, 1, 0xff},
+		{1, 4, 0},
+		{4, 4, 0x80},
+		// Between the block centers the values are interpolated.
+		{2, 1, 0x55},
+		{4, 3, 0xaa},
+	}
+	for _, tc := range cases {
+		if got := dst.AlphaAt(tc.x, tc.y).A; got != tc.want {
+			t.Fatalf("pixel (%d, %d) is %#x, want %#x", tc.x, tc.y, got, tc.want)
+		}
+	}
+}
+
+func TestSmoothstep(t *testing.T) {
+	cases := []struct {
+		v, want float64
+	}{
+		{-1, 0},
+		{0, 0},
+		{1, 0.5},
+		{2, 1},
+		{3, 1},
+	}
+	for _, tc := range cases {
+		if got := Smoothstep(0, 2, tc.v); got != tc.want {
+			t.Fatalf("Smoothstep(0, 2, %g) = %g, want %g", tc.v, got, tc.want)
+		}
+	}
+}
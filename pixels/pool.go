@@ -0,0 +1,62 @@
+package pixels
+
+import "sync"
+
+// maxPooled is the number of idle buffers kept by the pool.
+const maxPooled = 16
+
+// FramePool is a pool of reusable pixel buffers. It reduces the memory allocations
+// of the render loop, where a new buffer would be required for each frame or face region.
+// The full frame buffers are allocated only once by the render loops, since each webcam frame
+// overwrites their whole content, so the pool serves the buffers whose size varies between the frames.
+// The buffers are kept in a free list instead of a sync.Pool, since storing a slice in
+// a sync.Pool would allocate its header on each Put.
+type FramePool struct {
+	mu   sync.Mutex
+	bufs [][]uint8
+}
+
+// NewFramePool creates a new pool of pixel buffers.
+func NewFramePool() *FramePool {
+	return &FramePool{
+		bufs: make([][]uint8, 0, maxPooled),
+	}
+}
+
+// Get returns a buffer of the requested size from the pool. The buffer content is not cleared.
+func (fp *FramePool) Get(size int) []uint8 {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+
+	// Prefer the most recently returned buffer having enough capacity.
+	for i := len(fp.bufs) - 1; i >= 0; i-- {
+		if buf := fp.bufs[i]; cap(buf) >= size {
+			last := len(fp.bufs) - 1
+			fp.bufs[i] = fp.bufs[last]
+			fp.bufs[last] = nil
+			fp.bufs = fp.bufs[:last]
+			return buf[:size]
+		}
+	}
+	return make([]uint8, size)
+}
+
+// Put returns the buffer to the pool for later reuse. If the pool is full, the smallest buffer is dropped.
+func (fp *FramePool) Put(buf []uint8) {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+
+	if len(fp.bufs) < maxPooled {
+		fp.bufs = append(fp.bufs, buf)
+		return
+	}
+	smallest := 0
+	for i, b := range fp.bufs {
+		if cap(b) < cap(fp.bufs[smallest]) {
+			smallest = i
+		}
+	}
+	if cap(buf) > cap(fp.bufs[smallest]) {
+		fp.bufs[smallest] = buf
+	}
+}
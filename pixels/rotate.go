@@ -0,0 +1,207 @@
+package pixels
+
+import (
+	"image"
+	"math"
+)
+
+// Interpolation defines the sampling method used for resolving the pixel
+// values which are not aligned to the source image pixel grid.
+type Interpolation int
+
+const (
+	// Nearest picks the closest source pixel.
+	Nearest Interpolation = iota
+	// Bilinear interpolates linearly between the four closest source pixels.
+	Bilinear
+	// Bicubic uses a Catmull-Rom spline over the sixteen closest source pixels.
+	Bicubic
+)
+
+// RotateOptions holds the parameters of the image rotation.
+type RotateOptions struct {
+	// Interpolation is the sampling method used for reading the source pixels.
+	Interpolation Interpolation
+	// Pivot is the rotation center in source image coordinates. If it's nil, the image is rotated around
+	// its center, snapped to the pixel grid (rounded down for the odd sizes), so the rotations by right
+	// angles map the pixels exactly over the destination pixels, without transparent rows or columns.
+	Pivot *image.Point
+	// Expand enlarges the destination bounds to fit the whole rotated image,
+	// otherwise the result is cropped to the source image bounds.
+	Expand bool
+}
+
+// Rotate rotates the source image counterclockwise by the angle (expressed in degrees) and writes the result
+// into dst. The dst image is reused if its size is matching the size of the rotated image, otherwise a new
+// image is allocated. The bounds of the result are expressed in the source image coordinate system, so
+// an expanded image might start at negative coordinates, e.g. when it's rotated around its corner.
+// The source and destination images must not share the same pixel buffer.
+// The pixels falling outside of the source image bounds are left fully transparent.
+func Rotate(dst, src *image.NRGBA, angle float64, opts RotateOptions) *image.NRGBA {
+	b := src.Bounds()
+	pivot := image.Pt(b.Min.X+b.Dx()/2, b.Min.Y+b.Dy()/2)
+	if opts.Pivot != nil {
+		pivot = *opts.Pivot
+	}
+	px, py := float64(pivot.X), float64(pivot.Y)
+	rad := angle * math.Pi / 180
+	sin, cos := math.Sincos(rad)
+
+	rect := b
+	if opts.Expand {
+		rect = rotatedBounds(b, px, py, sin, cos)
+	}
+	if dst == nil || dst.Rect.Size() != rect.Size() {
+		dst = image.NewNRGBA(rect)
+	}
+	// The pixel layout of the reused image depends only on its size.
+	dst.Rect = rect
+
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		row := dst.Pix[(y-rect.Min.Y)*dst.Stride:]
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			// Map the destination pixel center back to the source image.
+			xoff := float64(x) + 0.5 - px
+			yoff := float64(y) + 0.5 - py
+			sx := cos*xoff - sin*yoff + px
+			sy := sin*xoff + cos*yoff + py
+
+			var r, g, b, a float64
+			switch opts.Interpolation {
+			case Bilinear:
+				r, g, b, a = sampleBilinear(src, sx-0.5, sy-0.5)
+			case Bicubic:
+				r, g, b, a = sampleBicubic(src, sx-0.5, sy-0.5)
+			default:
+				r, g, b, a = pixelAt(src, int(math.Floor(sx)), int(math.Floor(sy)))
+			}
+
+			i := (x - rect.Min.X) * 4
+			if a <= 0 {
+				row[i], row[i+1], row[i+2], row[i+3] = 0, 0, 0, 0
+				continue
+			}
+			// Convert back the premultiplied values.
+			row[i+0] = clampUint8(r / a * 255)
+			row[i+1] = clampUint8(g / a * 255)
+			row[i+2] = clampUint8(b / a * 255)
+			row[i+3] = clampUint8(a)
+		}
+	}
+	return dst
+}
+
+// rotatedBounds returns the bounding box of the rectangle rotated around the pivot point.
+func rotatedBounds(r image.Rectangle, px, py, sin, cos float64) image.Rectangle {
+	minX, minY := math.Inf(1), math.Inf(1)
+	maxX, maxY := math.Inf(-1), math.Inf(-1)
+
+	corners := [4][2]float64{
+		{float64(r.Min.X), float64(r.Min.Y)},
+		{float64(r.Max.X), float64(r.Min.Y)},
+		{float64(r.Min.X), float64(r.Max.Y)},
+		{float64(r.Max.X), float64(r.Max.Y)},
+	}
+	for _, c := range corners {
+		// Forward rotation, the inverse of the sampling transformation.
+		xoff, yoff := c[0]-px, c[1]-py
+		x := cos*xoff + sin*yoff + px
+		y := -sin*xoff + cos*yoff + py
+
+		minX, maxX = math.Min(minX, x), math.Max(maxX, x)
+		minY, maxY = math.Min(minY, y), math.Max(maxY, y)
+	}
+	// Tolerate the floating point errors of the trigonometric functions,
+	// otherwise the right angle rotations would grow the bounds by one pixel.
+	const eps = 1e-9
+	return image.Rect(
+		int(math.Floor(minX+eps)), int(math.Floor(minY+eps)),
+		int(math.Ceil(maxX-eps)), int(math.Ceil(maxY-eps)),
+	)
+}
+
+// pixelAt returns the premultiplied color components of the source pixel.
+// The pixels outside of the image bounds are considered fully transparent.
+func pixelAt(src *image.NRGBA, x, y int) (r, g, b, a float64) {
+	if !(image.Point{X: x, Y: y}).In(src.Rect) {
+		return 0, 0, 0, 0
+	}
+	i := src.PixOffset(x, y)
+	s := src.Pix[i : i+4 : i+4]
+	a = float64(s[3])
+	return float64(s[0]) * a / 255, float64(s[1]) * a / 255, float64(s[2]) * a / 255, a
+}
+
+// sampleBilinear interpolates the premultiplied colors of the four pixels around the (x, y) position.
+func sampleBilinear(src *image.NRGBA, x, y float64) (r, g, b, a float64) {
+	x0, y0 := math.Floor(x), math.Floor(y)
+	fx, fy := x-x0, y-y0
+	ix, iy := int(x0), int(y0)
+
+	weights := [4]float64{(1 - fx) * (1 - fy), fx * (1 - fy), (1 - fx) * fy, fx * fy}
+	offsets := [4][2]int{{0, 0}, {1, 0}, {0, 1}, {1, 1}}
+	for i, o := range offsets {
+		w := weights[i]
+		if w == 0 {
+			continue
+		}
+		pr, pg, pb, pa := pixelAt(src, ix+o[0], iy+o[1])
+		r += pr * w
+		g += pg * w
+		b += pb * w
+		a += pa * w
+	}
+	return
+}
+
+// sampleBicubic interpolates the premultiplied colors of the sixteen pixels around the (x, y) position.
+func sampleBicubic(src *image.NRGBA, x, y float64) (r, g, b, a float64) {
+	x0, y0 := math.Floor(x), math.Floor(y)
+	fx, fy := x-x0, y-y0
+	ix, iy := int(x0), int(y0)
+
+	var wx, wy [4]float64
+	for i := 0; i < 4; i++ {
+		wx[i] = cubicWeight(fx - float64(i-1))
+		wy[i] = cubicWeight(fy - float64(i-1))
+	}
+	for j := 0; j < 4; j++ {
+		for i := 0; i < 4; i++ {
+			w := wx[i] * wy[j]
+			pr, pg, pb, pa := pixelAt(src, ix+i-1, iy+j-1)
+			r += pr * w
+			g += pg * w
+			b += pb * w
+			a += pa * w
+		}
+	}
+	// The Catmull-Rom spline can overshoot, so the color values should not exceed the alpha value.
+	a = math.Max(0, math.Min(255, a))
+	r, g, b = math.Min(r, a), math.Min(g, a), math.Min(b, a)
+	return
+}
+
+// cubicWeight is the Catmull-Rom cubic convolution kernel.
+func cubicWeight(t float64) float64 {
+	const coeff = -0.5
+
+	t = math.Abs(t)
+	switch {
+	case t <= 1:
+		return (coeff+2)*t*t*t - (coeff+3)*t*t + 1
+	case t < 2:
+		return coeff*t*t*t - 5*coeff*t*t + 8*coeff*t - 4*coeff
+	}
+	return 0
+}
+
+// clampUint8 rounds the value and restricts it to the uint8 range.
+func clampUint8(v float64) uint8 {
+	if v <= 0 {
+		return 0
+	}
+	if v >= 255 {
+		return 255
+	}
+	return uint8(v + 0.5)
+}
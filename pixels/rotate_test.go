@@ -0,0 +1,100 @@
+package pixels
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+// rotateSource returns a deterministic image with distinct pixel colors and varying alpha.
+func rotateSource(w, h int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{R: uint8(x * 13), G: uint8(y * 29), B: uint8(x*y + 7), A: uint8(128 + (x+y)%128)})
+		}
+	}
+	return img
+}
+
+func TestRotateZeroAngleKeepsImage(t *testing.T) {
+	src := rotateSource(17, 11)
+	for _, interp := range []Interpolation{Nearest, Bilinear, Bicubic} {
+		for _, expand := range []bool{false, true} {
+			dst := Rotate(nil, src, 0, RotateOptions{Interpolation: interp, Expand: expand})
+			if dst.Rect != src.Rect {
+				t.Fatalf("interpolation %d, expand %t: bounds %v, want %v", interp, expand, dst.Rect, src.Rect)
+			}
+			for i := range src.Pix {
+				if dst.Pix[i] != src.Pix[i] {
+					t.Fatalf("interpolation %d, expand %t: pixel byte %d is %d, want %d", interp, expand, i, dst.Pix[i], src.Pix[i])
+				}
+			}
+		}
+	}
+}
+
+func TestRotateRightAngleBounds(t *testing.T) {
+	cases := []struct {
+		w, h  int
+		angle float64
+		want  image.Rectangle
+	}{
+		{40, 30, 90, image.Rect(5, -5, 35, 35)},
+		{40, 30, 180, image.Rect(0, 0, 40, 30)},
+		{40, 30, -90, image.Rect(5, -5, 35, 35)},
+		// The odd sizes are rotated around the pivot snapped to the pixel grid.
+		{3, 2, 90, image.Rect(0, -1, 2, 2)},
+		{3, 3, 270, image.Rect(-1, 0, 2, 3)},
+	}
+	for _, tc := range cases {
+		src := rotateSource(tc.w, tc.h)
+		dst := Rotate(nil, src, tc.angle, RotateOptions{Interpolation: Nearest, Expand: true})
+		if dst.Rect != tc.want {
+			t.Fatalf("%dx%d by %g: bounds %v, want %v", tc.w, tc.h, tc.angle, dst.Rect, tc.want)
+		}
+		// Every destination pixel is mapped over a source pixel.
+		for i := 3; i < len(dst.Pix); i += 4 {
+			if dst.Pix[i] == 0 {
+				t.Fatalf("%dx%d by %g: transparent pixel at byte %d", tc.w, tc.h, tc.angle, i)
+			}
+		}
+	}
+}
+
+func TestRotateAroundCorner(t *testing.T) {
+	src := rotateSource(8, 5)
+	dst := Rotate(nil, src, 90, RotateOptions{Interpolation: Nearest, Pivot: &image.Point{}, Expand: true})
+
+	// Rotated counterclockwise around the top left corner, the image lands above the pivot.
+	if want := image.Rect(0, -8, 5, 0); dst.Rect != want {
+		t.Fatalf("bounds %v, want %v", dst.Rect, want)
+	}
+	for y := dst.Rect.Min.Y; y < dst.Rect.Max.Y; y++ {
+		for x := dst.Rect.Min.X; x < dst.Rect.Max.X; x++ {
+			if got, want := dst.NRGBAAt(x, y), src.NRGBAAt(-y-1, x); got != want {
+				t.Fatalf("pixel (%d, %d) is %v, want %v", x, y, got, want)
+			}
+		}
+	}
+}
+
+func TestRotateReusesBuffer(t *testing.T) {
+	src := rotateSource(20, 10)
+	// The reused image has the size of the result, but other bounds.
+	dst := image.NewNRGBA(image.Rect(100, 100, 110, 120))
+	pix := &dst.Pix[0]
+
+	out := Rotate(dst, src, 90, RotateOptions{Expand: true})
+	if out != dst || &out.Pix[0] != pix {
+		t.Fatal("expected the destination image to be reused")
+	}
+	if want := image.Rect(5, -5, 15, 15); out.Rect != want {
+		t.Fatalf("bounds %v, want %v", out.Rect, want)
+	}
+
+	// The images of other size are reallocated.
+	if out := Rotate(dst, src, 0, RotateOptions{}); out == dst {
+		t.Fatal("expected a new destination image")
+	}
+}
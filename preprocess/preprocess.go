@@ -0,0 +1,258 @@
+package preprocess
+
+import (
+	"math"
+
+	"github.com/esimov/pigo-wasm-demos/pixels"
+)
+
+// Lighting describes the lighting conditions of the analyzed frame.
+type Lighting int
+
+const (
+	// GoodLighting means the frame is suitable for face detection.
+	GoodLighting Lighting = iota
+	// TooDark means the frame is underexposed.
+	TooDark
+	// TooBright means the frame is overexposed.
+	TooBright
+	// Backlit means the frame is dominated by a bright background and very dark regions.
+	Backlit
+	// LowContrast means the frame has a very narrow tonal range.
+	LowContrast
+)
+
+const (
+	// The gamma values estimated by the automatic gamma correction are restricted to this range.
+	minGamma = 0.4
+	maxGamma = 3.0
+
+	// Only every sampleStep-th pixel is considered when computing the frame statistics.
+	sampleStep = 4
+
+	// Pixels darker than shadowLevel or brighter than highlightLevel are counted as clipped.
+	shadowLevel    = 30
+	highlightLevel = 225
+)
+
+// Config holds the parameters of the preprocessing stage.
+type Config struct {
+	// Enabled switches the gamma correction and the auto contrast on or off.
+	Enabled bool
+	// Gamma is the gamma correction value. Values greater than 1 brighten the shadows,
+	// values between 0 and 1 darken the image. It's ignored if AutoGamma is enabled.
+	Gamma float64
+	// AutoGamma estimates the gamma value which maps the mean brightness to the middle gray.
+	AutoGamma bool
+	// AutoContrast stretches the tonal range, discarding ContrastClip percent of pixels at both ends.
+	AutoContrast bool
+	ContrastClip float64
+	// Equalization is the histogram equalization applied after the tonal corrections.
+	Equalization pixels.Equalization
+
+	// The thresholds below which the lighting is reported as inadequate for face detection.
+	MinBrightness float64
+	MaxBrightness float64
+	MinContrast   float64
+	// MaxBacklight is the maximum fraction of highlight and shadow pixels
+	// tolerated before the frame is reported as backlit.
+	MaxBacklight float64
+}
+
+// Report holds the statistics of the last processed frame.
+type Report struct {
+	Lighting Lighting
+	// Mean and StdDev are the brightness statistics of the frame before the corrections.
+	Mean   float64
+	StdDev float64
+	// Shadows and Highlights are the fraction of the dark and bright pixels.
+	Shadows    float64
+	Highlights float64
+	// Gamma is the gamma value applied over the frame.
+	Gamma float64
+}
+
+// Preprocessor enhances the grayscale frames before they are sent to the face detector.
+type Preprocessor struct {
+	Config
+
+	hist [256]int
+	lut  [256]uint8
+}
+
+// DefaultConfig returns the preprocessing parameters suitable for the webcam frames.
+// The corrections are disabled, so only the lighting conditions are reported until they are enabled.
+func DefaultConfig() Config {
+	return Config{
+		Enabled:       false,
+		Gamma:         1.0,
+		AutoGamma:     true,
+		AutoContrast:  true,
+		ContrastClip:  0.5,
+		Equalization:  pixels.NoEqualization,
+		MinBrightness: 35,
+		MaxBrightness: 220,
+		MinContrast:   12,
+		MaxBacklight:  0.6,
+	}
+}
+
+// NewPreprocessor creates a new preprocessor with the provided configuration.
+func NewPreprocessor(cfg Config) *Preprocessor {
+	return &Preprocessor{Config: cfg}
+}
+
+// Process analyzes the grayscale frame and applies the enabled corrections in place.
+// The gamma correction and the contrast stretching are combined into a single lookup table,
+// so the frame is traversed only once, followed by the optional histogram equalization.
+func (p *Preprocessor) Process(gray []uint8, width, height int) Report {
+	report := p.analyze(gray)
+
+	if p.Enabled {
+		low, high := uint8(0), uint8(255)
+		if p.AutoContrast {
+			low, high = p.percentiles(p.ContrastClip / 100)
+		}
+		report.Gamma = p.Gamma
+		if p.AutoGamma {
+			// The gamma is estimated from the mean brightness of the stretched tonal range.
+			report.Gamma = estimateGamma((report.Mean - float64(low)) * 255 / float64(high-low))
+		}
+		if report.Gamma != 1 || low > 0 || high < 255 {
+			p.buildLUT(report.Gamma, low, high)
+			for i, v := range gray {
+				gray[i] = p.lut[v]
+			}
+		}
+	}
+	pixels.Equalize(gray, width, height, p.Equalization)
+
+	return report
+}
+
+// analyze computes the brightness histogram and statistics of the frame over a subset of pixels.
+func (p *Preprocessor) analyze(gray []uint8) Report {
+	var report Report
+	for i := range p.hist {
+		p.hist[i] = 0
+	}
+	for i := 0; i < len(gray); i += sampleStep {
+		p.hist[gray[i]]++
+	}
+
+	var count, sum, sqSum, shadows, highlights float64
+	for v, n := range p.hist {
+		fn := float64(n)
+		count += fn
+		sum += fn * float64(v)
+		sqSum += fn * float64(v*v)
+		if v < shadowLevel {
+			shadows += fn
+		} else if v > highlightLevel {
+			highlights += fn
+		}
+	}
+	report.Gamma = 1
+	if count == 0 {
+		return report
+	}
+	report.Mean = sum / count
+	report.StdDev = math.Sqrt(math.Max(0, sqSum/count-report.Mean*report.Mean))
+	report.Shadows = shadows / count
+	report.Highlights = highlights / count
+	report.Lighting = p.classify(report)
+
+	return report
+}
+
+// classify decides whether the lighting conditions are adequate for the face detection.
+func (p *Preprocessor) classify(r Report) Lighting {
+	switch {
+	case r.Mean < p.MinBrightness:
+		return TooDark
+	case r.Mean > p.MaxBrightness:
+		return TooBright
+	case r.Highlights > 0.15 && r.Shadows > 0.15 && r.Highlights+r.Shadows > p.MaxBacklight:
+		return Backlit
+	case r.StdDev < p.MinContrast:
+		return LowContrast
+	}
+	return GoodLighting
+}
+
+// percentiles returns the brightness values below and above which
+// the clip fraction of the analyzed pixels are located.
+func (p *Preprocessor) percentiles(clip float64) (low, high uint8) {
+	total := 0
+	for _, n := range p.hist {
+		total += n
+	}
+	limit := int(clip * float64(total))
+
+	sum := 0
+	for v := 0; v < 256; v++ {
+		sum += p.hist[v]
+		if sum > limit {
+			low = uint8(v)
+			break
+		}
+	}
+	sum = 0
+	for v := 255; v >= 0; v-- {
+		sum += p.hist[v]
+		if sum > limit {
+			high = uint8(v)
+			break
+		}
+	}
+	if high <= low {
+		return 0, 255
+	}
+	return low, high
+}
+
+// buildLUT computes the lookup table which stretches the [low, high] range
+// over the full brightness range and then applies the gamma correction.
+func (p *Preprocessor) buildLUT(gamma float64, low, high uint8) {
+	invGamma := 1 / gamma
+	scale := 1 / float64(high-low)
+	for v := range p.lut {
+		n := clamp((float64(v)-float64(low))*scale, 0, 1)
+		p.lut[v] = uint8(math.Pow(n, invGamma)*255 + 0.5)
+	}
+}
+
+// estimateGamma returns the gamma value which maps the mean brightness to the middle gray.
+func estimateGamma(mean float64) float64 {
+	if mean <= 0 || mean >= 255 {
+		return 1
+	}
+	return clamp(math.Log(mean/255)/math.Log(0.5), minGamma, maxGamma)
+}
+
+// String returns the description of the lighting conditions.
+func (l Lighting) String() string {
+	switch l {
+	case TooDark:
+		return "too dark"
+	case TooBright:
+		return "too bright"
+	case Backlit:
+		return "backlit"
+	case LowContrast:
+		return "low contrast"
+	default:
+		return "good"
+	}
+}
+
+// clamp restricts the value between the min and max limits.
+func clamp(v, min, max float64) float64 {
+	if v < min {
+		return min
+	}
+	if v > max {
+		return max
+	}
+	return v
+}
@@ -0,0 +1,35 @@
+//go:build js && wasm
+
+package privacy
+
+import (
+	"syscall/js"
+
+	"github.com/esimov/pigo-wasm-demos/tracker"
+)
+
+// PutFrame draws the redacted RGBA frame buffer of the provided size back to the canvas context.
+func PutFrame(ctx js.Value, pix []uint8, width, height int) {
+	uint8Arr := js.Global().Get("Uint8Array").New(len(pix))
+	js.CopyBytesToJS(uint8Arr, pix)
+
+	uint8Clamped := js.Global().Get("Uint8ClampedArray").New(uint8Arr)
+	rawData := js.Global().Get("ImageData").New(uint8Clamped, width, height)
+	ctx.Call("putImageData", rawData, 0, 0)
+}
+
+// DrawTracks marks the tracked faces over the canvas context.
+func DrawTracks(ctx js.Value, tracks []*tracker.Track) {
+	for _, tr := range tracks {
+		ctx.Call("beginPath")
+		ctx.Set("lineWidth", 2)
+		// The held tracks are marked with a different color, since their faces are not detected.
+		if tr.Held() {
+			ctx.Set("strokeStyle", "rgba(255, 200, 0, 0.8)")
+		} else {
+			ctx.Set("strokeStyle", "rgba(0, 255, 0, 0.5)")
+		}
+		ctx.Call("rect", tr.Rect.Min.X, tr.Rect.Min.Y, tr.Rect.Dx(), tr.Rect.Dy())
+		ctx.Call("stroke")
+	}
+}
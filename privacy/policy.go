@@ -0,0 +1,141 @@
+package privacy
+
+import (
+	"image"
+
+	"github.com/esimov/pigo-wasm-demos/tracker"
+)
+
+// Action is the redaction required by the fail-safe policy for the current frame.
+type Action int
+
+const (
+	// NoAction means the detection is reliable, so the faces are handled by the effect.
+	NoAction Action = iota
+	// RedactRegions redacts the predicted regions of the faces which could not be confirmed.
+	RedactRegions
+	// RedactFrame redacts the entire frame.
+	RedactFrame
+)
+
+// Policy holds the thresholds and the hold times of the fail-safe redaction.
+type Policy struct {
+	// ConfidentQuality is the detection quality above which a face is considered confirmed.
+	ConfidentQuality int
+	// UncertainQuality is the detection quality above which a detection is considered
+	// a possible face. The detections between the two thresholds make the frame uncertain.
+	UncertainQuality int
+	// RecentFrames is the number of frames a face is considered recently present after its last confirmation.
+	RecentFrames int
+	// RecoveryFrames is the number of consecutive certain frames required for leaving the fail-safe mode,
+	// i.e. frames with confirmed faces only, without uncertain detections or held tracks.
+	RecoveryFrames int
+	// MaxHoldFrames is the number of frames after which the fail-safe mode ends even without recovering.
+	// If it's zero, the fail-safe mode never expires, it ends only after recovering or resetting the engine.
+	MaxHoldFrames int
+	// Fallback is the redaction applied while the detection is uncertain.
+	Fallback Action
+}
+
+// Decision is the outcome of the policy evaluation for a frame.
+type Decision struct {
+	Action Action
+	// Regions holds the predicted face regions, in case of the RedactRegions action.
+	Regions []image.Rectangle
+}
+
+// DefaultPolicy returns the default fail-safe policy, which redacts the entire frame.
+func DefaultPolicy() Policy {
+	return Policy{
+		ConfidentQuality: 50,
+		UncertainQuality: 5,
+		RecentFrames:     30,
+		RecoveryFrames:   5,
+		MaxHoldFrames:    0, // never expires
+		Fallback:         RedactFrame,
+	}
+}
+
+// Engine evaluates the fail-safe policy frame by frame. When faces were recently present,
+// but the current frame is uncertain, it requires the redaction of the predicted face regions
+// or of the entire frame, until the detection recovers. The redaction is kept when the faces
+// are no longer detected, since a face gone undetected can't be told apart from a face which left.
+type Engine struct {
+	Policy
+
+	frame     int
+	lastSeen  int
+	seen      bool
+	recovered int
+	held      int // number of frames the fail-safe mode has been active for
+	active    bool
+}
+
+// NewEngine creates a new fail-safe policy engine.
+func NewEngine(p Policy) *Engine {
+	return &Engine{Policy: p}
+}
+
+// Active reports whether the fail-safe redaction is currently in effect.
+func (e *Engine) Active() bool {
+	return e.active
+}
+
+// Evaluate decides the redaction required for the current frame, using the raw detections
+// of the frame and the tracks updated with them.
+func (e *Engine) Evaluate(dets [][]int, tracks []*tracker.Track) Decision {
+	e.frame++
+
+	var regions []image.Rectangle
+	confident, uncertain := 0, 0
+	for _, det := range dets {
+		switch {
+		case det[3] > e.ConfidentQuality:
+			confident++
+		case det[3] > e.UncertainQuality:
+			uncertain++
+			regions = append(regions, tracker.DetRect(det))
+		}
+	}
+	held := 0
+	for _, tr := range tracks {
+		if tr.Held() {
+			held++
+			regions = append(regions, tr.Rect)
+		}
+	}
+	if confident > 0 {
+		e.lastSeen, e.seen = e.frame, true
+	}
+	recent := e.seen && e.frame-e.lastSeen <= e.RecentFrames
+	certain := confident > 0 && uncertain == 0 && held == 0
+
+	switch {
+	case e.active:
+		e.held++
+		if certain {
+			e.recovered++
+		} else {
+			e.recovered = 0
+		}
+		if e.recovered >= e.RecoveryFrames || (e.MaxHoldFrames > 0 && e.held >= e.MaxHoldFrames) {
+			e.active = false
+		}
+	case recent && !certain:
+		e.active, e.recovered, e.held = true, 0, 0
+	}
+
+	if !e.active {
+		return Decision{Action: NoAction}
+	}
+	// Without any predicted region, the only safe choice is to redact the entire frame.
+	if e.Fallback == RedactRegions && len(regions) > 0 {
+		return Decision{Action: RedactRegions, Regions: regions}
+	}
+	return Decision{Action: RedactFrame}
+}
+
+// Reset clears the state of the engine, ending the fail-safe mode.
+func (e *Engine) Reset() {
+	*e = Engine{Policy: e.Policy}
+}
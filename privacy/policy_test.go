@@ -0,0 +1,137 @@
+package privacy
+
+import (
+	"image"
+	"testing"
+
+	"github.com/esimov/pigo-wasm-demos/tracker"
+)
+
+// policyFrame is a frame evaluated by the policy engine, holding the quality of its detections.
+type policyFrame struct {
+	quality []int
+	held    bool // whether a track is held without a matching detection
+	want    Action
+}
+
+func (f policyFrame) input() ([][]int, []*tracker.Track) {
+	dets := make([][]int, len(f.quality))
+	for i, q := range f.quality {
+		dets[i] = []int{100, 100 + 80*i, 60, q}
+	}
+	var tracks []*tracker.Track
+	if f.held {
+		tracks = append(tracks, &tracker.Track{ID: 1, Rect: image.Rect(300, 70, 360, 130), Missed: 1})
+	}
+	return dets, tracks
+}
+
+func TestEngineEvaluate(t *testing.T) {
+	policy := Policy{
+		ConfidentQuality: 50,
+		UncertainQuality: 5,
+		RecentFrames:     3,
+		RecoveryFrames:   2,
+		Fallback:         RedactFrame,
+	}
+	expiring := policy
+	expiring.MaxHoldFrames = 3
+
+	cases := []struct {
+		name   string
+		policy Policy
+		frames []policyFrame
+	}{
+		{"face lost after the certain frames", policy, []policyFrame{
+			{[]int{80}, false, NoAction},
+			{[]int{80, 90}, false, NoAction},
+			{nil, false, RedactFrame},
+		}},
+		{"no face seen before", policy, []policyFrame{
+			{nil, false, NoAction},
+			{[]int{20}, false, NoAction},
+		}},
+		{"recovery after the confirm frames", policy, []policyFrame{
+			{[]int{80}, false, NoAction},
+			{[]int{20}, false, RedactFrame},
+			{[]int{80}, false, RedactFrame},
+			{[]int{80}, false, NoAction},
+		}},
+		{"uncertain frame restarts the recovery", policy, []policyFrame{
+			{[]int{80}, false, NoAction},
+			{nil, false, RedactFrame},
+			{[]int{80}, false, RedactFrame},
+			{[]int{80, 20}, false, RedactFrame},
+			{[]int{80}, false, RedactFrame},
+			{[]int{80}, false, NoAction},
+		}},
+		{"held track is uncertain", policy, []policyFrame{
+			{[]int{80}, false, NoAction},
+			{[]int{80}, true, RedactFrame},
+			{[]int{80}, true, RedactFrame},
+			{[]int{80}, false, RedactFrame},
+			{[]int{80}, false, NoAction},
+		}},
+		{"never expires", policy, []policyFrame{
+			{[]int{80}, false, NoAction},
+			{nil, false, RedactFrame},
+			{nil, false, RedactFrame},
+			{nil, false, RedactFrame},
+			{nil, false, RedactFrame},
+			{nil, false, RedactFrame},
+			{nil, false, RedactFrame},
+		}},
+		{"hold expiry", expiring, []policyFrame{
+			{[]int{80}, false, NoAction},
+			{nil, false, RedactFrame},
+			{nil, false, RedactFrame},
+			{nil, false, RedactFrame},
+			{nil, false, NoAction},
+			// The face is no longer recent, so the fail-safe mode is not restarted.
+			{nil, false, NoAction},
+		}},
+	}
+	for _, tc := range cases {
+		e := NewEngine(tc.policy)
+		for i, f := range tc.frames {
+			dets, tracks := f.input()
+			if got := e.Evaluate(dets, tracks); got.Action != f.want {
+				t.Fatalf("%s: frame #%d action %d, want %d", tc.name, i, got.Action, f.want)
+			}
+			if e.Active() != (f.want != NoAction) {
+				t.Fatalf("%s: frame #%d active %t", tc.name, i, e.Active())
+			}
+		}
+	}
+}
+
+func TestEngineRedactRegions(t *testing.T) {
+	policy := DefaultPolicy()
+	policy.Fallback = RedactRegions
+	e := NewEngine(policy)
+
+	e.Evaluate(policyFrame{quality: []int{80}}.input())
+	got := e.Evaluate(policyFrame{quality: []int{80, 20}, held: true}.input())
+	want := []image.Rectangle{
+		tracker.DetRect([]int{100, 180, 60, 20}),
+		image.Rect(300, 70, 360, 130),
+	}
+	if got.Action != RedactRegions || len(got.Regions) != len(want) {
+		t.Fatalf("got %+v, want the regions %v", got, want)
+	}
+	for i := range want {
+		if got.Regions[i] != want[i] {
+			t.Fatalf("region #%d is %v, want %v", i, got.Regions[i], want[i])
+		}
+	}
+
+	// Without any predicted region the entire frame is redacted.
+	if got := e.Evaluate(nil, nil); got.Action != RedactFrame {
+		t.Fatalf("action %d, want %d", got.Action, RedactFrame)
+	}
+
+	e.Reset()
+	if e.Active() {
+		t.Fatal("expected the engine to be inactive after reset")
+	}
+}
@@ -0,0 +1,233 @@
+package privacy
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+
+	"github.com/esimov/pigo-wasm-demos/noise"
+	"github.com/esimov/pigo-wasm-demos/tracker"
+)
+
+// Fill defines how the face regions are redacted.
+type Fill int
+
+const (
+	// Blocks replaces the face region with coarse blocks of its average colors, covered by noise.
+	Blocks Fill = iota
+	// Solid fills the face region with a solid color.
+	Solid
+)
+
+// The minimum strength enforced regardless of the configuration, so the redaction cannot be reversed.
+const (
+	minBlockRatio = 1.0 / 6
+	minBlockSize  = 6
+	minNoiseLevel = 24
+	minPadding    = 0.2
+	minHoldFrames = 5
+)
+
+// frameFaceRatio is the face scale relative to the frame width assumed when redacting the entire frame.
+const frameFaceRatio = 0.25
+
+// heldPadding is the additional padding per missed frame of a held track, since the face might have moved.
+const heldPadding = 0.05
+
+// Config holds the parameters of the privacy mode.
+type Config struct {
+	Fill Fill
+	// BlockRatio is the size of the blocks relative to the face scale.
+	BlockRatio float64
+	// NoiseLevel is the amount of noise added over the blocks, expressed in 8-bit color levels.
+	NoiseLevel float64
+	// Padding enlarges the face region on each side, relative to the face scale.
+	Padding float64
+	// Color is the color used by the Solid fill.
+	Color color.NRGBA
+	// HoldFrames is the number of frames the mask is held on a tracked face after a missed detection.
+	HoldFrames int
+	// MinQuality is the minimum detection quality of the faces.
+	MinQuality int
+}
+
+// DefaultConfig returns the default parameters of the privacy mode.
+func DefaultConfig() Config {
+	return Config{
+		Fill:       Blocks,
+		BlockRatio: minBlockRatio,
+		NoiseLevel: 32,
+		Padding:    0.25,
+		Color:      color.NRGBA{R: 0x20, G: 0x20, B: 0x20, A: 0xff},
+		HoldFrames: 15,
+		MinQuality: 30,
+	}
+}
+
+// Enforce returns the configuration with the parameters raised to their minimum strength.
+func (cfg Config) Enforce() Config {
+	if cfg.BlockRatio < minBlockRatio {
+		cfg.BlockRatio = minBlockRatio
+	}
+	if cfg.NoiseLevel < minNoiseLevel {
+		cfg.NoiseLevel = minNoiseLevel
+	}
+	if cfg.Padding < minPadding {
+		cfg.Padding = minPadding
+	}
+	if cfg.HoldFrames < minHoldFrames {
+		cfg.HoldFrames = minHoldFrames
+	}
+	return cfg
+}
+
+// Redactor irreversibly redacts the faces tracked across the frames.
+type Redactor struct {
+	Config
+	Tracker *tracker.Tracker
+	Noise   *noise.Generator
+}
+
+// NewRedactor creates a new redactor with the provided configuration.
+func NewRedactor(cfg Config) *Redactor {
+	cfg = cfg.Enforce()
+	return &Redactor{
+		Config:  cfg,
+		Tracker: tracker.NewTracker(0.1, cfg.HoldFrames),
+		Noise:   noise.NewGenerator(1, noise.Chroma),
+	}
+}
+
+// Process tracks the detected faces and redacts the padded region of each active track
+// in the RGBA frame buffer of the provided width. It returns the active tracks.
+func (r *Redactor) Process(pix []uint8, width int, dets [][]int) []*tracker.Track {
+	tracks := r.Track(dets)
+	r.RedactTracks(pix, width, tracks)
+	return tracks
+}
+
+// Summary describes the coverage report of the tracked faces,
+// listing the frames in which the faces could not be confirmed covered.
+func (r *Redactor) Summary() string {
+	rep := r.Tracker.Report()
+	return fmt.Sprintf("Privacy report: %d frames, %d confirmed, %d tracks dropped, unconfirmed frames: %v",
+		rep.Frames, rep.Confirmed, rep.Dropped, rep.Unconfirmed)
+}
+
+// Track updates the tracker with the detections exceeding the minimum quality and returns the active tracks.
+func (r *Redactor) Track(dets [][]int) []*tracker.Track {
+	cfg := r.Config.Enforce()
+	r.Tracker.MaxMissed = cfg.HoldFrames
+
+	faces := make([][]int, 0, len(dets))
+	for _, det := range dets {
+		if det[3] > cfg.MinQuality {
+			faces = append(faces, det)
+		}
+	}
+	r.Noise.NextFrame()
+	return r.Tracker.Update(faces)
+}
+
+// RedactTracks redacts the padded region of each track in the RGBA frame buffer of the provided width.
+func (r *Redactor) RedactTracks(pix []uint8, width int, tracks []*tracker.Track) {
+	cfg := r.Config.Enforce()
+	bounds := image.Rect(0, 0, width, len(pix)/4/width)
+	for _, tr := range tracks {
+		scale := max(tr.Rect.Dx(), tr.Rect.Dy())
+		padding := cfg.Padding + heldPadding*float64(tr.Missed)
+		Redact(pix, width, Region(tr.Rect, padding, bounds), scale, cfg, r.Noise)
+	}
+}
+
+// RedactRegions redacts the padded face regions in the RGBA frame buffer of the provided width.
+func (r *Redactor) RedactRegions(pix []uint8, width int, regions []image.Rectangle) {
+	cfg := r.Config.Enforce()
+	bounds := image.Rect(0, 0, width, len(pix)/4/width)
+	for _, rect := range regions {
+		scale := max(rect.Dx(), rect.Dy())
+		Redact(pix, width, Region(rect, cfg.Padding, bounds), scale, cfg, r.Noise)
+	}
+}
+
+// RedactFrame redacts the entire RGBA frame buffer of the provided width.
+// The block size is derived from the size of a face filling frameFaceRatio of the frame width.
+func (r *Redactor) RedactFrame(pix []uint8, width int) {
+	cfg := r.Config.Enforce()
+	bounds := image.Rect(0, 0, width, len(pix)/4/width)
+	Redact(pix, width, bounds, int(float64(width)*frameFaceRatio), cfg, r.Noise)
+}
+
+// Region pads the face rectangle on each side and clips it to the frame bounds.
+func Region(rect image.Rectangle, padding float64, bounds image.Rectangle) image.Rectangle {
+	pad := int(float64(max(rect.Dx(), rect.Dy())) * padding)
+	return rect.Inset(-pad).Intersect(bounds)
+}
+
+// Redact replaces the region of the RGBA frame buffer with the configured fill.
+// The Blocks fill keeps only the average color of each block, then covers it with noise.
+// The block size is proportional to the face scale, so it does not depend on the padding.
+func Redact(pix []uint8, width int, region image.Rectangle, scale int, cfg Config, gen *noise.Generator) {
+	if region.Empty() {
+		return
+	}
+	if cfg.Fill == Solid {
+		for y := region.Min.Y; y < region.Max.Y; y++ {
+			for x := region.Min.X; x < region.Max.X; x++ {
+				i := (y*width + x) * 4
+				pix[i], pix[i+1], pix[i+2], pix[i+3] = cfg.Color.R, cfg.Color.G, cfg.Color.B, 0xff
+			}
+		}
+		return
+	}
+
+	block := max(minBlockSize, int(float64(scale)*cfg.BlockRatio))
+	for by := region.Min.Y; by < region.Max.Y; by += block {
+		for bx := region.Min.X; bx < region.Max.X; bx += block {
+			cell := image.Rect(bx, by, bx+block, by+block).Intersect(region)
+
+			var r, g, b, n int
+			for y := cell.Min.Y; y < cell.Max.Y; y++ {
+				for x := cell.Min.X; x < cell.Max.X; x++ {
+					i := (y*width + x) * 4
+					r += int(pix[i])
+					g += int(pix[i+1])
+					b += int(pix[i+2])
+					n++
+				}
+			}
+			r, g, b = r/n, g/n, b/n
+			luma := (0.2126*float64(r) + 0.7152*float64(g) + 0.0722*float64(b)) / 255
+
+			for y := cell.Min.Y; y < cell.Max.Y; y++ {
+				for x := cell.Min.X; x < cell.Max.X; x++ {
+					i := (y*width + x) * 4
+					dr, dg, db := gen.Sample(x, y, luma)
+					pix[i] = clamp(float64(r) + dr*cfg.NoiseLevel)
+					pix[i+1] = clamp(float64(g) + dg*cfg.NoiseLevel)
+					pix[i+2] = clamp(float64(b) + db*cfg.NoiseLevel)
+					pix[i+3] = 0xff
+				}
+			}
+		}
+	}
+}
+
+// max returns the biggest of the two values.
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// clamp rounds the value and restricts it to the 8-bit range.
+func clamp(v float64) uint8 {
+	if v <= 0 {
+		return 0
+	}
+	if v >= 0xff {
+		return 0xff
+	}
+	return uint8(v + 0.5)
+}
@@ -0,0 +1,79 @@
+package privacy
+
+import (
+	"image"
+	"testing"
+
+	"github.com/esimov/pigo-wasm-demos/noise"
+)
+
+// gradientFrame returns an RGBA frame buffer having a different color in every pixel.
+func gradientFrame(w, h int) []uint8 {
+	pix := make([]uint8, w*h*4)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			i := (y*w + x) * 4
+			pix[i], pix[i+1], pix[i+2], pix[i+3] = uint8(x*3), uint8(y*3), 0x80, 0xff
+		}
+	}
+	return pix
+}
+
+func TestNewRedactorEnforcesMinimums(t *testing.T) {
+	r := NewRedactor(Config{Fill: Blocks, BlockRatio: 0.01, NoiseLevel: 1, Padding: 0, HoldFrames: 1})
+	if r.BlockRatio != minBlockRatio || r.NoiseLevel != minNoiseLevel || r.Padding != minPadding || r.HoldFrames != minHoldFrames {
+		t.Fatalf("got %+v, want the minimum strength", r.Config)
+	}
+	if r.Tracker.MaxMissed != minHoldFrames {
+		t.Fatalf("tracker holds %d frames, want %d", r.Tracker.MaxMissed, minHoldFrames)
+	}
+
+	// The parameters lowered after creating the redactor are enforced too.
+	r.HoldFrames = 0
+	r.Track(nil)
+	if r.Tracker.MaxMissed != minHoldFrames {
+		t.Fatalf("tracker holds %d frames, want %d", r.Tracker.MaxMissed, minHoldFrames)
+	}
+}
+
+func TestRedactBlockSize(t *testing.T) {
+	const width, height = 80, 80
+	region := image.Rect(3, 5, 75, 77)
+
+	cases := []struct {
+		scale int
+		ratio float64
+		want  int
+	}{
+		{12, 0, minBlockSize},
+		{30, minBlockRatio, minBlockSize},
+		{48, minBlockRatio, 8},
+		{120, minBlockRatio, 20},
+	}
+	for _, tc := range cases {
+		pix := gradientFrame(width, height)
+		// Without noise every block is filled with its average color.
+		cfg := Config{Fill: Blocks, BlockRatio: tc.ratio}
+		Redact(pix, width, region, tc.scale, cfg, noise.NewGenerator(1, noise.Chroma))
+
+		for y := region.Min.Y; y < region.Max.Y; y++ {
+			for x := region.Min.X; x < region.Max.X; x++ {
+				bx := region.Min.X + (x-region.Min.X)/tc.want*tc.want
+				by := region.Min.Y + (y-region.Min.Y)/tc.want*tc.want
+				i, j := (y*width+x)*4, (by*width+bx)*4
+				if pix[i] != pix[j] || pix[i+1] != pix[j+1] || pix[i+2] != pix[j+2] {
+					t.Fatalf("scale %d: pixel (%d, %d) differs from its block at (%d, %d)", tc.scale, x, y, bx, by)
+				}
+			}
+		}
+		// The neighboring blocks have different colors, so the blocks are not bigger than expected.
+		i, j := (region.Min.Y*width+region.Min.X)*4, (region.Min.Y*width+region.Min.X+tc.want)*4
+		if pix[i] == pix[j] {
+			t.Fatalf("scale %d: expected the blocks of %d pixels", tc.scale, tc.want)
+		}
+		// The pixels outside the region are kept.
+		if orig := gradientFrame(width, height); pix[0] != orig[0] || pix[len(pix)-4] != orig[len(orig)-4] {
+			t.Fatalf("scale %d: the pixels outside the region were changed", tc.scale)
+		}
+	}
+}
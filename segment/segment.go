@@ -0,0 +1,289 @@
+package segment
+
+import (
+	"image"
+	"math"
+
+	"github.com/esimov/pigo-wasm-demos/mask"
+	"github.com/esimov/pigo-wasm-demos/pixels"
+)
+
+// silhouette is a canonical head and shoulders outline, expressed in the coordinate system of the face box:
+// the origin is the center of the face box, the y axis points downward and the unit is the face box size.
+// The points below the neck are not rotated with the head, the last ones extending below the frame.
+var silhouette = [][2]float64{
+	{0, -0.8},
+	{0.3, -0.75}, {0.5, -0.58}, {0.6, -0.3}, {0.6, 0.05}, {0.5, 0.38}, {0.34, 0.6},
+	{0.3, 0.8}, {0.6, 0.95}, {1.1, 1.08}, {1.45, 1.3}, {1.62, 1.75}, {1.7, 40},
+	{-1.7, 40}, {-1.62, 1.75}, {-1.45, 1.3}, {-1.1, 1.08}, {-0.6, 0.95}, {-0.3, 0.8},
+	{-0.34, 0.6}, {-0.5, 0.38}, {-0.6, 0.05}, {-0.6, -0.3}, {-0.5, -0.58}, {-0.3, -0.75},
+}
+
+// neckLine is the vertical position in the face box coordinate system, below which the silhouette is not rotated.
+const neckLine = 0.7
+
+// histBits is the number of bits per color channel used for indexing the color histograms.
+const histBits = 4
+
+// Face holds the detected face used for placing the silhouette.
+type Face struct {
+	// Center is the center of the face box.
+	Center mask.Point
+	// Scale is the size of the face box.
+	Scale float64
+	// Angle is the roll angle of the head in radians, measured on the line between the pupils.
+	Angle float64
+	// Contour is the optional face contour fitted over the facial landmarks, which is always kept in the foreground.
+	Contour []mask.Point
+}
+
+// Config holds the parameters of the segmentation.
+type Config struct {
+	// Downscale is the factor by which the frame is downscaled before the segmentation.
+	Downscale int
+	// Band is the width of the uncertain band around the warped silhouette, relative to the face scale.
+	// Only the pixels of this band are reclassified by the color refinement.
+	Band float64
+	// Iterations is the number of color model refinement iterations.
+	Iterations int
+	// EdgeSigma is the color difference at which the smoothing of the matte stops at the image edges.
+	EdgeSigma float64
+	// Temporal is the weight of the previous matte in the exponential moving average of the mattes.
+	Temporal float64
+}
+
+// DefaultConfig returns the default parameters of the segmentation.
+func DefaultConfig() Config {
+	return Config{
+		Downscale:  4,
+		Band:       0.25,
+		Iterations: 3,
+		EdgeSigma:  24,
+		Temporal:   0.6,
+	}
+}
+
+// Segmenter estimates the soft alpha matte of the persons in the frame. The head and shoulders silhouette
+// is warped over each face, then the pixels close to its outline are reclassified by iteratively refined
+// foreground and background color models, like in GrabCut. The matte is smoothed along the image edges
+// and over time, so that it does not flicker between the frames.
+type Segmenter struct {
+	Config
+
+	w, h   int
+	small  []float64 // downscaled RGB frame
+	prior  []float64 // warped silhouette
+	alpha  []float64 // refined matte
+	prev   []float64 // matte of the previous frame
+	tmp    []float64
+	edges  []float64 // smoothing weights of the 3x3 neighborhood of each pixel
+	fgHist []float64
+	bgHist []float64
+	shape  *image.Alpha
+	matte  *image.Alpha
+}
+
+// NewSegmenter creates a new segmenter with the provided configuration.
+func NewSegmenter(cfg Config) *Segmenter {
+	if cfg.Downscale < 1 {
+		cfg.Downscale = 1
+	}
+	return &Segmenter{
+		Config: cfg,
+		fgHist: make([]float64, 1<<(3*histBits)),
+		bgHist: make([]float64, 1<<(3*histBits)),
+	}
+}
+
+// Segment returns the alpha matte of the persons in the RGBA frame buffer of the provided size.
+// The returned matte is reused by the next Segment call.
+func (s *Segmenter) Segment(pix []uint8, width, height int, faces []Face) *image.Alpha {
+	s.init(width, height)
+	pixels.Downscale(s.small, pix, width, height, s.Downscale)
+	s.warp(faces)
+	s.edgeWeights()
+
+	copy(s.alpha, s.prior)
+	for i := 0; i < s.Iterations; i++ {
+		s.refine()
+		s.smooth()
+	}
+	if len(faces) > 0 {
+		s.keepFaces(faces)
+	}
+
+	if s.prev != nil {
+		for i, a := range s.alpha {
+			s.alpha[i] = s.prev[i]*s.Temporal + a*(1-s.Temporal)
+		}
+	} else {
+		s.prev = make([]float64, len(s.alpha))
+	}
+	copy(s.prev, s.alpha)
+
+	pixels.UpscaleAlpha(s.matte, s.alpha, s.w, s.h, s.Downscale)
+	return s.matte
+}
+
+// Reset discards the matte of the previous frame.
+func (s *Segmenter) Reset() {
+	s.prev = nil
+}
+
+// init allocates the buffers for the frame size, keeping the ones allocated for the previous frame of the same size.
+func (s *Segmenter) init(width, height int) {
+	w, h := pixels.ScaledSize(width, height, s.Downscale)
+	if w == s.w && h == s.h {
+		return
+	}
+	s.w, s.h = w, h
+	s.small = make([]float64, w*h*3)
+	s.prior = make([]float64, w*h)
+	s.alpha = make([]float64, w*h)
+	s.tmp = make([]float64, w*h)
+	s.edges = make([]float64, w*h*9)
+	s.prev = nil
+	s.shape = image.NewAlpha(image.Rect(0, 0, w, h))
+	s.matte = image.NewAlpha(image.Rect(0, 0, width, height))
+}
+
+// warp places the silhouette over each face, feathered by the width of the uncertain band.
+func (s *Segmenter) warp(faces []Face) {
+	for i := range s.prior {
+		s.prior[i] = 0
+	}
+	d := float64(s.Downscale)
+	for _, f := range faces {
+		sin, cos := math.Sincos(f.Angle)
+		poly := make([]mask.Point, len(silhouette))
+		for i, p := range silhouette {
+			x, y := p[0], p[1]
+			if y < neckLine {
+				x, y = x*cos-y*sin, x*sin+y*cos
+			}
+			poly[i] = mask.Point{
+				X: (f.Center.X + x*f.Scale) / d,
+				Y: (f.Center.Y + y*f.Scale) / d,
+			}
+		}
+		// The box blur applied twice spreads the outline over about four times its radius.
+		feather := int(f.Scale * s.Band / d / 4)
+		mask.Fill(s.shape, poly, feather)
+		for i, v := range s.shape.Pix {
+			if a := float64(v) / 255; a > s.prior[i] {
+				s.prior[i] = a
+			}
+		}
+	}
+}
+
+// refine reclassifies the uncertain pixels by the likelihood of their color in the foreground
+// and background color models, which are rebuilt from the current matte on each iteration.
+func (s *Segmenter) refine() {
+	for i := range s.fgHist {
+		s.fgHist[i], s.bgHist[i] = 1, 1
+	}
+	var fgSum, bgSum float64
+	for i, a := range s.alpha {
+		bin := s.bin(i)
+		s.fgHist[bin] += a
+		s.bgHist[bin] += 1 - a
+		fgSum += a
+		bgSum += 1 - a
+	}
+	if fgSum == 0 || bgSum == 0 {
+		return
+	}
+	bins := float64(len(s.fgHist))
+	fgSum += bins
+	bgSum += bins
+
+	for i, p := range s.prior {
+		// The pixels far from the silhouette outline keep their prior label.
+		if p <= 0.02 || p >= 0.98 {
+			s.alpha[i] = p
+			continue
+		}
+		bin := s.bin(i)
+		fg := s.fgHist[bin] / fgSum * p
+		bg := s.bgHist[bin] / bgSum * (1 - p)
+		s.alpha[i] = fg / (fg + bg)
+	}
+}
+
+// bin returns the color histogram bin of the downscaled pixel.
+func (s *Segmenter) bin(i int) int {
+	const shift = 8 - histBits
+	c := s.small[i*3 : i*3+3]
+	return int(c[0])>>shift<<(2*histBits) | int(c[1])>>shift<<histBits | int(c[2])>>shift
+}
+
+// edgeWeights computes the smoothing weights between each pixel and its neighbors,
+// which are decreasing with the color difference, so that the smoothing stops at the edges.
+func (s *Segmenter) edgeWeights() {
+	sigma := 2 * s.EdgeSigma * s.EdgeSigma
+	for y := 0; y < s.h; y++ {
+		for x := 0; x < s.w; x++ {
+			i := y*s.w + x
+			c := s.small[i*3 : i*3+3]
+			k := i * 9
+			for ny := y - 1; ny <= y+1; ny++ {
+				for nx := x - 1; nx <= x+1; nx++ {
+					if nx < 0 || ny < 0 || nx >= s.w || ny >= s.h {
+						s.edges[k] = 0
+						k++
+						continue
+					}
+					j := ny*s.w + nx
+					nc := s.small[j*3 : j*3+3]
+					dr, dg, db := c[0]-nc[0], c[1]-nc[1], c[2]-nc[2]
+					s.edges[k] = math.Exp(-(dr*dr + dg*dg + db*db) / sigma)
+					k++
+				}
+			}
+		}
+	}
+}
+
+// smooth averages the matte over the neighboring pixels having a similar color, so that
+// the isolated misclassified pixels are removed, while the edges of the image are kept.
+func (s *Segmenter) smooth() {
+	for y := 0; y < s.h; y++ {
+		for x := 0; x < s.w; x++ {
+			i := y*s.w + x
+			k := i * 9
+			var sum, weights float64
+			for ny := y - 1; ny <= y+1; ny++ {
+				for nx := x - 1; nx <= x+1; nx++ {
+					if wt := s.edges[k]; wt > 0 {
+						sum += s.alpha[ny*s.w+nx] * wt
+						weights += wt
+					}
+					k++
+				}
+			}
+			s.tmp[i] = sum / weights
+		}
+	}
+	s.alpha, s.tmp = s.tmp, s.alpha
+}
+
+// keepFaces marks the face contours as foreground, since they are known to belong to the persons.
+func (s *Segmenter) keepFaces(faces []Face) {
+	d := float64(s.Downscale)
+	for _, f := range faces {
+		if len(f.Contour) < 3 {
+			continue
+		}
+		poly := make([]mask.Point, len(f.Contour))
+		for i, p := range f.Contour {
+			poly[i] = mask.Point{X: p.X / d, Y: p.Y / d}
+		}
+		mask.Fill(s.shape, poly, 0)
+		for i, v := range s.shape.Pix {
+			if a := float64(v) / 255; a > s.alpha[i] {
+				s.alpha[i] = a
+			}
+		}
+	}
+}
@@ -0,0 +1,77 @@
+//go:build js && wasm
+
+package selection
+
+import (
+	"image"
+	"syscall/js"
+)
+
+// Expose registers the selection as a global Javascript object with the provided name, with the following methods:
+//
+//	mode([name])        returns the selection mode, after changing it if a name ("all", "exempt" or "target") is provided
+//	mark(id)            marks the face with the track identifier
+//	mark(x, y, w, h)    marks the faces having their center inside the rectangle
+//	unmark(id)          removes the mark of the face with the track identifier, even if it was marked by a region
+//	clear()             removes all the marks
+//	marked()            returns the identifiers of the marked faces
+//	faces()             returns the tracked faces as {id, x, y, width, height, marked, applied} objects
+func (s *Selection) Expose(name string) {
+	api := js.Global().Get("Object").New()
+
+	api.Set("mode", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		if len(args) > 0 {
+			m, ok := ParseMode(args[0].String())
+			if !ok {
+				return js.Global().Get("Error").New("unknown selection mode: " + args[0].String())
+			}
+			s.SetMode(m)
+		}
+		return s.Mode().String()
+	}))
+	api.Set("mark", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		switch len(args) {
+		case 1:
+			s.Mark(args[0].Int())
+		case 4:
+			x, y := args[0].Int(), args[1].Int()
+			s.MarkRegion(image.Rect(x, y, x+args[2].Int(), y+args[3].Int()))
+		}
+		return nil
+	}))
+	api.Set("unmark", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		if len(args) > 0 {
+			s.Unmark(args[0].Int())
+		}
+		return nil
+	}))
+	api.Set("clear", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		s.Clear()
+		return nil
+	}))
+	api.Set("marked", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		ids := s.Marked()
+		arr := make([]interface{}, len(ids))
+		for i, id := range ids {
+			arr[i] = id
+		}
+		return arr
+	}))
+	api.Set("faces", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		tracks := s.Tracks()
+		arr := make([]interface{}, len(tracks))
+		for i, tr := range tracks {
+			arr[i] = map[string]interface{}{
+				"id":      tr.ID,
+				"x":       tr.Rect.Min.X,
+				"y":       tr.Rect.Min.Y,
+				"width":   tr.Rect.Dx(),
+				"height":  tr.Rect.Dy(),
+				"marked":  s.IsMarked(tr),
+				"applied": s.Applies(tr),
+			}
+		}
+		return arr
+	}))
+	js.Global().Set(name, api)
+}
@@ -0,0 +1,56 @@
+//go:build js && wasm
+
+package selection
+
+import (
+	"fmt"
+	"image"
+	"syscall/js"
+
+	"github.com/esimov/pigo-wasm-demos/tracker"
+)
+
+// Draw labels the tracked faces with their identifiers over the canvas context and outlines
+// the marked ones, unless the effect is applied to every face.
+func (s *Selection) Draw(ctx js.Value, tracks []*tracker.Track) {
+	if s.Mode() == All {
+		return
+	}
+	ctx.Set("font", "14px sans-serif")
+	for _, tr := range tracks {
+		if s.IsMarked(tr) {
+			ctx.Call("beginPath")
+			ctx.Set("lineWidth", 2)
+			ctx.Set("strokeStyle", "rgba(0, 200, 255, 0.8)")
+			ctx.Call("setLineDash", []interface{}{6, 4})
+			ctx.Call("rect", tr.Rect.Min.X, tr.Rect.Min.Y, tr.Rect.Dx(), tr.Rect.Dy())
+			ctx.Call("stroke")
+			ctx.Call("setLineDash", []interface{}{})
+		}
+		ctx.Set("fillStyle", "rgba(0, 200, 255, 0.9)")
+		ctx.Call("fillText", fmt.Sprintf("#%d", tr.ID), tr.Rect.Min.X, tr.Rect.Min.Y-4)
+	}
+}
+
+// ListenClicks listens for the click events of the canvas and toggles the mark of the face under the pointer.
+// If every face is affected, the first click switches to exempting the marked faces.
+// The toggled function, if it's not nil, receives the track of each toggled face.
+func (s *Selection) ListenClicks(canvas js.Value, toggled func(*tracker.Track)) {
+	clickEventHandler := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		// Convert the pointer position to canvas coordinates, since the canvas might be scaled by CSS.
+		rect := canvas.Call("getBoundingClientRect")
+		x := (args[0].Get("clientX").Float() - rect.Get("left").Float()) * canvas.Get("width").Float() / rect.Get("width").Float()
+		y := (args[0].Get("clientY").Float() - rect.Get("top").Float()) * canvas.Get("height").Float() / rect.Get("height").Float()
+
+		if tr := s.Toggle(image.Pt(int(x), int(y))); tr != nil {
+			if s.Mode() == All {
+				s.SetMode(Exempt)
+			}
+			if toggled != nil {
+				toggled(tr)
+			}
+		}
+		return nil
+	})
+	canvas.Call("addEventListener", "click", clickEventHandler)
+}
@@ -0,0 +1,259 @@
+package selection
+
+import (
+	"image"
+	"sort"
+	"sync"
+
+	"github.com/esimov/pigo-wasm-demos/tracker"
+)
+
+// Mode defines which faces the effect is applied to.
+type Mode int
+
+const (
+	// All applies the effect to every face, ignoring the marked ones.
+	All Mode = iota
+	// Exempt applies the effect to every face, except the marked ones.
+	Exempt
+	// Target applies the effect only to the marked faces.
+	Target
+
+	// Modes is the number of the selection modes.
+	Modes = iota
+)
+
+// String returns the name of the selection mode.
+func (m Mode) String() string {
+	switch m {
+	case Exempt:
+		return "exempt"
+	case Target:
+		return "target"
+	default:
+		return "all"
+	}
+}
+
+// ParseMode returns the selection mode with the provided name.
+func ParseMode(name string) (Mode, bool) {
+	for m := All; m < Modes; m++ {
+		if m.String() == name {
+			return m, true
+		}
+	}
+	return All, false
+}
+
+// Selection marks the tracked faces either by their track identifier, or by a region
+// of the frame containing the face center. Since the track identifiers persist between
+// the frames, a face marked once remains marked for as long as it's tracked.
+// A face unmarked by its identifier stays unmarked even if its center is inside a marked region.
+// The selection can be accessed concurrently by the render loop and the event handlers.
+type Selection struct {
+	mu   sync.Mutex
+	mode Mode
+	// ids holds the faces marked (true) or unmarked (false) by their track identifier,
+	// which take precedence over the regions.
+	ids     map[int]bool
+	regions []image.Rectangle
+	tracks  []*tracker.Track
+}
+
+// New creates a new, empty selection applying the effect to every face.
+func New() *Selection {
+	return &Selection{
+		ids: make(map[int]bool),
+	}
+}
+
+// Mode returns the selection mode.
+func (s *Selection) Mode() Mode {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.mode
+}
+
+// SetMode changes the selection mode, keeping the marked faces.
+func (s *Selection) SetMode(m Mode) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.mode = m
+}
+
+// Mark marks the face with the provided track identifier.
+func (s *Selection) Mark(id int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.ids[id] = true
+}
+
+// Unmark removes the mark of the face with the provided track identifier,
+// including the mark of the regions containing the face.
+func (s *Selection) Unmark(id int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.ids[id] = false
+}
+
+// MarkRegion marks every face having its center inside the region.
+func (s *Selection) MarkRegion(r image.Rectangle) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if r = r.Canon(); !r.Empty() {
+		s.regions = append(s.regions, r)
+	}
+}
+
+// Clear removes all the marks.
+func (s *Selection) Clear() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.ids = make(map[int]bool)
+	s.regions = nil
+}
+
+// Marked returns the sorted identifiers of the faces marked by their track identifier.
+func (s *Selection) Marked() []int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ids := make([]int, 0, len(s.ids))
+	for id, marked := range s.ids {
+		if marked {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// Update stores the active tracks of the current frame, used for locating the face under a point.
+// The marks of the faces no longer tracked are removed, since their identifiers are never reused.
+func (s *Selection) Update(tracks []*tracker.Track) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.tracks = append(s.tracks[:0], tracks...)
+	for id := range s.ids {
+		if !s.tracked(id) {
+			delete(s.ids, id)
+		}
+	}
+}
+
+// tracked reports whether the face with the provided identifier is among the active tracks.
+func (s *Selection) tracked(id int) bool {
+	for _, tr := range s.tracks {
+		if tr.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// Tracks returns the active tracks of the current frame.
+func (s *Selection) Tracks() []*tracker.Track {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]*tracker.Track(nil), s.tracks...)
+}
+
+// Toggle toggles the mark of the face located under the point and returns its track.
+// If there is no face under the point, it returns nil. If the point is covered by
+// overlapping faces, the smallest one is selected, being the closest to the point.
+func (s *Selection) Toggle(p image.Point) *tracker.Track {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var hit *tracker.Track
+	for _, tr := range s.tracks {
+		if !p.In(tr.Rect) {
+			continue
+		}
+		if hit == nil || tr.Rect.Dx()*tr.Rect.Dy() < hit.Rect.Dx()*hit.Rect.Dy() {
+			hit = tr
+		}
+	}
+	if hit == nil {
+		return nil
+	}
+	s.ids[hit.ID] = !s.isMarked(hit)
+	return hit
+}
+
+// IsMarked reports whether the track is marked, either by its identifier or by a region.
+func (s *Selection) IsMarked(tr *tracker.Track) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.isMarked(tr)
+}
+
+func (s *Selection) isMarked(tr *tracker.Track) bool {
+	if marked, ok := s.ids[tr.ID]; ok {
+		return marked
+	}
+	center := image.Pt((tr.Rect.Min.X+tr.Rect.Max.X)/2, (tr.Rect.Min.Y+tr.Rect.Max.Y)/2)
+	for _, r := range s.regions {
+		if center.In(r) {
+			return true
+		}
+	}
+	return false
+}
+
+// Applies reports whether the effect should be applied to the tracked face.
+func (s *Selection) Applies(tr *tracker.Track) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.applies(tr)
+}
+
+func (s *Selection) applies(tr *tracker.Track) bool {
+	switch s.mode {
+	case Exempt:
+		return !s.isMarked(tr)
+	case Target:
+		return s.isMarked(tr)
+	default:
+		return true
+	}
+}
+
+// Filter returns the tracks the effect should be applied to.
+func (s *Selection) Filter(tracks []*tracker.Track) []*tracker.Track {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	selected := make([]*tracker.Track, 0, len(tracks))
+	for _, tr := range tracks {
+		if s.applies(tr) {
+			selected = append(selected, tr)
+		}
+	}
+	return selected
+}
+
+// Dets returns the detections of the tracks the effect should be applied to.
+// The held tracks are skipped, since their faces were not detected in the current frame.
+func (s *Selection) Dets(tracks []*tracker.Track) [][]int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	dets := make([][]int, 0, len(tracks))
+	for _, tr := range tracks {
+		if !tr.Held() && s.applies(tr) {
+			dets = append(dets, tr.Det)
+		}
+	}
+	return dets
+}
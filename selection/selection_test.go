@@ -0,0 +1,142 @@
+package selection
+
+import (
+	"image"
+	"testing"
+
+	"github.com/esimov/pigo-wasm-demos/tracker"
+)
+
+func TestSelectionPrecedence(t *testing.T) {
+	// The center of the face is at (120, 120).
+	face := &tracker.Track{ID: 7, Rect: image.Rect(100, 100, 140, 140)}
+	region := image.Rect(0, 0, 200, 200)
+	elsewhere := image.Rect(300, 300, 400, 400)
+
+	cases := []struct {
+		name  string
+		setup func(s *Selection)
+		want  bool
+	}{
+		{"not marked", func(s *Selection) {}, false},
+		{"marked by identifier", func(s *Selection) { s.Mark(7) }, true},
+		{"other identifier marked", func(s *Selection) { s.Mark(8) }, false},
+		{"marked by region", func(s *Selection) { s.MarkRegion(region) }, true},
+		{"marked by reversed region", func(s *Selection) { s.MarkRegion(image.Rectangle{region.Max, region.Min}) }, true},
+		{"region not containing the center", func(s *Selection) { s.MarkRegion(elsewhere) }, false},
+		{"unmarked identifier overrides the region", func(s *Selection) {
+			s.MarkRegion(region)
+			s.Unmark(7)
+		}, false},
+		{"unmarked identifier overrides a later region", func(s *Selection) {
+			s.Unmark(7)
+			s.MarkRegion(region)
+		}, false},
+		{"marked again after unmarking", func(s *Selection) {
+			s.MarkRegion(region)
+			s.Unmark(7)
+			s.Mark(7)
+		}, true},
+		{"cleared", func(s *Selection) {
+			s.Mark(7)
+			s.MarkRegion(region)
+			s.Clear()
+		}, false},
+	}
+	for _, tc := range cases {
+		s := New()
+		tc.setup(s)
+		if got := s.IsMarked(face); got != tc.want {
+			t.Fatalf("%s: marked %t, want %t", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestSelectionToggle(t *testing.T) {
+	s := New()
+	big := &tracker.Track{ID: 1, Rect: image.Rect(0, 0, 100, 100)}
+	small := &tracker.Track{ID: 2, Rect: image.Rect(40, 40, 60, 60)}
+	s.Update([]*tracker.Track{big, small})
+	s.MarkRegion(image.Rect(0, 0, 200, 200))
+
+	// The smallest of the overlapping faces is toggled, unmarking the face marked by the region.
+	if tr := s.Toggle(image.Pt(50, 50)); tr != small {
+		t.Fatalf("toggled %v, want the track %d", tr, small.ID)
+	}
+	if s.IsMarked(small) || !s.IsMarked(big) {
+		t.Fatalf("got the marks %t and %t, want only the big face marked", s.IsMarked(big), s.IsMarked(small))
+	}
+	if tr := s.Toggle(image.Pt(50, 50)); tr != small || !s.IsMarked(small) {
+		t.Fatal("expected the face to be marked again")
+	}
+	if tr := s.Toggle(image.Pt(150, 150)); tr != nil {
+		t.Fatalf("toggled %v, want no face", tr)
+	}
+}
+
+func TestSelectionModes(t *testing.T) {
+	marked := &tracker.Track{ID: 1, Rect: image.Rect(0, 0, 40, 40), Det: []int{20, 20, 40, 100}}
+	other := &tracker.Track{ID: 2, Rect: image.Rect(100, 0, 140, 40), Det: []int{20, 120, 40, 100}}
+	held := &tracker.Track{ID: 3, Rect: image.Rect(200, 0, 240, 40), Det: []int{20, 220, 40, 100}, Missed: 1}
+	tracks := []*tracker.Track{marked, other, held}
+
+	cases := []struct {
+		mode     Mode
+		filtered []*tracker.Track
+		dets     int
+	}{
+		{All, []*tracker.Track{marked, other, held}, 2},
+		{Exempt, []*tracker.Track{other, held}, 1},
+		{Target, []*tracker.Track{marked}, 1},
+	}
+	for _, tc := range cases {
+		s := New()
+		s.Mark(marked.ID)
+		s.SetMode(tc.mode)
+
+		got := s.Filter(tracks)
+		if len(got) != len(tc.filtered) {
+			t.Fatalf("%s: got %d tracks, want %d", tc.mode, len(got), len(tc.filtered))
+		}
+		for i := range got {
+			if got[i] != tc.filtered[i] {
+				t.Fatalf("%s: track #%d is %d, want %d", tc.mode, i, got[i].ID, tc.filtered[i].ID)
+			}
+		}
+		// The held tracks have no detection in the current frame.
+		if dets := s.Dets(tracks); len(dets) != tc.dets {
+			t.Fatalf("%s: got %d detections, want %d", tc.mode, len(dets), tc.dets)
+		}
+	}
+}
+
+func TestParseMode(t *testing.T) {
+	for m := All; m < Modes; m++ {
+		if got, ok := ParseMode(m.String()); !ok || got != m {
+			t.Fatalf("ParseMode(%q) = %s, %t", m.String(), got, ok)
+		}
+	}
+	if _, ok := ParseMode("none"); ok {
+		t.Fatal("expected an unknown mode")
+	}
+}
+
+func TestSelectionUpdatePrunesLostFaces(t *testing.T) {
+	s := New()
+	kept := &tracker.Track{ID: 1, Rect: image.Rect(0, 0, 40, 40)}
+	lost := &tracker.Track{ID: 2, Rect: image.Rect(100, 0, 140, 40)}
+	unmarked := &tracker.Track{ID: 3, Rect: image.Rect(200, 0, 240, 40)}
+	s.Update([]*tracker.Track{kept, lost, unmarked})
+	s.Mark(kept.ID)
+	s.Mark(lost.ID)
+	s.Unmark(unmarked.ID)
+
+	s.Update([]*tracker.Track{kept, unmarked})
+	if got := s.Marked(); len(got) != 1 || got[0] != kept.ID {
+		t.Fatalf("marked %v, want [%d]", got, kept.ID)
+	}
+	s.Update([]*tracker.Track{kept})
+	if len(s.ids) != 1 {
+		t.Fatalf("got %d identifiers, want only the tracked face", len(s.ids))
+	}
+}
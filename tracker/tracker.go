@@ -0,0 +1,197 @@
+package tracker
+
+import (
+	"image"
+	"sort"
+)
+
+// maxReportFrames is the maximum number of unconfirmed frame numbers kept in the report.
+const maxReportFrames = 1024
+
+// velocitySmoothing is the weight of the latest movement in the exponential moving average of the velocity.
+const velocitySmoothing = 0.5
+
+// Track is a face followed across the frames.
+type Track struct {
+	ID   int
+	Rect image.Rectangle
+	// Det is the last detection matched with the track, in the format returned by the detector.
+	Det []int
+	// Hits is the number of frames in which the track was matched with a detection.
+	Hits int
+	// Missed is the number of consecutive frames without a matching detection.
+	Missed int
+
+	vx, vy float64 // velocity of the face center in pixels per frame
+}
+
+// Held reports whether the track is kept alive without a matching detection in the current frame.
+func (t *Track) Held() bool {
+	return t.Missed > 0
+}
+
+// Report summarizes the coverage of the tracked faces.
+type Report struct {
+	// Frames is the number of processed frames.
+	Frames int
+	// Confirmed is the number of frames in which every tracked face was matched with a detection.
+	Confirmed int
+	// Dropped is the number of tracks lost after exceeding the hold period.
+	Dropped int
+	// Unconfirmed holds the numbers of the latest frames in which at least one face was
+	// covered only by a held mask, or its track was dropped, so it might have been exposed.
+	Unconfirmed []int
+}
+
+// Tracker matches the face detections of consecutive frames by their intersection over union,
+// assigning persistent identifiers to the faces. The tracks without a matching detection are
+// held for a few frames, so that a missed detection does not expose the face.
+type Tracker struct {
+	// MinIoU is the minimum intersection over union required for matching a detection to a track.
+	MinIoU float64
+	// MaxMissed is the number of frames a track is held after its face is no longer detected.
+	MaxMissed int
+
+	tracks []*Track
+	nextID int
+	report Report
+}
+
+// NewTracker creates a new face tracker.
+func NewTracker(minIoU float64, maxMissed int) *Tracker {
+	return &Tracker{
+		MinIoU:    minIoU,
+		MaxMissed: maxMissed,
+		nextID:    1,
+	}
+}
+
+// DetRect returns the bounding rectangle of a detection returned by the detector.
+func DetRect(det []int) image.Rectangle {
+	x, y, scale := det[1], det[0], det[2]
+	return image.Rect(x-scale/2, y-scale/2, x+scale/2, y+scale/2)
+}
+
+// IoU returns the intersection over union of the two rectangles.
+func IoU(a, b image.Rectangle) float64 {
+	inter := a.Intersect(b)
+	if inter.Empty() {
+		return 0
+	}
+	ia := inter.Dx() * inter.Dy()
+	union := a.Dx()*a.Dy() + b.Dx()*b.Dy() - ia
+	if union <= 0 {
+		return 0
+	}
+	return float64(ia) / float64(union)
+}
+
+// Update matches the detections of the new frame with the existing tracks
+// and returns the active tracks, including the held ones.
+func (t *Tracker) Update(dets [][]int) []*Track {
+	type pair struct {
+		track, det int
+		iou        float64
+	}
+	var pairs []pair
+	for i, tr := range t.tracks {
+		for j, det := range dets {
+			if iou := IoU(tr.Rect, DetRect(det)); iou >= t.MinIoU {
+				pairs = append(pairs, pair{i, j, iou})
+			}
+		}
+	}
+	// Greedily match the pairs with the highest overlap first.
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i].iou > pairs[j].iou })
+
+	matchedTracks := make([]bool, len(t.tracks))
+	matchedDets := make([]bool, len(dets))
+	for _, p := range pairs {
+		if matchedTracks[p.track] || matchedDets[p.det] {
+			continue
+		}
+		matchedTracks[p.track], matchedDets[p.det] = true, true
+		t.tracks[p.track].match(dets[p.det])
+	}
+
+	confirmed := true
+	active := t.tracks[:0]
+	for i, tr := range t.tracks {
+		if matchedTracks[i] {
+			active = append(active, tr)
+			continue
+		}
+		tr.Missed++
+		confirmed = false
+		if tr.Missed > t.MaxMissed {
+			t.report.Dropped++
+			continue
+		}
+		// Move the held track along its last known direction.
+		tr.Rect = tr.Rect.Add(image.Pt(int(tr.vx), int(tr.vy)))
+		active = append(active, tr)
+	}
+	// Clear the references of the dropped tracks.
+	for i := len(active); i < len(t.tracks); i++ {
+		t.tracks[i] = nil
+	}
+	t.tracks = active
+
+	for j, det := range dets {
+		if matchedDets[j] {
+			continue
+		}
+		t.tracks = append(t.tracks, &Track{
+			ID:   t.nextID,
+			Rect: DetRect(det),
+			Det:  det,
+			Hits: 1,
+		})
+		t.nextID++
+	}
+
+	t.report.Frames++
+	if confirmed {
+		t.report.Confirmed++
+	} else {
+		if len(t.report.Unconfirmed) == maxReportFrames {
+			t.report.Unconfirmed = append(t.report.Unconfirmed[:0], t.report.Unconfirmed[1:]...)
+		}
+		t.report.Unconfirmed = append(t.report.Unconfirmed, t.report.Frames)
+	}
+	return t.tracks
+}
+
+// match updates the track with the matching detection.
+func (tr *Track) match(det []int) {
+	rect := DetRect(det)
+	dx := float64(rect.Min.X+rect.Max.X-tr.Rect.Min.X-tr.Rect.Max.X) / 2
+	dy := float64(rect.Min.Y+rect.Max.Y-tr.Rect.Min.Y-tr.Rect.Max.Y) / 2
+	// The velocity is measured only between consecutive detections.
+	if tr.Missed == 0 {
+		tr.vx += (dx - tr.vx) * velocitySmoothing
+		tr.vy += (dy - tr.vy) * velocitySmoothing
+	}
+	tr.Rect = rect
+	tr.Det = det
+	tr.Hits++
+	tr.Missed = 0
+}
+
+// Tracks returns the active tracks.
+func (t *Tracker) Tracks() []*Track {
+	return t.tracks
+}
+
+// Report returns a copy of the coverage report.
+func (t *Tracker) Report() Report {
+	r := t.report
+	r.Unconfirmed = append([]int(nil), t.report.Unconfirmed...)
+	return r
+}
+
+// Reset removes all the tracks and clears the report.
+func (t *Tracker) Reset() {
+	t.tracks = nil
+	t.report = Report{}
+}
@@ -0,0 +1,124 @@
+package tracker
+
+import (
+	"image"
+	"testing"
+)
+
+// det returns a detection of the provided scale centered on the point.
+func det(x, y, scale int) []int {
+	return []int{y, x, scale, 100}
+}
+
+func TestIoU(t *testing.T) {
+	cases := []struct {
+		a, b image.Rectangle
+		want float64
+	}{
+		{image.Rect(0, 0, 10, 10), image.Rect(0, 0, 10, 10), 1},
+		{image.Rect(0, 0, 10, 10), image.Rect(5, 0, 15, 10), 1.0 / 3},
+		{image.Rect(0, 0, 10, 10), image.Rect(10, 0, 20, 10), 0},
+		{image.Rect(0, 0, 10, 10), image.Rect(2, 2, 8, 8), 0.36},
+		{image.Rect(0, 0, 0, 0), image.Rect(0, 0, 0, 0), 0},
+	}
+	for _, tc := range cases {
+		if got := IoU(tc.a, tc.b); got < tc.want-1e-9 || got > tc.want+1e-9 {
+			t.Fatalf("IoU(%v, %v) = %g, want %g", tc.a, tc.b, got, tc.want)
+		}
+	}
+}
+
+func TestTrackerUpdate(t *testing.T) {
+	type track struct{ id, missed int }
+
+	cases := []struct {
+		name      string
+		maxMissed int
+		frames    [][][]int
+		want      []track
+	}{
+		{"moving face keeps its identifier", 2, [][][]int{
+			{det(100, 100, 40)},
+			{det(104, 102, 40)},
+			{det(110, 104, 40)},
+		}, []track{{1, 0}}},
+		{"distant face gets a new identifier", 2, [][][]int{
+			{det(100, 100, 40)},
+			{det(300, 100, 40)},
+		}, []track{{1, 1}, {2, 0}}},
+		{"missed face is held", 2, [][][]int{
+			{det(100, 100, 40)},
+			{},
+			{},
+		}, []track{{1, 2}}},
+		{"held face is dropped", 2, [][][]int{
+			{det(100, 100, 40)},
+			{},
+			{},
+			{},
+		}, nil},
+		{"held face is recovered", 2, [][][]int{
+			{det(100, 100, 40)},
+			{},
+			{det(102, 100, 40)},
+		}, []track{{1, 0}}},
+		{"highest overlap is matched first", 2, [][][]int{
+			{det(100, 100, 40), det(130, 100, 40)},
+			{det(116, 100, 40)},
+		}, []track{{1, 1}, {2, 0}}},
+	}
+	for _, tc := range cases {
+		tr := NewTracker(0.3, tc.maxMissed)
+		var tracks []*Track
+		for _, dets := range tc.frames {
+			tracks = tr.Update(dets)
+		}
+		if len(tracks) != len(tc.want) {
+			t.Fatalf("%s: got %d tracks, want %d", tc.name, len(tracks), len(tc.want))
+		}
+		for i, want := range tc.want {
+			if got := (track{tracks[i].ID, tracks[i].Missed}); got != want {
+				t.Fatalf("%s: track #%d is %+v, want %+v", tc.name, i, got, want)
+			}
+			if tracks[i].Held() != (want.missed > 0) {
+				t.Fatalf("%s: track #%d held %t", tc.name, i, tracks[i].Held())
+			}
+		}
+	}
+}
+
+func TestHeldTrackMoves(t *testing.T) {
+	tr := NewTracker(0.3, 2)
+	tr.Update([][]int{det(100, 100, 40)})
+	tr.Update([][]int{det(108, 100, 40)})
+	tracks := tr.Update(nil)
+
+	// The velocity is smoothed, so the held track moves by half of the last movement.
+	if want := DetRect(det(112, 100, 40)); len(tracks) != 1 || tracks[0].Rect != want {
+		t.Fatalf("got %v, want the held track at %v", tracks, want)
+	}
+}
+
+func TestTrackerReport(t *testing.T) {
+	tr := NewTracker(0.3, 1)
+	for _, dets := range [][][]int{
+		{det(100, 100, 40)},
+		{},
+		{},
+		{det(100, 100, 40)},
+	} {
+		tr.Update(dets)
+	}
+	rep := tr.Report()
+	if rep.Frames != 4 || rep.Confirmed != 2 || rep.Dropped != 1 {
+		t.Fatalf("got %+v, want 4 frames, 2 confirmed and 1 dropped", rep)
+	}
+	if len(rep.Unconfirmed) != 2 || rep.Unconfirmed[0] != 2 || rep.Unconfirmed[1] != 3 {
+		t.Fatalf("unconfirmed frames %v, want [2 3]", rep.Unconfirmed)
+	}
+
+	tr.Reset()
+	if rep := tr.Report(); rep.Frames != 0 || len(tr.Tracks()) != 0 {
+		t.Fatalf("got %+v, want an empty report after reset", rep)
+	}
+}
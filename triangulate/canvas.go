@@ -3,13 +3,19 @@ package triangulate
 import (
 	"fmt"
 	"image"
+	"image/color"
 	"image/draw"
 	"math"
 	"sync"
 	"syscall/js"
 
 	"github.com/esimov/pigo-wasm-demos/detector"
+	"github.com/esimov/pigo-wasm-demos/mask"
+	"github.com/esimov/pigo-wasm-demos/mesh"
 	"github.com/esimov/pigo-wasm-demos/pixels"
+	"github.com/esimov/pigo-wasm-demos/selection"
+	"github.com/esimov/pigo-wasm-demos/tracker"
+	pigocore "github.com/esimov/pigo/core"
 	triangle "github.com/esimov/triangle/v2"
 	"golang.org/x/sync/errgroup"
 )
@@ -45,9 +51,18 @@ type Canvas struct {
 	triangle  *triangle.Image
 	processor *triangle.Processor
 	frame     *image.NRGBA
+	pool      *pixels.FramePool
+	// anchored triangulates the faces over a point set anchored to the facial features,
+	// instead of the points picked from the image edges by the triangle processor.
+	anchored bool
+	meshCfg  mesh.Config
+	// coherent reuses the mesh of each tracked face between the frames, moving it along with the face.
+	coherent bool
+	meshes   *mesh.Cache
 
 	// Canvas interaction related variables
 	showFrame       bool
+	maskKind        mask.Kind
 	isSolid         bool
 	isGrayScaled    bool
 	wireframe       int
@@ -55,6 +70,10 @@ type Canvas struct {
 	pointsThreshold int
 	pointRate       float64
 	strokeWidth     float64
+
+	// Face selection related variables
+	tracker   *tracker.Tracker
+	selection *selection.Selection
 }
 
 const (
@@ -69,6 +88,12 @@ const (
 
 	minStrokeWidth = 0
 	maxStrokeWidth = 4
+
+	// holdFrames is the number of frames a face keeps its track identifier after a missed detection.
+	holdFrames = 10
+
+	// rebuildFrames is the number of frames after which the mesh of a face is rebuilt in the coherent mode.
+	rebuildFrames = 60
 )
 
 var (
@@ -104,6 +129,7 @@ func NewCanvas() *Canvas {
 	c.ctxOffscr = c.offscreen.Call("getContext", "2d")
 
 	c.showFrame = false
+	c.maskKind = mask.Ellipse
 	c.isSolid = false
 	c.isGrayScaled = false
 
@@ -112,6 +138,8 @@ func NewCanvas() *Canvas {
 	c.trianglePoints = 450
 	c.pointsThreshold = 10
 	c.pointRate = 0.075
+	c.meshCfg = mesh.DefaultConfig()
+	c.meshes = mesh.NewCache(rebuildFrames)
 
 	pigo = detector.NewDetector()
 
@@ -130,6 +158,10 @@ func NewCanvas() *Canvas {
 		BgColor:         "#ffffff00",
 	}
 	c.mu = &sync.Mutex{}
+	c.pool = pixels.NewFramePool()
+	c.tracker = tracker.NewTracker(0.1, holdFrames)
+	c.selection = selection.New()
+	c.selection.Expose("faceSelection")
 	g = &errgroup.Group{}
 
 	c.triangle = &triangle.Image{*c.processor}
@@ -141,6 +173,7 @@ func NewCanvas() *Canvas {
 func (c *Canvas) Render() error {
 	width, height := c.windowSize.width, c.windowSize.height
 	var data = make([]byte, width*height*4)
+	var gray = make([]byte, width*height)
 	c.done = make(chan struct{})
 
 	err := pigo.UnpackCascades()
@@ -162,17 +195,30 @@ func (c *Canvas) Render() error {
 			uint8Arr := js.Global().Get("Uint8Array").New(rgba)
 			js.CopyBytesToGo(data, uint8Arr)
 
-			gray := pixels.RgbaToGrayscale(data, width, height)
-
-			// Reset the data slice to its default values to avoid unnecessary memory allocation.
-			// Otherwise, the GC won't clean up the memory address allocated by this slice
-			// and the memory will keep increasing by each iteration.
-			data = make([]byte, len(data))
+			gray = pixels.Grayscale(gray, data, pixels.BT709)
 
 			res := pigo.DetectFaces(gray, height, width)
-			if err := c.drawDetection(res); err != nil {
+			// Track only the faces which are triangulated, so that the identifiers are not spent on false detections.
+			faces := make([][]int, 0, len(res))
+			for _, det := range res {
+				if det[3] > 50 {
+					faces = append(faces, det)
+				}
+			}
+			tracks := c.tracker.Update(faces)
+			c.selection.Update(tracks)
+
+			// The meshes of the held tracks are kept, so that they are reused if the faces are detected again.
+			ids := make([]int, len(tracks))
+			for i, tr := range tracks {
+				ids[i] = tr.ID
+			}
+			c.meshes.Retain(ids)
+
+			if err := c.drawDetection(c.selection.Filter(tracks)); err != nil {
 				return err
 			}
+			c.selection.Draw(c.ctx, tracks)
 			c.window.Get("stats").Call("end")
 
 			return nil
@@ -184,6 +230,9 @@ func (c *Canvas) Render() error {
 
 	c.window.Call("requestAnimationFrame", c.renderer)
 	c.detectKeyPress()
+	c.selection.ListenClicks(c.canvas, func(tr *tracker.Track) {
+		c.Log(fmt.Sprintf("Face #%d marked: %t, selection mode: %s", tr.ID, c.selection.IsMarked(tr), c.selection.Mode()))
+	})
 	<-c.done
 
 	return nil
@@ -253,8 +302,8 @@ func (c *Canvas) StartWebcam() (*Canvas, error) {
 	}
 }
 
-// drawDetection draws the detected faces and eyes.
-func (c *Canvas) drawDetection(dets [][]int) error {
+// drawDetection draws the tracked faces detected in the current frame.
+func (c *Canvas) drawDetection(tracks []*tracker.Track) error {
 	c.processor.MaxPoints = c.trianglePoints
 	c.processor.Grayscale = c.isGrayScaled
 	c.processor.StrokeWidth = c.strokeWidth
@@ -266,8 +315,12 @@ func (c *Canvas) drawDetection(dets [][]int) error {
 	var scaleX, scaleY, invScaleX, invScaleY float64
 	var grad js.Value
 
-	for _, det := range dets {
-		det := det
+	for _, tr := range tracks {
+		// The held tracks are skipped, since their faces were not detected in the current frame.
+		if tr.Held() {
+			continue
+		}
+		id, det := tr.ID, tr.Det
 		g.Go(func() error {
 			leftPupil := pigo.DetectLeftPupil(det)
 			rightPupil := pigo.DetectRightPupil(det)
@@ -280,13 +333,23 @@ func (c *Canvas) drawDetection(dets [][]int) error {
 				row, col, scale := det[1], det[0], int(float64(det[2])*1.1)
 
 				// Substract the image under the detected face region.
-				imgData := make([]byte, scale*scale*4)
+				imgData := c.pool.Get(scale * scale * 4)
 				subimg := c.ctx.Call("getImageData", row-scale/2, col-scale/2, scale, scale).Get("data")
 				uint8Arr := js.Global().Get("Uint8Array").New(subimg)
 				js.CopyBytesToGo(imgData, uint8Arr)
 
-				// Draw the ellipse mask.
-				{
+				// The face contour and the anchored points require both of the pupils.
+				var face *mask.Face
+				if leftPupil != nil && rightPupil != nil && (c.maskKind == mask.Contour || c.anchored) {
+					face = mask.NewFace(leftPupil, rightPupil, pigo.DetectLandmarkPoints(leftPupil, rightPupil))
+				}
+				// Without the pupils fall back to the ellipse mask.
+				useContour := c.maskKind == mask.Contour && face != nil
+				if useContour {
+					c.ctxMask.Call("setTransform", 1, 0, 0, 1, 0, 0)
+					c.ctxMask.Call("clearRect", 0, 0, c.windowSize.width, c.windowSize.height)
+					c.ctxMask.Call("putImageData", mask.ToImageData(face, row-scale/2, col-scale/2, scale), 0, 0)
+				} else { // Draw the ellipse mask.
 					scx, scy := int(float64(scale)*0.8/1.6), int(float64(scale)*0.8/2.1)
 					rx, ry := scx/2, scy/2
 
@@ -317,8 +380,18 @@ func (c *Canvas) drawDetection(dets [][]int) error {
 
 				// Triangulate the detected face region.
 				rect := image.Rect(0, 0, scale, scale)
-				buffer, err := c.triangulate(imgData, rect)
+				var buffer []uint8
+				var err error
+				switch {
+				case c.coherent && leftPupil != nil && rightPupil != nil:
+					buffer, err = c.triangulateCoherent(id, imgData, rect, face, leftPupil, rightPupil, row-scale/2, col-scale/2)
+				case c.anchored && face != nil:
+					buffer = c.renderMesh(c.anchoredMesh(face, rect, row-scale/2, col-scale/2), imgData, rect)
+				default:
+					buffer, err = c.triangulate(imgData, rect)
+				}
 				if err != nil {
+					c.mu.Unlock()
 					return err
 				}
 
@@ -328,6 +401,7 @@ func (c *Canvas) drawDetection(dets [][]int) error {
 				{
 					uint8Arr = js.Global().Get("Uint8Array").New(scale * scale * 4)
 					js.CopyBytesToJS(uint8Arr, buffer)
+					c.pool.Put(buffer)
 
 					uint8Clamped := js.Global().Get("Uint8ClampedArray").New(uint8Arr)
 					rawData := js.Global().Get("ImageData").New(uint8Clamped, scale)
@@ -337,13 +411,16 @@ func (c *Canvas) drawDetection(dets [][]int) error {
 					// Replace the underlying face region with the blurred image.
 					c.ctxOffscr.Call("putImageData", rawData, 0, 0)
 
-					// Calculate the lean angle between the pupils.
-					angle := 1 - (math.Atan2(float64(rightPupil.Col-leftPupil.Col), float64(rightPupil.Row-leftPupil.Row)) * 180 / math.Pi / 90)
-
 					c.ctxOffscr.Call("save")
-					c.ctxOffscr.Call("translate", scale/2, scale/2)
-					c.ctxOffscr.Call("rotate", js.ValueOf(angle).Float())
-					c.ctxOffscr.Call("translate", -scale/2, -scale/2)
+					// The face contour is already fitted over the facial landmarks, so it needs no rotation.
+					if !useContour && leftPupil != nil && rightPupil != nil {
+						// Calculate the lean angle between the pupils.
+						angle := 1 - (math.Atan2(float64(rightPupil.Col-leftPupil.Col), float64(rightPupil.Row-leftPupil.Row)) * 180 / math.Pi / 90)
+
+						c.ctxOffscr.Call("translate", scale/2, scale/2)
+						c.ctxOffscr.Call("rotate", js.ValueOf(angle).Float())
+						c.ctxOffscr.Call("translate", -scale/2, -scale/2)
+					}
 
 					// Apply the ellipse mask over the source image by using composite operation.
 					c.ctxOffscr.Set("globalCompositeOperation", "destination-atop")
@@ -368,20 +445,99 @@ func (c *Canvas) drawDetection(dets [][]int) error {
 	return nil
 }
 
-// triangulate triangulates the detected face region
+// triangulate triangulates the detected face region.
+// The result is written back into the source buffer.
 func (c *Canvas) triangulate(data []uint8, size image.Rectangle) ([]uint8, error) {
-	// Converts the buffer array to an image.
-	img := pixels.PixToImage(data, size)
+	// Wrap the buffer array into an image without copying it.
+	img := pixels.NewNRGBAView(data, size)
 
 	// Call the face triangulation algorithm.
 	triangled, _, _, err := c.triangle.Draw(img, *c.processor, func() {})
 	if err != nil {
 		return nil, err
 	}
-	dst := image.NewNRGBA(triangled.Bounds())
-	draw.Draw(dst, triangled.Bounds(), triangled, image.Point{}, draw.Over)
+	// Reuse the destination image between the frames if the face region size has not changed.
+	if c.frame == nil || c.frame.Rect != triangled.Bounds() {
+		c.frame = image.NewNRGBA(triangled.Bounds())
+	}
+	draw.Draw(c.frame, triangled.Bounds(), triangled, image.Point{}, draw.Src)
 
-	return pixels.ImgToPix(dst), nil
+	return pixels.ImgToPixInto(data, c.frame), nil
+}
+
+// triangulateCoherent triangulates the face with the identifier by reusing its mesh from the previous
+// frames, moved along with the pupils. Only the triangle colors are refreshed on each frame, until the
+// mesh is periodically rebuilt. The face is located at the provided offset from the region.
+// The result is written back into the source buffer.
+func (c *Canvas) triangulateCoherent(id int, data []uint8, size image.Rectangle, face *mask.Face, leftPupil, rightPupil *pigocore.Puploc, x, y int) ([]uint8, error) {
+	// Wrap the buffer array into an image without copying it.
+	img := pixels.NewNRGBAView(data, size)
+
+	t := mesh.PupilTransform(
+		mask.Point{X: float64(leftPupil.Col - x), Y: float64(leftPupil.Row - y)},
+		mask.Point{X: float64(rightPupil.Col - x), Y: float64(rightPupil.Row - y)},
+	)
+	var err error
+	m := c.meshes.Mesh(id, t, func() *mesh.Mesh {
+		if c.anchored && face != nil {
+			return c.anchoredMesh(face, size, x, y)
+		}
+		var pm *mesh.Mesh
+		pm, err = c.processorMesh(img)
+		return pm
+	})
+	if err != nil {
+		return nil, err
+	}
+	return c.renderMesh(m, data, size), nil
+}
+
+// anchoredMesh triangulates the detected face region over the pupils, the landmark points and
+// a grid laid out inside the face contour. The face is located at the provided offset from the region.
+func (c *Canvas) anchoredMesh(face *mask.Face, size image.Rectangle, x, y int) *mesh.Mesh {
+	// The grid density follows the number of points used by the triangle processor.
+	c.meshCfg.GridPoints = c.trianglePoints / 10
+	points, anchors := c.meshCfg.Points(face)
+	return mesh.Triangulate(mask.Translate(points, float64(-x), float64(-y)), anchors, size.Dx(), size.Dy())
+}
+
+// processorMesh triangulates the image over the points picked from its edges by the triangle processor.
+func (c *Canvas) processorMesh(img *image.NRGBA) (*mesh.Mesh, error) {
+	// The processor runs its edge detection filters in place, so it receives a copy of the image.
+	buf := c.pool.Get(len(img.Pix))
+	defer c.pool.Put(buf)
+	copy(buf, img.Pix)
+
+	_, _, points, err := c.triangle.Draw(pixels.NewNRGBAView(buf, img.Rect), *c.processor, func() {})
+	if err != nil {
+		return nil, err
+	}
+	return mesh.Triangulate(mesh.FromTrianglePoints(points), 0, img.Rect.Dx(), img.Rect.Dy()), nil
+}
+
+// renderMesh draws the mesh over the image wrapping the buffer array.
+// The result is written back into the source buffer.
+func (c *Canvas) renderMesh(m *mesh.Mesh, data []uint8, size image.Rectangle) []uint8 {
+	// Wrap the buffer array into an image without copying it.
+	img := pixels.NewNRGBAView(data, size)
+
+	opts := mesh.RenderOptions{Grayscale: c.isGrayScaled}
+	if c.wireframe == triangle.WithWireframe {
+		opts.StrokeWidth = c.strokeWidth
+		opts.StrokeColor = color.NRGBA{A: 20}
+		if c.isSolid {
+			opts.StrokeColor = color.NRGBA{A: 255}
+		}
+	}
+	// The triangle colors are sampled from the source, so the mesh can't be drawn in place. The source
+	// is copied first, since a mesh moved along with the face might not cover the whole region.
+	if c.frame == nil || c.frame.Rect != size {
+		c.frame = image.NewNRGBA(size)
+	}
+	copy(c.frame.Pix, img.Pix)
+	m.Render(c.frame, img, opts)
+
+	return pixels.ImgToPixInto(data, c.frame)
 }
 
 // detectKeyPress listen for the keypress event and retrieves the key code.
@@ -391,6 +547,12 @@ func (c *Canvas) detectKeyPress() {
 		switch {
 		case keyCode.String() == "f":
 			c.showFrame = !c.showFrame
+		case keyCode.String() == "m":
+			if c.maskKind == mask.Ellipse {
+				c.maskKind = mask.Contour
+			} else {
+				c.maskKind = mask.Ellipse
+			}
 		case keyCode.String() == "g":
 			c.isGrayScaled = !c.isGrayScaled
 		case keyCode.String() == "-":
@@ -424,6 +586,19 @@ func (c *Canvas) detectKeyPress() {
 			if c.strokeWidth == minStrokeWidth {
 				c.wireframe = triangle.WithoutWireframe
 			}
+		case keyCode.String() == "a":
+			c.anchored = !c.anchored
+			c.meshes.Reset()
+			c.Log(fmt.Sprintf("Landmark anchored triangulation: %t", c.anchored))
+		case keyCode.String() == "c":
+			c.coherent = !c.coherent
+			c.meshes.Reset()
+			c.Log(fmt.Sprintf("Temporally coherent triangulation: %t", c.coherent))
+		case keyCode.String() == "x":
+			c.selection.SetMode((c.selection.Mode() + 1) % selection.Modes)
+			c.Log("Selection mode: " + c.selection.Mode().String())
+		case keyCode.String() == "u":
+			c.selection.Clear()
 		case keyCode.String() == "2":
 			c.wireframe = triangle.WithWireframe
 			if c.strokeWidth <= maxStrokeWidth {
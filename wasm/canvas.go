@@ -6,6 +6,8 @@ import (
 	"syscall/js"
 
 	"github.com/esimov/pigo-wasm-demos/detector"
+	"github.com/esimov/pigo-wasm-demos/pixels"
+	"github.com/esimov/pigo-wasm-demos/preprocess"
 )
 
 // Canvas struct holds the Javascript objects needed for the Canvas creation
@@ -35,6 +37,11 @@ type Canvas struct {
 	flploc     bool
 	markerType string
 	markerIdx  int
+
+	// Grayscale conversion and preprocessing related variables
+	luma     pixels.Luma
+	preproc  *preprocess.Preprocessor
+	lighting preprocess.Lighting
 }
 
 var det *detector.Detector
@@ -60,6 +67,9 @@ func NewCanvas() *Canvas {
 	c.showCoord = false
 	c.flploc = false
 	c.markerType = "rect"
+	c.luma = pixels.BT709
+	c.preproc = preprocess.NewPreprocessor(preprocess.DefaultConfig())
+	c.lighting = preprocess.GoodLighting
 
 	det = detector.NewDetector()
 	return &c
@@ -69,6 +79,7 @@ func NewCanvas() *Canvas {
 func (c *Canvas) Render() error {
 	width, height := c.windowSize.width, c.windowSize.height
 	var data = make([]byte, width*height*4)
+	var gray = make([]byte, width*height)
 	c.done = make(chan struct{})
 
 	err := det.UnpackCascades()
@@ -88,15 +99,18 @@ func (c *Canvas) Render() error {
 			// be able to transfer it from Javascript to Go via the js.CopyBytesToGo function.
 			uint8Arr := js.Global().Get("Uint8Array").New(rgba)
 			js.CopyBytesToGo(data, uint8Arr)
-			pixels := c.rgbaToGrayscale(data)
-
-			// Empty the data slice to avoid unnecessary memory allocation.
-			// Otherwise, the GC won't clean up the memory address allocated by this slice
-			// and the memory will keep up increasing by each iteration.
-			data = make([]byte, len(data))
+			gray = pixels.Grayscale(gray, data, c.luma)
+			report := c.preproc.Process(gray, width, height)
+			if report.Lighting != c.lighting {
+				c.lighting = report.Lighting
+				c.Log("Lighting conditions: " + c.lighting.String())
+			}
 
-			res := det.DetectFaces(pixels, height, width)
+			res := det.DetectFaces(gray, height, width)
 			c.drawDetection(res)
+			if c.lighting != preprocess.GoodLighting {
+				c.drawLightingWarning()
+			}
 
 			c.window.Get("stats").Call("end")
 		}()
@@ -175,21 +189,6 @@ func (c *Canvas) StartWebcam() (*Canvas, error) {
 	}
 }
 
-// rgbaToGrayscale converts the rgb pixel values to grayscale
-func (c *Canvas) rgbaToGrayscale(data []uint8) []uint8 {
-	rows, cols := c.windowSize.width, c.windowSize.height
-	for r := 0; r < rows; r++ {
-		for c := 0; c < cols; c++ {
-			// gray = 0.2*red + 0.7*green + 0.1*blue
-			data[r*cols+c] = uint8(math.Round(
-				0.2126*float64(data[r*4*cols+4*c+0]) +
-					0.7152*float64(data[r*4*cols+4*c+1]) +
-					0.0722*float64(data[r*4*cols+4*c+2])))
-		}
-	}
-	return data
-}
-
 // drawDetection draws the detected faces and eyes.
 func (c *Canvas) drawDetection(dets [][]int) {
 	for i := 0; i < len(dets); i++ {
@@ -252,6 +251,18 @@ func (c *Canvas) drawDetection(dets [][]int) {
 	}
 }
 
+// drawLightingWarning notifies the user that the lighting conditions are too poor for a reliable detection.
+func (c *Canvas) drawLightingWarning() {
+	message := "Poor lighting: " + c.lighting.String()
+
+	c.ctx.Set("font", "18px Arial")
+	txtWidth := c.ctx.Call("measureText", js.ValueOf(message)).Get("width").Int()
+	c.ctx.Set("fillStyle", "rgba(0, 0, 0, 0.6)")
+	c.ctx.Call("fillRect", 10, 10, txtWidth+20, 32)
+	c.ctx.Set("fillStyle", "rgb(255, 200, 0)")
+	c.ctx.Call("fillText", message, 20, 32)
+}
+
 // detectKeyPress listen for the keypress event and retrieves the key code.
 func (c *Canvas) detectKeyPress() {
 	keyEventHandler := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
@@ -275,6 +286,15 @@ func (c *Canvas) detectKeyPress() {
 			c.flploc = !c.flploc
 		case keyCode.String() == "x":
 			c.showCoord = !c.showCoord
+		case keyCode.String() == "l":
+			c.luma = (c.luma + 1) % (pixels.Average + 1)
+			c.Log("Grayscale luma standard: " + c.luma.String())
+		case keyCode.String() == "h":
+			c.preproc.Equalization = (c.preproc.Equalization + 1) % (pixels.CLAHEqualization + 1)
+			c.Log("Histogram equalization: " + c.preproc.Equalization.String())
+		case keyCode.String() == "p":
+			c.preproc.Enabled = !c.preproc.Enabled
+			c.Log(fmt.Sprintf("Low-light preprocessing enabled: %v", c.preproc.Enabled))
 		}
 		return nil
 	})